@@ -0,0 +1,412 @@
+package forward
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	BalanceRoundRobin       = "round-robin"
+	BalanceLeastConnections = "least-conn"
+	BalanceCookie           = "cookie"
+	BalanceIPHash           = "ip-hash"
+
+	stickyCookieName = "forward_upstream"
+
+	defaultHealthCheckInterval = 10 * time.Second
+	defaultFailTimeout         = 30 * time.Second
+)
+
+type upstreamContextKey struct{}
+
+type upstream struct {
+	URL *url.URL
+	id  string // stable identifier used by sticky cookie
+
+	active int64 // in-flight requests, accessed atomically
+
+	mux          sync.Mutex
+	down         bool      // marked as down by active health check
+	fails        int       // consecutive failures
+	ejectedUntil time.Time // passive ejection deadline
+	lastCheck    time.Time
+	lastError    string
+}
+
+type upstreamStatus struct {
+	URL                 string     `json:"url"`
+	Healthy             bool       `json:"healthy"`
+	ActiveConnections   int64      `json:"active_connections"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	EjectedUntil        *time.Time `json:"ejected_until,omitempty"`
+	LastCheck           *time.Time `json:"last_check,omitempty"`
+	LastError           string     `json:"last_error,omitempty"`
+}
+
+func newUpstream(u *url.URL) *upstream {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(u.String()))
+
+	return &upstream{
+		URL: u,
+		id:  fmt.Sprintf("%08x", h.Sum32()),
+	}
+}
+
+// expireEjection counts the failures from zero once the ejection has ended, the caller holds the lock.
+func (u *upstream) expireEjection(now time.Time) {
+	if !u.ejectedUntil.IsZero() && !now.Before(u.ejectedUntil) {
+		u.fails = 0
+		u.ejectedUntil = time.Time{}
+	}
+}
+
+func (u *upstream) available(now time.Time) bool {
+	u.mux.Lock()
+	defer u.mux.Unlock()
+
+	u.expireEjection(now)
+
+	return !u.down && !now.Before(u.ejectedUntil)
+}
+
+func (u *upstream) status(now time.Time) upstreamStatus {
+	u.mux.Lock()
+	defer u.mux.Unlock()
+
+	u.expireEjection(now)
+
+	s := upstreamStatus{
+		URL:                 u.URL.String(),
+		Healthy:             !u.down && !now.Before(u.ejectedUntil),
+		ActiveConnections:   atomic.LoadInt64(&u.active),
+		ConsecutiveFailures: u.fails,
+		LastError:           u.lastError,
+	}
+
+	if now.Before(u.ejectedUntil) {
+		t := u.ejectedUntil
+		s.EjectedUntil = &t
+	}
+
+	if !u.lastCheck.IsZero() {
+		t := u.lastCheck
+		s.LastCheck = &t
+	}
+
+	return s
+}
+
+type upstreamPool struct {
+	upstreams []*upstream
+	strategy  string
+	maxFails  int
+	timeout   time.Duration // passive ejection duration
+	limit     int64         // the max number of in-flight requests per upstream, unlimited if 0
+	next      uint32        // round robin counter, accessed atomically
+	stop      chan struct{}
+
+	hosts   []string        // the host of every member, all of them are treated as the origin host
+	hostSet map[string]bool // the hosts for the lookup on every request
+}
+
+func newUpstreamPool(options *ProxyServerOptions) *upstreamPool {
+	pool := &upstreamPool{
+		strategy: options.Balance,
+		maxFails: options.MaxFails,
+		timeout:  options.FailTimeout,
+		limit:    options.UpstreamConcurrency,
+		stop:     make(chan struct{}),
+		hostSet:  map[string]bool{},
+	}
+
+	if pool.timeout <= 0 {
+		pool.timeout = defaultFailTimeout
+	}
+
+	seen := map[string]struct{}{}
+
+	for _, u := range append([]*url.URL{options.Target}, options.Upstreams...) {
+		if u == nil {
+			continue
+		}
+		if _, ok := seen[u.String()]; ok {
+			continue
+		}
+		seen[u.String()] = struct{}{}
+		pool.upstreams = append(pool.upstreams, newUpstream(u))
+
+		if !pool.hostSet[u.Host] {
+			pool.hostSet[u.Host] = true
+			pool.hosts = append(pool.hosts, u.Host)
+		}
+	}
+
+	return pool
+}
+
+func (p *upstreamPool) has(host string) bool {
+	return p.hostSet[host]
+}
+
+// pick selects an upstream for the request with the configured strategy.
+// When every member is unhealthy or busy, all of them are considered to avoid a total outage.
+func (p *upstreamPool) pick(r *http.Request) *upstream {
+	now := time.Now()
+	candidates := make([]*upstream, 0, len(p.upstreams))
+
+	for _, u := range p.upstreams {
+		if u.available(now) && (p.limit <= 0 || atomic.LoadInt64(&u.active) < p.limit) {
+			candidates = append(candidates, u)
+		}
+	}
+
+	if len(candidates) == 0 {
+		candidates = p.upstreams
+	}
+
+	if len(candidates) == 1 {
+		return candidates[0]
+	}
+
+	switch p.strategy {
+	case BalanceLeastConnections:
+		picked := candidates[0]
+
+		for _, u := range candidates[1:] {
+			if atomic.LoadInt64(&u.active) < atomic.LoadInt64(&picked.active) {
+				picked = u
+			}
+		}
+
+		return picked
+	case BalanceCookie:
+		if c, err := r.Cookie(stickyCookieName); err == nil {
+			for _, u := range candidates {
+				if u.id == c.Value {
+					return u
+				}
+			}
+		}
+	case BalanceIPHash:
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(clientIP(r)))
+
+		return candidates[h.Sum32()%uint32(len(candidates))]
+	}
+
+	n := atomic.AddUint32(&p.next, 1)
+
+	return candidates[(n-1)%uint32(len(candidates))]
+}
+
+// acquire counts an in-flight request of the upstream,
+// it returns false if the upstream has reached the concurrency limit.
+func (p *upstreamPool) acquire(u *upstream) bool {
+	if n := atomic.AddInt64(&u.active, 1); p.limit > 0 && n > p.limit {
+		atomic.AddInt64(&u.active, -1)
+		return false
+	}
+
+	return true
+}
+
+func (p *upstreamPool) release(u *upstream) {
+	atomic.AddInt64(&u.active, -1)
+}
+
+// markFailure counts a failure for the upstream and ejects it after too many consecutive failures.
+func (p *upstreamPool) markFailure(u *upstream, err error) {
+	u.mux.Lock()
+	defer u.mux.Unlock()
+
+	now := time.Now()
+
+	u.expireEjection(now)
+
+	u.fails++
+	u.lastError = err.Error()
+
+	if p.maxFails > 0 && u.fails >= p.maxFails {
+		u.ejectedUntil = now.Add(p.timeout)
+		log.Printf("upstream '%s' ejected for %s after %d consecutive failures\n", u.URL, p.timeout, u.fails)
+	}
+}
+
+func (p *upstreamPool) markSuccess(u *upstream) {
+	u.mux.Lock()
+	defer u.mux.Unlock()
+
+	u.fails = 0
+	u.lastError = ""
+}
+
+// healthCheck periodically requests the health check path of every member.
+func (p *upstreamPool) healthCheck(transport http.RoundTripper, path string, interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultHealthCheckInterval
+	}
+
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   interval,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	check := func() {
+		var wg sync.WaitGroup
+
+		for _, u := range p.upstreams {
+			wg.Add(1)
+			go func(u *upstream) {
+				defer wg.Done()
+				p.checkUpstream(client, u, path)
+			}(u)
+		}
+
+		wg.Wait()
+	}
+
+	check()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			check()
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+func (p *upstreamPool) checkUpstream(client *http.Client, u *upstream, path string) {
+	checkURL := *u.URL
+	checkURL.Path = "/" + strings.TrimLeft(path, "/")
+	checkURL.RawQuery = ""
+
+	var checkErr error
+
+	if res, err := client.Get(checkURL.String()); err != nil {
+		checkErr = err
+	} else {
+		_ = res.Body.Close()
+
+		if res.StatusCode >= http.StatusBadRequest {
+			checkErr = fmt.Errorf("health check '%s' responded with status %d", checkURL.String(), res.StatusCode)
+		}
+	}
+
+	u.mux.Lock()
+	defer u.mux.Unlock()
+
+	wasDown := u.down
+
+	u.lastCheck = time.Now()
+	u.down = checkErr != nil
+
+	if checkErr != nil {
+		u.lastError = checkErr.Error()
+	} else {
+		u.fails = 0
+		u.lastError = ""
+		u.ejectedUntil = time.Time{}
+	}
+
+	if wasDown != u.down {
+		if u.down {
+			log.Printf("upstream '%s' is unhealthy: %s\n", u.URL, checkErr)
+		} else {
+			log.Printf("upstream '%s' is healthy\n", u.URL)
+		}
+	}
+}
+
+func (p *upstreamPool) status() []upstreamStatus {
+	now := time.Now()
+	status := make([]upstreamStatus, 0, len(p.upstreams))
+
+	for _, u := range p.upstreams {
+		status = append(status, u.status(now))
+	}
+
+	return status
+}
+
+func upstreamFromContext(ctx context.Context) *upstream {
+	u, _ := ctx.Value(upstreamContextKey{}).(*upstream)
+
+	return u
+}
+
+// serveProxy picks an upstream for the request and proxies it.
+func (p *ProxyServer) serveProxy(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	p.metrics.served.inc(sourceUpstream)
+
+	// the request of a forward proxy client goes to the host it requested
+	if forwardTargetFromContext(ctx) == nil && len(p.pool.upstreams) > 0 {
+		u := p.pool.pick(r)
+
+		if !p.pool.acquire(u) {
+			log.Printf("upstream '%s' is busy with %d requests\n", u.URL, p.pool.limit)
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "all upstreams have reached the concurrency limit", http.StatusServiceUnavailable)
+			return
+		}
+
+		defer p.pool.release(u)
+
+		ctx = context.WithValue(ctx, upstreamContextKey{}, u)
+	}
+
+	if p.RequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.RequestTimeout)
+		defer cancel()
+	}
+
+	r = r.WithContext(ctx)
+
+	if p.grpcProxy != nil && isGRPCContentType(r.Header.Get("Content-Type")) {
+		p.serveGRPC(w, r)
+		return
+	}
+
+	p.proxy.ServeHTTP(w, r)
+}
+
+// setStickyCookie pins the client to the upstream which served the response, with the cookie balance.
+func (p *ProxyServer) setStickyCookie(res *http.Response, u *upstream) {
+	if p.Balance != BalanceCookie {
+		return
+	}
+
+	if c, err := res.Request.Cookie(stickyCookieName); err != nil || c.Value != u.id {
+		res.Header.Add("Set-Cookie", (&http.Cookie{Name: stickyCookieName, Value: u.id, Path: "/", HttpOnly: true}).String())
+	}
+}
+
+// upstreamHandler shows the status of the upstreams as JSON.
+func (p *ProxyServer) upstreamHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+
+	_ = encoder.Encode(p.pool.status())
+}
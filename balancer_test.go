@@ -0,0 +1,126 @@
+package forward
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestPool(strategy string, maxFails int, hosts ...string) *upstreamPool {
+	options := &ProxyServerOptions{Balance: strategy, MaxFails: maxFails}
+
+	for i, host := range hosts {
+		u, _ := url.Parse("http://" + host)
+		if i == 0 {
+			options.Target = u
+		} else {
+			options.Upstreams = append(options.Upstreams, u)
+		}
+	}
+
+	return newUpstreamPool(options)
+}
+
+func Test_upstreamPool_pick(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	t.Run("round-robin", func(t *testing.T) {
+		pool := newTestPool(BalanceRoundRobin, 0, "a", "b", "c")
+
+		got := []string{}
+		for i := 0; i < 4; i++ {
+			got = append(got, pool.pick(req).URL.Host)
+		}
+
+		if want := []string{"a", "b", "c", "a"}; !equalStrings(got, want) {
+			t.Errorf("pick() = %v, want %v", got, want)
+		}
+	})
+
+	t.Run("least-conn", func(t *testing.T) {
+		pool := newTestPool(BalanceLeastConnections, 0, "a", "b")
+		atomic.AddInt64(&pool.upstreams[0].active, 2)
+
+		if got := pool.pick(req).URL.Host; got != "b" {
+			t.Errorf("pick() = %v, want %v", got, "b")
+		}
+	})
+
+	t.Run("cookie", func(t *testing.T) {
+		pool := newTestPool(BalanceCookie, 0, "a", "b")
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.AddCookie(&http.Cookie{Name: stickyCookieName, Value: pool.upstreams[1].id})
+
+		for i := 0; i < 3; i++ {
+			if got := pool.pick(r).URL.Host; got != "b" {
+				t.Errorf("pick() = %v, want %v", got, "b")
+			}
+		}
+	})
+
+	t.Run("ip-hash", func(t *testing.T) {
+		pool := newTestPool(BalanceIPHash, 0, "a", "b", "c")
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = "10.0.0.1:1234"
+		first := pool.pick(r)
+		r.RemoteAddr = "10.0.0.1:5678"
+
+		if got := pool.pick(r); got != first {
+			t.Errorf("pick() = %v, want %v", got.URL, first.URL)
+		}
+	})
+
+	t.Run("passive ejection", func(t *testing.T) {
+		pool := newTestPool(BalanceRoundRobin, 2, "a", "b")
+
+		pool.markFailure(pool.upstreams[0], errors.New("connection refused"))
+		pool.markFailure(pool.upstreams[0], errors.New("connection refused"))
+
+		for i := 0; i < 3; i++ {
+			if got := pool.pick(req).URL.Host; got != "b" {
+				t.Errorf("pick() = %v, want %v", got, "b")
+			}
+		}
+
+		if status := pool.status(); status[0].Healthy || !status[1].Healthy {
+			t.Errorf("status() = %+v", status)
+		}
+
+		// the ejection has ended, a single failure does not eject it again
+		pool.upstreams[0].ejectedUntil = time.Now().Add(-time.Second)
+		pool.markFailure(pool.upstreams[0], errors.New("connection refused"))
+
+		if status := pool.status(); !status[0].Healthy || status[0].ConsecutiveFailures != 1 {
+			t.Errorf("status() = %+v", status)
+		}
+	})
+}
+
+func Test_replaceHosts(t *testing.T) {
+	got := replaceHosts("https://a.example.com/1 https://b.example.com/2 https://c.example.com/3", []string{"a.example.com", "b.example.com"}, "localhost:8080", false, false, nil)
+	want := "http://localhost:8080/1 http://localhost:8080/2 https://c.example.com/3"
+
+	if got != want {
+		t.Errorf("replaceHosts() = %v, want %v", got, want)
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,208 @@
+package forward
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// the bytes of HTML scanned for the meta charset, the same as browsers
+const metaCharsetScanLen = 1024
+
+var (
+	// <meta charset="gbk"> or <meta http-equiv="Content-Type" content="text/html; charset=gbk">
+	regMetaCharset = regexp.MustCompile(`(?i)(<meta\s[^>]*charset\s*=\s*["']?)([\w.:-]+)`)
+	// @charset "GBK";
+	regCSSCharset = regexp.MustCompile(`^(@charset\s+["'])([\w.:-]+)`)
+)
+
+var boms = []struct {
+	bom     []byte
+	charset string
+}{
+	{bom: []byte("\xef\xbb\xbf"), charset: "utf-8"},
+	{bom: []byte("\xfe\xff"), charset: "utf-16be"},
+	{bom: []byte("\xff\xfe"), charset: "utf-16le"},
+}
+
+// contentCharset is the charset of the content which is not UTF-8.
+type contentCharset struct {
+	name     string // the canonical name, eg. gbk, shift_jis or windows-1252 for ISO-8859-1
+	encoding encoding.Encoding
+	bom      []byte // the BOM of the content, it is written back as it is
+}
+
+// lookupCharset returns the charset of the label, nil for UTF-8 or the unknown label.
+func lookupCharset(label string) *contentCharset {
+	e, err := htmlindex.Get(strings.TrimSpace(label))
+
+	if err != nil {
+		return nil
+	}
+
+	name, err := htmlindex.Name(e)
+
+	// the content of the replacement encoding could not be decoded
+	if err != nil || name == "utf-8" || name == "replacement" {
+		return nil
+	}
+
+	return &contentCharset{name: name, encoding: e}
+}
+
+// detectCharset detects the charset from the BOM, the charset of Content-Type, then the declaration in the content.
+// It returns nil for UTF-8 content or the unknown charset.
+func detectCharset(contentType string, body []byte, kind string, fallback string) *contentCharset {
+	for _, b := range boms {
+		if bytes.HasPrefix(body, b.bom) {
+			charset := lookupCharset(b.charset)
+
+			if charset != nil {
+				charset.bom = b.bom
+			}
+
+			return charset
+		}
+	}
+
+	if _, params, err := mime.ParseMediaType(contentType); err == nil && params["charset"] != "" {
+		return lookupCharset(params["charset"])
+	}
+
+	switch kind {
+	case contentHTML:
+		head := body
+
+		if len(head) > metaCharsetScanLen {
+			head = head[:metaCharsetScanLen]
+		}
+
+		if sub := regMetaCharset.FindSubmatch(head); sub != nil {
+			return lookupCharset(string(sub[2]))
+		}
+	case contentCSS:
+		if sub := regCSSCharset.FindSubmatch(body); sub != nil {
+			return lookupCharset(string(sub[2]))
+		}
+	}
+
+	if fallback != "" {
+		return lookupCharset(fallback)
+	}
+
+	return nil
+}
+
+// decode transcodes the content to UTF-8 without the BOM.
+func (c *contentCharset) decode(body []byte) ([]byte, error) {
+	content, err := c.encoding.NewDecoder().Bytes(bytes.TrimPrefix(body, c.bom))
+
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	// the invalid bytes are decoded as U+FFFD, which could not be encoded back
+	if bytes.ContainsRune(content, utf8.RuneError) {
+		return nil, fmt.Errorf("the content is not valid %s", c.name)
+	}
+
+	return content, nil
+}
+
+// encoder returns the encoder of the charset, the characters not supported are
+// written as the character references in HTML, or replaced in the others.
+func (c *contentCharset) encoder(kind string) *encoding.Encoder {
+	if kind == contentHTML || kind == contentSVG || kind == contentXML {
+		return encoding.HTMLEscapeUnsupported(c.encoding.NewEncoder())
+	}
+
+	return encoding.ReplaceUnsupported(c.encoding.NewEncoder())
+}
+
+// encode transcodes the UTF-8 content back to the charset.
+func (c *contentCharset) encode(content []byte, kind string) ([]byte, error) {
+	body, err := c.encoder(kind).Bytes(content)
+
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return append(append([]byte{}, c.bom...), body...), nil
+}
+
+// setUTF8Charset declares the content as UTF-8 in Content-Type.
+func setUTF8Charset(header http.Header) {
+	if t, params, err := mime.ParseMediaType(header.Get("Content-Type")); err == nil {
+		params["charset"] = "utf-8"
+		header.Set("Content-Type", mime.FormatMediaType(t, params))
+	}
+}
+
+// declareUTF8Charset declares the content as UTF-8 in the meta of HTML, or @charset of CSS.
+func declareUTF8Charset(content []byte, kind string) []byte {
+	switch kind {
+	case contentHTML:
+		head := content
+		rest := []byte{}
+
+		if len(head) > metaCharsetScanLen {
+			head, rest = content[:metaCharsetScanLen], content[metaCharsetScanLen:]
+		}
+
+		head = regMetaCharset.ReplaceAll(head, []byte("${1}utf-8"))
+
+		return append(head, rest...)
+	case contentCSS:
+		return regCSSCharset.ReplaceAll(content, []byte("${1}UTF-8"))
+	}
+
+	return content
+}
+
+// withUTF8Charset declares the content as UTF-8 in Content-Type and the content.
+func withUTF8Charset(header http.Header, content []byte, kind string) []byte {
+	setUTF8Charset(header)
+
+	return declareUTF8Charset(content, kind)
+}
+
+// modifyCharsetContent rewrites the content as UTF-8, the content of other charsets is transcoded,
+// so that the replacements written in UTF-8 are matched.
+func (p *ProxyServer) modifyCharsetContent(kind string, body []byte, header http.Header, m hostMapping) []byte {
+	charset := detectCharset(header.Get("Content-Type"), body, kind, p.DefaultCharset)
+
+	if charset == nil {
+		return p.modifyContent(kind, body, m)
+	}
+
+	content, err := charset.decode(body)
+
+	if err != nil {
+		log.Printf("WARN: rewrite the content as UTF-8: %+v\n", err)
+		return p.modifyContent(kind, body, m)
+	}
+
+	content = p.modifyContent(kind, content, m)
+
+	if p.ServeUTF8 {
+		return withUTF8Charset(header, content, kind)
+	}
+
+	newBody, err := charset.encode(content, kind)
+
+	if err != nil {
+		log.Printf("WARN: could not encode the content as %s: %+v\n", charset.name, err)
+		return withUTF8Charset(header, content, kind)
+	}
+
+	return newBody
+}
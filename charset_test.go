@@ -0,0 +1,143 @@
+package forward
+
+import (
+	"net/http"
+	"testing"
+
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+func encodeCharset(t *testing.T, charset, s string) string {
+	e, err := htmlindex.Get(charset)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := e.NewEncoder().String(s)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return b
+}
+
+func Test_detectCharset(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		kind        string
+		fallback    string
+		want        string
+	}{
+		{name: "content type", contentType: "text/html; charset=GB2312", kind: contentHTML, want: "gbk"},
+		{name: "iso-8859-1", contentType: "text/plain; charset=ISO-8859-1", kind: contentText, want: "windows-1252"},
+		{name: "utf-8", contentType: "text/html; charset=utf-8", body: `<meta charset="gbk">`, kind: contentHTML, want: ""},
+		{name: "meta", contentType: "text/html", body: `<html><head><meta charset="Shift_JIS">`, kind: contentHTML, want: "shift_jis"},
+		{name: "http-equiv", body: `<META HTTP-EQUIV="Content-Type" CONTENT="text/html; charset=gbk">`, kind: contentHTML, want: "gbk"},
+		{name: "meta of text", contentType: "text/plain", body: `<meta charset="gbk">`, kind: contentText, want: ""},
+		{name: "css", contentType: "text/css", body: `@charset "GBK"; body {}`, kind: contentCSS, want: "gbk"},
+		{name: "bom", contentType: "text/html; charset=gbk", body: "\xef\xbb\xbf<html>", kind: contentHTML, want: ""},
+		{name: "utf-16 bom", contentType: "text/plain", body: "\xff\xfea\x00", kind: contentText, want: "utf-16le"},
+		{name: "fallback", contentType: "text/html", body: "<html>", kind: contentHTML, fallback: "gbk", want: "gbk"},
+		{name: "unknown", contentType: "text/html; charset=unknown", kind: contentHTML, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ""
+
+			if charset := detectCharset(tt.contentType, []byte(tt.body), tt.kind, tt.fallback); charset != nil {
+				got = charset.name
+			}
+
+			if got != tt.want {
+				t.Errorf("detectCharset() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProxyServer_modifyCharsetContent(t *testing.T) {
+	m := hostMapping{originHosts: []string{"example.com"}, proxyHost: "localhost:8080"}
+
+	tests := []struct {
+		name            string
+		options         ProxyServerOptions
+		contentType     string
+		kind            string
+		body            string
+		want            string
+		wantContentType string
+	}{
+		{
+			name:            "gbk",
+			options:         ProxyServerOptions{ReplaceContent: []string{"你好=再见"}},
+			contentType:     "text/html; charset=gbk",
+			kind:            contentHTML,
+			body:            encodeCharset(t, "gbk", `<a href="https://example.com/首页">你好</a>`),
+			want:            encodeCharset(t, "gbk", `<a href="http://localhost:8080/首页">再见</a>`),
+			wantContentType: "text/html; charset=gbk",
+		},
+		{
+			name:            "not supported by the charset",
+			options:         ProxyServerOptions{ReplaceContent: []string{"a=😀"}},
+			contentType:     "text/html; charset=shift_jis",
+			kind:            contentHTML,
+			body:            encodeCharset(t, "shift_jis", "<p>a日本</p>"),
+			want:            encodeCharset(t, "shift_jis", "<p>&#128512;日本</p>"),
+			wantContentType: "text/html; charset=shift_jis",
+		},
+		{
+			name:            "iso-8859-1",
+			options:         ProxyServerOptions{ReplaceContent: []string{"café=bar"}},
+			contentType:     "text/plain; charset=iso-8859-1",
+			kind:            contentText,
+			body:            "caf\xe9 na\xefve",
+			want:            "bar na\xefve",
+			wantContentType: "text/plain; charset=iso-8859-1",
+		},
+		{
+			name:            "serve utf-8",
+			options:         ProxyServerOptions{ServeUTF8: true},
+			contentType:     "text/html",
+			kind:            contentHTML,
+			body:            encodeCharset(t, "gbk", `<meta charset="gbk"><a href="https://example.com/">你好</a>`),
+			want:            `<meta charset="utf-8"><a href="http://localhost:8080/">你好</a>`,
+			wantContentType: "text/html; charset=utf-8",
+		},
+		{
+			name:            "serve utf-8 css",
+			options:         ProxyServerOptions{ServeUTF8: true, DefaultCharset: "gbk"},
+			contentType:     "text/css",
+			kind:            contentCSS,
+			body:            encodeCharset(t, "gbk", `@charset "GBK"; a::after { content: "你好" }`),
+			want:            `@charset "UTF-8"; a::after { content: "你好" }`,
+			wantContentType: "text/css; charset=utf-8",
+		},
+		{
+			name:            "invalid",
+			options:         ProxyServerOptions{},
+			contentType:     "text/plain; charset=shift_jis",
+			kind:            contentText,
+			body:            "https://example.com/\x81",
+			want:            "http://localhost:8080/\x81",
+			wantContentType: "text/plain; charset=shift_jis",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &ProxyServer{ProxyServerOptions: &tt.options, metrics: newMetrics(nil)}
+			header := http.Header{"Content-Type": []string{tt.contentType}}
+
+			if got := string(p.modifyCharsetContent(tt.kind, []byte(tt.body), header, m)); got != tt.want {
+				t.Errorf("modifyCharsetContent() = %q, want %q", got, tt.want)
+			}
+
+			if got := header.Get("Content-Type"); got != tt.wantContentType {
+				t.Errorf("Content-Type = %q, want %q", got, tt.wantContentType)
+			}
+		})
+	}
+}
@@ -0,0 +1,277 @@
+package forward
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	headerForwarded       = "Forwarded"
+	headerXForwardedFor   = "X-Forwarded-For"
+	headerXForwardedProto = "X-Forwarded-Proto"
+	headerXForwardedHost  = "X-Forwarded-Host"
+	headerXForwardedPort  = "X-Forwarded-Port"
+	headerXRealIP         = "X-Real-IP"
+)
+
+type clientIPContextKey struct{}
+
+// ParseTrustedProxy parses the CIDR like "10.0.0.0/8" or a single IP address.
+func ParseTrustedProxy(value string) (*net.IPNet, error) {
+	ipNet, err := parseIPNet(value)
+
+	return ipNet, errors.Wrapf(err, "invalid trusted proxy '%s'", value)
+}
+
+// ParseForwardProxyClient parses the client of the forward proxy like "192.168.0.0/16" or a single IP address.
+func ParseForwardProxyClient(value string) (*net.IPNet, error) {
+	ipNet, err := parseIPNet(value)
+
+	return ipNet, errors.Wrapf(err, "invalid forward proxy client '%s'", value)
+}
+
+func parseIPNet(value string) (*net.IPNet, error) {
+	if !strings.Contains(value, "/") {
+		ip := net.ParseIP(value)
+
+		if ip == nil {
+			return nil, errors.New("not an IP address")
+		}
+
+		bits := 8 * net.IPv6len
+
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+
+	_, ipNet, err := net.ParseCIDR(value)
+
+	return ipNet, errors.WithStack(err)
+}
+
+// isTrustedProxy reports whether the address is one of the trusted proxies.
+func (p *ProxyServer) isTrustedProxy(addr string) bool {
+	ip := net.ParseIP(strings.Trim(addr, "[]"))
+
+	if ip == nil {
+		return false
+	}
+
+	for _, ipNet := range p.TrustedProxies {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// remoteIP returns the IP address of the peer without port.
+func remoteIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+
+	return r.RemoteAddr
+}
+
+// clientIP returns the IP address of the client without port,
+// which is resolved through the trusted proxies by withClientIP.
+func clientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPContextKey{}).(string); ok {
+		return ip
+	}
+
+	return remoteIP(r)
+}
+
+// withClientIP resolves the client IP address. When the peer is a trusted proxy, the addresses
+// of X-Forwarded-For or Forwarded are walked from right to left, the first untrusted one is the client.
+func (p *ProxyServer) withClientIP(r *http.Request) *http.Request {
+	ip := remoteIP(r)
+
+	if p.isTrustedProxy(ip) {
+		chain := forwardedFor(r.Header)
+
+		for i := len(chain) - 1; i >= 0; i-- {
+			if net.ParseIP(chain[i]) == nil {
+				// obfuscated or unknown, the client can not be resolved any further
+				break
+			}
+
+			ip = chain[i]
+
+			if !p.isTrustedProxy(ip) {
+				break
+			}
+		}
+	}
+
+	return r.WithContext(context.WithValue(r.Context(), clientIPContextKey{}, ip))
+}
+
+// forwardedFor returns the addresses of the proxy chain, from X-Forwarded-For or the "for" of Forwarded.
+func forwardedFor(h http.Header) []string {
+	chain := []string{}
+
+	if values := h.Values(headerXForwardedFor); len(values) > 0 {
+		for _, v := range strings.Split(strings.Join(values, ","), ",") {
+			v = strings.TrimSpace(v)
+
+			// some proxies append the port, eg. "192.0.2.43:47011" or "[2001:db8::1]:4711"
+			if host, _, err := net.SplitHostPort(v); err == nil {
+				v = host
+			}
+
+			if v = strings.Trim(v, "[]"); v != "" {
+				chain = append(chain, v)
+			}
+		}
+
+		return chain
+	}
+
+	for _, element := range parseForwarded(h.Values(headerForwarded)) {
+		addr := element["for"]
+
+		// the address may have a port, eg. "[2001:db8::1]:4711" or "192.0.2.43:47011"
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			addr = host
+		}
+
+		chain = append(chain, strings.Trim(addr, "[]"))
+	}
+
+	return chain
+}
+
+// parseForwarded parses the elements of the Forwarded headers defined by RFC 7239,
+// like `for=192.0.2.60;proto=http;by=203.0.113.43, for="[2001:db8:cafe::17]"`.
+func parseForwarded(values []string) []map[string]string {
+	elements := []map[string]string{}
+
+	for _, value := range values {
+		for _, element := range splitQuoted(value, ',') {
+			pairs := map[string]string{}
+
+			for _, pair := range splitQuoted(element, ';') {
+				kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+
+				if len(kv) != 2 {
+					continue
+				}
+
+				pairs[strings.ToLower(kv[0])] = strings.Trim(kv[1], `"`)
+			}
+
+			if len(pairs) > 0 {
+				elements = append(elements, pairs)
+			}
+		}
+	}
+
+	return elements
+}
+
+// splitQuoted splits the string by the separator outside quotes.
+func splitQuoted(s string, sep byte) []string {
+	parts := []string{}
+	quoted := false
+	start := 0
+
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			quoted = !quoted
+		case sep:
+			if !quoted {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+
+	return append(parts, s[start:])
+}
+
+// formatForwardedNode formats the IP address as a node of Forwarded, IPv6 addresses are quoted.
+func formatForwardedNode(ip string) string {
+	if strings.Contains(ip, ":") {
+		return `"[` + ip + `]"`
+	}
+
+	return ip
+}
+
+// setForwardedHeaders sets the headers telling the upstream about the client.
+// The headers sent by untrusted peers are dropped, since they could be spoofed.
+func (p *ProxyServer) setForwardedHeaders(req *http.Request, proxyHost string) {
+	headers := []string{headerForwarded, headerXForwardedFor, headerXForwardedProto, headerXForwardedHost, headerXForwardedPort, headerXRealIP}
+
+	if p.StripForwardedHeaders {
+		for _, name := range headers {
+			req.Header.Del(name)
+		}
+
+		// nil prevents ReverseProxy from adding X-Forwarded-For
+		req.Header[headerXForwardedFor] = nil
+		return
+	}
+
+	trusted := p.isTrustedProxy(remoteIP(req))
+
+	if !trusted {
+		for _, name := range headers {
+			req.Header.Del(name)
+		}
+	}
+
+	proto := "http"
+
+	if p.isSecure(req) {
+		proto = "https"
+	}
+
+	port := ""
+
+	if _, p, err := net.SplitHostPort(proxyHost); err == nil {
+		port = p
+	} else if addr, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		_, port, _ = net.SplitHostPort(addr.String())
+	}
+
+	if port == "" {
+		port = map[string]string{"http": "80", "https": "443"}[proto]
+	}
+
+	if req.Header.Get(headerXForwardedProto) == "" {
+		req.Header.Set(headerXForwardedProto, proto)
+	}
+
+	if req.Header.Get(headerXForwardedHost) == "" {
+		req.Header.Set(headerXForwardedHost, proxyHost)
+	}
+
+	if req.Header.Get(headerXForwardedPort) == "" {
+		req.Header.Set(headerXForwardedPort, port)
+	}
+
+	req.Header.Set(headerXRealIP, clientIP(req))
+
+	// ReverseProxy appends the peer address to X-Forwarded-For
+	element := fmt.Sprintf("for=%s;host=%q;proto=%s", formatForwardedNode(remoteIP(req)), proxyHost, proto)
+
+	if prior := req.Header.Get(headerForwarded); prior != "" {
+		element = strings.Join(req.Header.Values(headerForwarded), ", ") + ", " + element
+	}
+
+	req.Header.Set(headerForwarded, element)
+}
@@ -0,0 +1,180 @@
+package forward
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func mustParseTrustedProxies(values ...string) []*net.IPNet {
+	result := []*net.IPNet{}
+
+	for _, v := range values {
+		ipNet, err := ParseTrustedProxy(v)
+
+		if err != nil {
+			panic(err)
+		}
+
+		result = append(result, ipNet)
+	}
+
+	return result
+}
+
+func TestParseTrustedProxy(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{name: "cidr", value: "10.0.0.0/8", want: "10.0.0.0/8"},
+		{name: "ipv4", value: "192.168.1.1", want: "192.168.1.1/32"},
+		{name: "ipv6", value: "::1", want: "::1/128"},
+		{name: "invalid ip", value: "example.com", wantErr: true},
+		{name: "invalid cidr", value: "10.0.0.0/33", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseTrustedProxy(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseTrustedProxy() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err == nil && got.String() != tt.want {
+				t.Errorf("ParseTrustedProxy() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_parseForwarded(t *testing.T) {
+	got := parseForwarded([]string{`for=192.0.2.60;proto=http;by=203.0.113.43, For="[2001:db8:cafe::17]:4711"`, `for=unknown;host="a;b"`})
+	want := []map[string]string{
+		{"for": "192.0.2.60", "proto": "http", "by": "203.0.113.43"},
+		{"for": "[2001:db8:cafe::17]:4711"},
+		{"for": "unknown", "host": "a;b"},
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseForwarded() = %v, want %v", got, want)
+	}
+}
+
+func TestProxyServer_withClientIP(t *testing.T) {
+	server := &ProxyServer{ProxyServerOptions: &ProxyServerOptions{TrustedProxies: mustParseTrustedProxies("10.0.0.0/8", "::1")}}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		want       string
+	}{
+		{name: "direct", remoteAddr: "192.0.2.1:1234", want: "192.0.2.1"},
+		{name: "spoofed by untrusted peer", remoteAddr: "192.0.2.1:1234", headers: map[string]string{"X-Forwarded-For": "1.1.1.1"}, want: "192.0.2.1"},
+		{name: "trusted peer", remoteAddr: "10.0.0.1:1234", headers: map[string]string{"X-Forwarded-For": "1.1.1.1, 203.0.113.5"}, want: "203.0.113.5"},
+		{name: "trusted chain", remoteAddr: "10.0.0.1:1234", headers: map[string]string{"X-Forwarded-For": "1.1.1.1, 203.0.113.5, 10.0.0.2"}, want: "203.0.113.5"},
+		{name: "forwarded", remoteAddr: "[::1]:1234", headers: map[string]string{"Forwarded": `for="[2001:db8::1]:4711", for=10.0.0.3`}, want: "2001:db8::1"},
+		{name: "obfuscated", remoteAddr: "10.0.0.1:1234", headers: map[string]string{"Forwarded": "for=_hidden"}, want: "10.0.0.1"},
+		{name: "x-forwarded-for with port", remoteAddr: "10.0.0.1:1234", headers: map[string]string{"X-Forwarded-For": "203.0.113.5:5678, 10.0.0.2:80"}, want: "203.0.113.5"},
+		{name: "x-forwarded-for with ipv6 and port", remoteAddr: "10.0.0.1:1234", headers: map[string]string{"X-Forwarded-For": "[2001:db8::1]:4711"}, want: "2001:db8::1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://localhost:8080/", nil)
+			req.RemoteAddr = tt.remoteAddr
+
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+
+			if got := clientIP(server.withClientIP(req)); got != tt.want {
+				t.Errorf("clientIP() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProxyServer_setForwardedHeaders(t *testing.T) {
+	target, _ := url.Parse("http://example.com")
+
+	tests := []struct {
+		name        string
+		options     ProxyServerOptions
+		remoteAddr  string
+		headers     map[string]string
+		wantHeaders map[string][]string
+	}{
+		{
+			name:       "untrusted peer",
+			remoteAddr: "192.0.2.1:1234",
+			headers:    map[string]string{"X-Forwarded-For": "1.1.1.1", "X-Forwarded-Host": "evil.com", "Forwarded": "for=1.1.1.1"},
+			wantHeaders: map[string][]string{
+				"X-Real-Ip":         {"192.0.2.1"},
+				"X-Forwarded-For":   nil,
+				"X-Forwarded-Proto": {"http"},
+				"X-Forwarded-Host":  {"localhost:8080"},
+				"X-Forwarded-Port":  {"8080"},
+				"Forwarded":         {`for=192.0.2.1;host="localhost:8080";proto=http`},
+			},
+		},
+		{
+			name:       "trusted peer",
+			options:    ProxyServerOptions{TrustedProxies: mustParseTrustedProxies("::1")},
+			remoteAddr: "[::1]:1234",
+			headers:    map[string]string{"X-Forwarded-For": "203.0.113.5", "X-Forwarded-Proto": "https", "Forwarded": "for=203.0.113.5"},
+			wantHeaders: map[string][]string{
+				"X-Real-Ip":         {"203.0.113.5"},
+				"X-Forwarded-For":   {"203.0.113.5"},
+				"X-Forwarded-Proto": {"https"},
+				"Forwarded":         {`for=203.0.113.5, for="[::1]";host="localhost:8080";proto=http`},
+			},
+		},
+		{
+			name:       "strip",
+			options:    ProxyServerOptions{StripForwardedHeaders: true},
+			remoteAddr: "192.0.2.1:1234",
+			headers:    map[string]string{"X-Forwarded-For": "1.1.1.1", "Forwarded": "for=1.1.1.1"},
+			wantHeaders: map[string][]string{
+				"X-Real-Ip":         nil,
+				"X-Forwarded-Proto": nil,
+				"Forwarded":         nil,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			options := tt.options
+			options.Target = target
+
+			server := NewProxyServer(&options)
+			defer server.Close()
+
+			req := httptest.NewRequest(http.MethodGet, "http://localhost:8080/", nil)
+			req.RemoteAddr = tt.remoteAddr
+
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+
+			req = server.withClientIP(req)
+
+			server.proxy.Director(req)
+
+			for k, v := range tt.wantHeaders {
+				if got := req.Header.Values(k); !reflect.DeepEqual(got, v) && !(len(got) == 0 && len(v) == 0) {
+					t.Errorf("%s = %q, want %q", k, got, v)
+				}
+			}
+
+			// nil asks ReverseProxy not to append the peer address
+			if _, ok := req.Header["X-Forwarded-For"]; tt.options.StripForwardedHeaders && (!ok || req.Header["X-Forwarded-For"] != nil) {
+				t.Errorf("X-Forwarded-For = %q, want nil", req.Header["X-Forwarded-For"])
+			}
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -9,8 +10,12 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	forward "github.com/axetroy/forward-cli"
 )
@@ -65,21 +70,122 @@ OPTIONS:
   --proxy-external                    whether to proxy external host. defaults: false
   --proxy-external-ignore=<host>      specify the external host without using a proxy. defaults: ""
   --req-header="key=value"            specify the request header attached to the request. Allow multiple flags. defaults: ""
-  --res-header="key=value"            specify the response headers. Allow multiple flags. defaults: ""
-  --cors                              whether enable cors. defaults: false
+  --res-header="key=value"            specify the response headers, which replace the headers of the upstream. Allow multiple flags. defaults: ""
+  --cors                              whether enable cors, preflight requests are answered by forward. defaults: false
+  --cors-origin=<origin>              the allowed origin like https://example.com or https://*.example.com, implies --cors. Allow multiple flags. defaults: "*"
+  --cors-method=<method>              the allowed method of cors. Allow multiple flags. defaults: GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS
+  --cors-header=<name>                the allowed request header of cors, the requested headers are allowed if not specified. Allow multiple flags. defaults: ""
+  --cors-expose-header=<name>         the response header exposed to the browser. Allow multiple flags. defaults: ""
+  --cors-max-age=<duration>           how long the browser caches the preflight result. defaults: 0s
+  --cors-credentials                  whether to allow cookies and authorization headers, requires --cors-origin other than "*". defaults: false
+  --security-header="<name>=<action>" the action of the security response header: keep, strip, rewrite (map the upstream hosts to the proxy host) or report (Content-Security-Policy only, violations are logged instead of blocked). Content-Security-Policy and Expect-CT are stripped, Strict-Transport-Security is stripped without TLS by default. Allow multiple flags. defaults: ""
+  --permanent-redirect=<policy>       keep or downgrade (301 to 302, 308 to 307) the permanent redirects, which browsers cache. defaults: downgrade
+  --follow-redirect=<host>            follow the redirects between the hosts matching the pattern by forward, the final response is returned. Allow multiple flags. defaults: ""
+  --max-redirects=<int>               the max hops of the followed redirects, the last redirect is returned beyond it. defaults: 10
+  --rewrite-response-header=<name>    map the URLs in the response header to the proxy host, Location, Link, Refresh, Content-Location and Access-Control-Allow-Origin are always mapped. Allow multiple flags. defaults: ""
+  --replace-json-content="<rule>"     replace the content of the JSON string values matched by the JSONPath, the keys are path (eg. $.data[*].url or $..avatar), old and new. Allow multiple flags. defaults: ""
+  --rewrite-content-type=<type>       rewrite the content of the media type as text, supports patterns like text/* and application/*+json. Allow multiple flags. defaults: ""
+  --no-rewrite-content-type=<type>    never rewrite the content of the media type, supports patterns like text/* and application/*+json. Allow multiple flags. defaults: ""
+  --default-charset=<charset>         the charset of the content declaring none in Content-Type, meta or BOM, eg. gbk, shift_jis or iso-8859-1. defaults: ""
+  --serve-utf8                        serve the transcoded content of other charsets as UTF-8, the charset of Content-Type and meta is updated. defaults: false
+  --flush-interval=<duration>         the interval of flushing the response to client, negative to flush immediately. defaults: -1ns
+  --buffer-streams                    buffer the entire responses without Content-Length to rewrite, instead of rewriting them line by line as streams. JSON is buffered up to 8MB anyway. defaults: false
   --overwrite=<folder>                enable overwrite with a folder. defaults: ""
   --no-cache                          disabled cache for response. defaults: true
   --tls-cert-file=<filepath>          the cert file path for enabled tls. defaults: ""
   --tls-key-file=<filepath>           the key file path for enabled tls. defaults: ""
   --replace-content="a=b"             Contents to be replaced. defaults: ""
+  --grpc                              proxy native gRPC over HTTP/2 (h2c for http target) without rewriting. defaults: false
+  --grpc-web                          translate gRPC-Web requests to native gRPC for the target. defaults: false
+  --upstream=<url>                    specify another upstream of the target for load balancing. Allow multiple flags. defaults: ""
+  --balance=<strategy>                load balancing strategy: round-robin, least-conn, cookie or ip-hash. defaults: round-robin
+  --health-check-path=<path>          enable active health checks of upstreams by requesting the path. defaults: ""
+  --health-check-interval=<duration>  the interval of active health checks. defaults: 10s
+  --max-fails=<int>                   eject the upstream after the number of consecutive failures, 0 to disable. defaults: 0
+  --fail-timeout=<duration>           how long an ejected upstream is excluded from balancing. defaults: 30s
+  --admin-address=<address>           specify the address of the admin listener serving /upstreams, /faults and /metrics, eg. 127.0.0.1:9090. defaults: ""
+  --metrics-route=<path>              the path prefix labelled as a route in /metrics, eg. /api, the other paths are labelled as other. Allow multiple flags. defaults: ""
+  --retries=<int>                     the max number of retries for idempotent requests on connect errors. defaults: 0
+  --retry-status=<int>                retry idempotent requests on the upstream status code. Allow multiple flags. defaults: ""
+  --retry-backoff=<duration>          the initial delay between retries, doubled on each retry. defaults: 100ms
+  --retry-max-backoff=<duration>      the max delay between retries. defaults: 5s
+  --retry-body-limit=<bytes>          requests with a larger body are not retried. defaults: 1048576
+  --circuit-breaker=<int>             open the circuit of an upstream after the number of consecutive failures, 0 to disable. defaults: 0
+  --circuit-breaker-timeout=<duration> how long the circuit stays open before a trial request. defaults: 30s
+  --dial-timeout=<duration>           the timeout of connecting upstreams. defaults: 30s
+  --tls-handshake-timeout=<duration>  the timeout of TLS handshake with upstreams. defaults: 10s
+  --response-header-timeout=<duration> the timeout of waiting for the response headers of upstreams, 0 for no timeout. defaults: 0
+  --request-timeout=<duration>        the overall deadline of a proxied request, 0 for no deadline. defaults: 0
+  --max-idle-conns=<int>              the max number of idle upstream connections. defaults: 100
+  --max-idle-conns-per-host=<int>     the max number of idle connections per upstream. defaults: 2
+  --max-conns-per-host=<int>          the max number of connections per upstream, 0 for unlimited. defaults: 0
+  --idle-conn-timeout=<duration>      how long an idle upstream connection is kept. defaults: 90s
+  --keep-alive=<duration>             the interval of TCP keep-alive probes, negative to disable. defaults: 30s
+  --disable-keep-alives               do not reuse upstream connections. defaults: false
+  --read-timeout=<duration>           the timeout of reading the entire client request, 0 for no timeout. defaults: 0
+  --read-header-timeout=<duration>    the timeout of reading the client request headers, 0 for no timeout. defaults: 0
+  --write-timeout=<duration>          the timeout of writing the response to client, 0 for no timeout. defaults: 0
+  --idle-timeout=<duration>           how long an idle client connection is kept, 0 for no timeout. defaults: 0
+  --upstream-ca=<filepath>            the extra root CA file trusted for upstreams. Allow multiple flags. defaults: ""
+  --upstream-insecure                 do not verify the certificate of upstreams, DANGEROUS. defaults: false
+  --upstream-cert=<filepath>          the client cert file for mTLS with upstreams. defaults: ""
+  --upstream-key=<filepath>           the client key file for mTLS with upstreams. defaults: ""
+  --upstream-sni=<name>               override the server name (SNI) sent to the target, use sni of --upstream-tls for the other upstreams. defaults: ""
+  --upstream-tls-min=<version>        the minimum TLS version for upstreams: 1.0, 1.1, 1.2 or 1.3. defaults: 1.2
+  --upstream-tls="<host>,<key>=<value>" override the upstream TLS options for the host, the keys are ca, cert, key, sni, min and insecure. Allow multiple flags. defaults: ""
+  --upstream-proxy=<url>              the outbound proxy for upstreams, eg. http://127.0.0.1:3128 or socks5://127.0.0.1:1080. defaults: use HTTP_PROXY/HTTPS_PROXY
+  --upstream-proxy-for="<host>=<url>" the outbound proxy for the host pattern, "direct" to connect directly. Allow multiple flags. defaults: ""
+  --no-proxy=<host>                   the host pattern connected without outbound proxy, eg. .example.com or 10.0.0.0/8. Allow multiple flags. defaults: ""
+  --forward-proxy                     serve as a forward HTTP proxy of browsers, the host argument is optional. defaults: false
+  --forward-proxy-client=<cidr>       the client allowed to use the forward proxy, like 192.168.0.0/16 or a single IP, any client if not specified. Allow multiple flags. defaults: ""
+  --forward-proxy-host=<host>         the host pattern reachable through the forward proxy, like .example.com or 10.0.0.0/8, any host if not specified. Allow multiple flags. defaults: ""
+  --mitm=<host>                       decrypt CONNECT requests to the host pattern to rewrite them, requires --forward-proxy. Allow multiple flags. defaults: ""
+  --mitm-ca-cert=<filepath>           the CA cert file issuing certificates for MITM hosts, generated if not exist. defaults: "<config dir>/forward-cli/ca.pem"
+  --mitm-ca-key=<filepath>            the CA key file issuing certificates for MITM hosts, generated if not exist. defaults: "<config dir>/forward-cli/ca-key.pem"
+  --fault="<key>=<value>,..."         inject the fault into matched requests, the keys are path, method, host, probability, delay, abort, status, truncate, bandwidth and after, commas are escaped as "\,". Allow multiple flags. defaults: ""
+  --throttle="<key>=<value>,..."      simulate a slow network for matched requests, the keys are path, profile (2g, slow-3g, 3g, slow-4g or 4g), down, up (kbps), rtt and side (client, upstream or both), commas are escaped as "\,". Allow multiple flags. defaults: ""
+  --throttle-header                   allow the request header X-Forward-Throttle to select the network profile, eg. "3g" or "down=500,up=100,rtt=200ms". defaults: false
+  --rate-limit="<key>=<value>,..."    limit the rate of matched requests with token buckets, the keys are path, rate (eg. 10, 10/s or 100/m), burst and key (ip, route or header:<name>), commas are escaped as "\,". Allow multiple flags. defaults: ""
+  --upstream-concurrency=<int>        the max number of in-flight requests per upstream, 0 for unlimited. defaults: 0
+  --trace-endpoint=<url>              export the spans of requests to the OTLP/HTTP endpoint, eg. http://127.0.0.1:4318. defaults: ""
+  --trace-file=<filepath>             export the spans of requests to the file as OTLP JSON lines. defaults: ""
+  --trace-service-name=<name>         the service name of the exported spans. defaults: forward-cli
+  --rewrite-request-body              map the proxy host back to the target in JSON, form and multipart request bodies. defaults: false
+  --replace-request-content="a=b"     contents to be replaced in JSON, form and multipart request bodies. Allow multiple flags. defaults: ""
+  --request-body-limit=<bytes>        request bodies larger than the limit are not rewritten. defaults: 10485760
+  --reverse-map-header=<name>         map the URL in the request header from the proxy host back to the target, Referer and Origin are always mapped. Allow multiple flags. defaults: ""
+  --trusted-proxy=<cidr>              the IP or CIDR of the proxy in front of forward, whose Forwarded, X-Forwarded-* and PROXY protocol headers are trusted. Allow multiple flags. defaults: ""
+  --proxy-protocol                    accept the PROXY protocol v1/v2 header sent by the load balancer, requires --trusted-proxy. defaults: false
+  --strip-forwarded-headers           send neither Forwarded, X-Forwarded-* nor X-Real-IP to the upstream for privacy. defaults: false
+  --req-header-rule="<key>=<value>"   rewrite the request header sent to the upstream, the keys are action (set, add, remove, rename or replace), name, value, to, match, path and content-type. Allow multiple flags. defaults: ""
+  --res-header-rule="<key>=<value>"   rewrite the response header, the keys are the same as --req-header-rule, and status (eg. 404 or 4xx). The value supports ${client_ip}, ${method}, ${host}, ${path}, ${query}, ${upstream}, ${timestamp} and ${request_id}, commas are escaped as "\,". Allow multiple flags. defaults: ""
 
 EXAMPLES:
   forward http://example.com
   forward --port=80 http://example.com
   forward --req-header="foo=bar" http://example.com
   forward --cors --req-header="foo=bar" --req-header="hello=world" http://example.com
+  forward --cors-origin=http://localhost:3000 --cors-origin="https://*.example.com" --cors-expose-header=X-Total --cors-max-age=10m --cors-credentials http://example.com
   forward --tls-cert-file=/path/to/cert/file --tls-key-file=/path/to/key/file http://example.com
-  forward --port=80 http://example.com --replace-content="value=newvalue"`)
+  forward --port=80 http://example.com --replace-content="value=newvalue"
+  forward --grpc --grpc-web http://127.0.0.1:50051
+  forward --upstream-ca=/path/to/ca.pem --upstream-tls="mtls.example.com,cert=/path/to/cert,key=/path/to/key" https://example.com
+  forward --upstream-proxy=socks5://127.0.0.1:1080 --upstream-proxy-for="example.com=direct" --proxy-external https://example.com
+  forward --forward-proxy --mitm=.example.com --req-header="foo=bar" --port=8080
+  forward --forward-proxy --forward-proxy-client=127.0.0.1 --forward-proxy-host=.example.com --port=8080
+  forward --fault="path=^/api/,probability=0.2,status=503" --fault="path=\.js$,delay=3s,after" --admin-address=127.0.0.1:9090 http://example.com
+  forward --throttle="path=^/static/,profile=slow-3g" --throttle="down=500,up=100,rtt=200ms,side=upstream" --throttle-header http://example.com
+  forward --rate-limit="rate=10,burst=20" --rate-limit="path=^/api/,rate=100/m,key=header:X-Api-Key" --upstream-concurrency=50 http://example.com
+  forward --trace-endpoint=http://127.0.0.1:4318 http://example.com
+  forward --rewrite-request-body --replace-request-content="newvalue=value" http://example.com
+  forward --proxy-protocol --trusted-proxy=10.0.0.0/8 --trusted-proxy=192.168.1.1 http://example.com
+  forward --req-header-rule='action=set,name=X-Request-Id,value=${request_id}' --res-header-rule="action=set,name=Cache-Control,value=no-cache\, no-store,status=2xx,content-type=^text/html" http://example.com
+  forward --security-header=Content-Security-Policy=report --security-header=X-Frame-Options=strip http://example.com
+  forward --permanent-redirect=keep --follow-redirect=sso.example.com --follow-redirect=10.0.0.0/8 http://example.com
+  forward --replace-json-content='path=$..avatar,old=cdn.example.com,new=img.example.com' http://example.com
+  forward --rewrite-content-type=text/markdown --no-rewrite-content-type=image/svg+xml http://example.com
+  forward --default-charset=gbk --replace-content="旧=新" --serve-utf8 http://example.com
+  forward --upstream=http://10.0.0.2 --balance=least-conn --health-check-path=/healthz --admin-address=127.0.0.1:9090 --metrics-route=/api http://10.0.0.1`)
 }
 
 type arrayFlags []string
@@ -93,23 +199,168 @@ func (i *arrayFlags) Set(value string) error {
 	return nil
 }
 
+// parseUpstreamTLS parses the flag like "<host>,ca=<file>,cert=<file>,key=<file>,sni=<name>,min=<version>,insecure".
+// The options not specified are inherited from the defaults.
+func parseUpstreamTLS(value string, defaults forward.UpstreamTLSOptions) (string, forward.UpstreamTLSOptions, error) {
+	arr := strings.Split(value, ",")
+	host := strings.TrimSpace(arr[0])
+	options := defaults
+	options.RootCAFiles = append([]string{}, defaults.RootCAFiles...)
+
+	if host == "" {
+		return "", options, fmt.Errorf("invalid upstream tls '%s': host is required", value)
+	}
+
+	for _, paren := range arr[1:] {
+		kv := strings.SplitN(strings.TrimSpace(paren), "=", 2)
+		key := kv[0]
+		val := ""
+
+		if len(kv) == 2 {
+			val = kv[1]
+		}
+
+		switch key {
+		case "ca":
+			options.RootCAFiles = append(options.RootCAFiles, val)
+		case "cert":
+			options.CertFile = val
+		case "key":
+			options.KeyFile = val
+		case "sni":
+			options.ServerName = val
+		case "min":
+			version, err := forward.ParseTLSVersion(val)
+
+			if err != nil {
+				return "", options, err
+			}
+
+			options.MinVersion = version
+		case "insecure":
+			options.InsecureSkipVerify = val == "" || val == "true"
+		default:
+			return "", options, fmt.Errorf("invalid upstream tls '%s': unknown key '%s'", value, key)
+		}
+	}
+
+	return host, options, nil
+}
+
+func parseProxyURL(value string) (*url.URL, error) {
+	u, err := url.Parse(value)
+
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "http", "https", "socks5":
+		return u, nil
+	}
+
+	return nil, fmt.Errorf("invalid outbound proxy '%s': the scheme must be http, https or socks5", value)
+}
+
 func main() {
 	var (
-		showHelp             bool       = false
-		showVersion          bool       = false
-		address              string     = "0.0.0.0"
-		port                 string     = "80"
-		cors                 bool       = false
-		noCache              bool       = true
-		overwriteFolder      string     = ""
-		proxyExternal        bool       = false
-		proxyExternalIgnores arrayFlags = arrayFlags{}
-		requestHeadersArray  arrayFlags = arrayFlags{}
-		responseHeadersArray arrayFlags = arrayFlags{}
-		certFilePath         string     = ""
-		keyFilePath          string     = ""
-		useTLS               bool       = false
-		replaceContentArray  arrayFlags = arrayFlags{}
+		showHelp              bool          = false
+		showVersion           bool          = false
+		address               string        = "0.0.0.0"
+		port                  string        = "80"
+		cors                  bool          = false
+		corsOriginArray       arrayFlags    = arrayFlags{}
+		corsMethodArray       arrayFlags    = arrayFlags{}
+		corsHeaderArray       arrayFlags    = arrayFlags{}
+		corsExposeHeaderArray arrayFlags    = arrayFlags{}
+		corsMaxAge            time.Duration = 0
+		corsCredentials       bool          = false
+		securityHeaderArray   arrayFlags    = arrayFlags{}
+		permanentRedirect     string        = forward.RedirectDowngrade
+		followRedirectArray   arrayFlags    = arrayFlags{}
+		maxRedirects          int           = 10
+		rewriteResHeaderArray arrayFlags    = arrayFlags{}
+		replaceJSONArray      arrayFlags    = arrayFlags{}
+		rewriteContentTypes   arrayFlags    = arrayFlags{}
+		noRewriteContentTypes arrayFlags    = arrayFlags{}
+		defaultCharset        string        = ""
+		serveUTF8             bool          = false
+		flushInterval         time.Duration = -1
+		bufferStreams         bool          = false
+		noCache               bool          = true
+		overwriteFolder       string        = ""
+		proxyExternal         bool          = false
+		proxyExternalIgnores  arrayFlags    = arrayFlags{}
+		requestHeadersArray   arrayFlags    = arrayFlags{}
+		responseHeadersArray  arrayFlags    = arrayFlags{}
+		certFilePath          string        = ""
+		keyFilePath           string        = ""
+		useTLS                bool          = false
+		replaceContentArray   arrayFlags    = arrayFlags{}
+		grpc                  bool          = false
+		grpcWeb               bool          = false
+		upstreamsArray        arrayFlags    = arrayFlags{}
+		balance               string        = forward.BalanceRoundRobin
+		healthCheckPath       string        = ""
+		healthCheckInterval   time.Duration = 10 * time.Second
+		maxFails              int           = 0
+		failTimeout           time.Duration = 30 * time.Second
+		adminAddress          string        = ""
+		metricsRouteArray     arrayFlags    = arrayFlags{}
+		retries               int           = 0
+		retryStatusArray      arrayFlags    = arrayFlags{}
+		retryBackoff          time.Duration = 100 * time.Millisecond
+		retryMaxBackoff       time.Duration = 5 * time.Second
+		retryBodyLimit        int64         = 1 << 20
+		circuitBreaker        int           = 0
+		circuitBreakerTimeout time.Duration = 30 * time.Second
+		dialTimeout           time.Duration = 30 * time.Second
+		tlsHandshakeTimeout   time.Duration = 10 * time.Second
+		responseHeaderTimeout time.Duration = 0
+		requestTimeout        time.Duration = 0
+		maxIdleConns          int           = 100
+		maxIdleConnsPerHost   int           = http.DefaultMaxIdleConnsPerHost
+		maxConnsPerHost       int           = 0
+		idleConnTimeout       time.Duration = 90 * time.Second
+		keepAlive             time.Duration = 30 * time.Second
+		disableKeepAlives     bool          = false
+		readTimeout           time.Duration = 0
+		readHeaderTimeout     time.Duration = 0
+		writeTimeout          time.Duration = 0
+		idleTimeout           time.Duration = 0
+		upstreamCAArray       arrayFlags    = arrayFlags{}
+		upstreamInsecure      bool          = false
+		upstreamCertFilePath  string        = ""
+		upstreamKeyFilePath   string        = ""
+		upstreamSNI           string        = ""
+		upstreamTLSMin        string        = "1.2"
+		upstreamTLSArray      arrayFlags    = arrayFlags{}
+		upstreamProxy         string        = ""
+		upstreamProxyForArray arrayFlags    = arrayFlags{}
+		noProxyArray          arrayFlags    = arrayFlags{}
+		forwardProxy          bool          = false
+		forwardClientArray    arrayFlags    = arrayFlags{}
+		forwardHostArray      arrayFlags    = arrayFlags{}
+		mitmArray             arrayFlags    = arrayFlags{}
+		mitmCACertFilePath    string        = ""
+		mitmCAKeyFilePath     string        = ""
+		faultArray            arrayFlags    = arrayFlags{}
+		throttleArray         arrayFlags    = arrayFlags{}
+		throttleHeader        bool          = false
+		rateLimitArray        arrayFlags    = arrayFlags{}
+		upstreamConcurrency   int64         = 0
+		traceEndpoint         string        = ""
+		traceFile             string        = ""
+		traceServiceName      string        = "forward-cli"
+		rewriteRequestBody    bool          = false
+		replaceRequestArray   arrayFlags    = arrayFlags{}
+		requestBodyLimit      int64         = 10 << 20
+		reverseMapHeaderArray arrayFlags    = arrayFlags{}
+		trustedProxyArray     arrayFlags    = arrayFlags{}
+		proxyProtocol         bool          = false
+		stripForwardedHeaders bool          = false
+		reqHeaderRuleArray    arrayFlags    = arrayFlags{}
+		resHeaderRuleArray    arrayFlags    = arrayFlags{}
 	)
 
 	flag.BoolVar(&showHelp, "help", showHelp, "")
@@ -117,6 +368,24 @@ func main() {
 	flag.Var(&requestHeadersArray, "req-header", "")
 	flag.Var(&responseHeadersArray, "res-header", "")
 	flag.BoolVar(&cors, "cors", cors, "")
+	flag.Var(&corsOriginArray, "cors-origin", "")
+	flag.Var(&corsMethodArray, "cors-method", "")
+	flag.Var(&corsHeaderArray, "cors-header", "")
+	flag.Var(&corsExposeHeaderArray, "cors-expose-header", "")
+	flag.DurationVar(&corsMaxAge, "cors-max-age", corsMaxAge, "")
+	flag.BoolVar(&corsCredentials, "cors-credentials", corsCredentials, "")
+	flag.Var(&securityHeaderArray, "security-header", "")
+	flag.StringVar(&permanentRedirect, "permanent-redirect", permanentRedirect, "")
+	flag.Var(&followRedirectArray, "follow-redirect", "")
+	flag.IntVar(&maxRedirects, "max-redirects", maxRedirects, "")
+	flag.Var(&rewriteResHeaderArray, "rewrite-response-header", "")
+	flag.Var(&replaceJSONArray, "replace-json-content", "")
+	flag.Var(&rewriteContentTypes, "rewrite-content-type", "")
+	flag.Var(&noRewriteContentTypes, "no-rewrite-content-type", "")
+	flag.StringVar(&defaultCharset, "default-charset", defaultCharset, "")
+	flag.BoolVar(&serveUTF8, "serve-utf8", serveUTF8, "")
+	flag.DurationVar(&flushInterval, "flush-interval", flushInterval, "")
+	flag.BoolVar(&bufferStreams, "buffer-streams", bufferStreams, "")
 	flag.BoolVar(&noCache, "no-cache", noCache, "")
 	flag.BoolVar(&proxyExternal, "proxy-external", proxyExternal, "")
 	flag.Var(&proxyExternalIgnores, "proxy-external-ignore", "")
@@ -127,6 +396,70 @@ func main() {
 	flag.StringVar(&keyFilePath, "tls-key-file", keyFilePath, "")
 	flag.Var(&replaceContentArray, "replace-content", "")
 	flag.BoolVar(&useTLS, "useTLS", useTLS, "")
+	flag.BoolVar(&grpc, "grpc", grpc, "")
+	flag.BoolVar(&grpcWeb, "grpc-web", grpcWeb, "")
+	flag.Var(&upstreamsArray, "upstream", "")
+	flag.StringVar(&balance, "balance", balance, "")
+	flag.StringVar(&healthCheckPath, "health-check-path", healthCheckPath, "")
+	flag.DurationVar(&healthCheckInterval, "health-check-interval", healthCheckInterval, "")
+	flag.IntVar(&maxFails, "max-fails", maxFails, "")
+	flag.DurationVar(&failTimeout, "fail-timeout", failTimeout, "")
+	flag.StringVar(&adminAddress, "admin-address", adminAddress, "")
+	flag.Var(&metricsRouteArray, "metrics-route", "")
+	flag.IntVar(&retries, "retries", retries, "")
+	flag.Var(&retryStatusArray, "retry-status", "")
+	flag.DurationVar(&retryBackoff, "retry-backoff", retryBackoff, "")
+	flag.DurationVar(&retryMaxBackoff, "retry-max-backoff", retryMaxBackoff, "")
+	flag.Int64Var(&retryBodyLimit, "retry-body-limit", retryBodyLimit, "")
+	flag.IntVar(&circuitBreaker, "circuit-breaker", circuitBreaker, "")
+	flag.DurationVar(&circuitBreakerTimeout, "circuit-breaker-timeout", circuitBreakerTimeout, "")
+	flag.DurationVar(&dialTimeout, "dial-timeout", dialTimeout, "")
+	flag.DurationVar(&tlsHandshakeTimeout, "tls-handshake-timeout", tlsHandshakeTimeout, "")
+	flag.DurationVar(&responseHeaderTimeout, "response-header-timeout", responseHeaderTimeout, "")
+	flag.DurationVar(&requestTimeout, "request-timeout", requestTimeout, "")
+	flag.IntVar(&maxIdleConns, "max-idle-conns", maxIdleConns, "")
+	flag.IntVar(&maxIdleConnsPerHost, "max-idle-conns-per-host", maxIdleConnsPerHost, "")
+	flag.IntVar(&maxConnsPerHost, "max-conns-per-host", maxConnsPerHost, "")
+	flag.DurationVar(&idleConnTimeout, "idle-conn-timeout", idleConnTimeout, "")
+	flag.DurationVar(&keepAlive, "keep-alive", keepAlive, "")
+	flag.BoolVar(&disableKeepAlives, "disable-keep-alives", disableKeepAlives, "")
+	flag.DurationVar(&readTimeout, "read-timeout", readTimeout, "")
+	flag.DurationVar(&readHeaderTimeout, "read-header-timeout", readHeaderTimeout, "")
+	flag.DurationVar(&writeTimeout, "write-timeout", writeTimeout, "")
+	flag.DurationVar(&idleTimeout, "idle-timeout", idleTimeout, "")
+	flag.Var(&upstreamCAArray, "upstream-ca", "")
+	flag.BoolVar(&upstreamInsecure, "upstream-insecure", upstreamInsecure, "")
+	flag.StringVar(&upstreamCertFilePath, "upstream-cert", upstreamCertFilePath, "")
+	flag.StringVar(&upstreamKeyFilePath, "upstream-key", upstreamKeyFilePath, "")
+	flag.StringVar(&upstreamSNI, "upstream-sni", upstreamSNI, "")
+	flag.StringVar(&upstreamTLSMin, "upstream-tls-min", upstreamTLSMin, "")
+	flag.Var(&upstreamTLSArray, "upstream-tls", "")
+	flag.StringVar(&upstreamProxy, "upstream-proxy", upstreamProxy, "")
+	flag.Var(&upstreamProxyForArray, "upstream-proxy-for", "")
+	flag.Var(&noProxyArray, "no-proxy", "")
+	flag.BoolVar(&forwardProxy, "forward-proxy", forwardProxy, "")
+	flag.Var(&forwardClientArray, "forward-proxy-client", "")
+	flag.Var(&forwardHostArray, "forward-proxy-host", "")
+	flag.Var(&mitmArray, "mitm", "")
+	flag.StringVar(&mitmCACertFilePath, "mitm-ca-cert", mitmCACertFilePath, "")
+	flag.StringVar(&mitmCAKeyFilePath, "mitm-ca-key", mitmCAKeyFilePath, "")
+	flag.Var(&faultArray, "fault", "")
+	flag.Var(&throttleArray, "throttle", "")
+	flag.BoolVar(&throttleHeader, "throttle-header", throttleHeader, "")
+	flag.Var(&rateLimitArray, "rate-limit", "")
+	flag.Int64Var(&upstreamConcurrency, "upstream-concurrency", upstreamConcurrency, "")
+	flag.StringVar(&traceEndpoint, "trace-endpoint", traceEndpoint, "")
+	flag.StringVar(&traceFile, "trace-file", traceFile, "")
+	flag.StringVar(&traceServiceName, "trace-service-name", traceServiceName, "")
+	flag.BoolVar(&rewriteRequestBody, "rewrite-request-body", rewriteRequestBody, "")
+	flag.Var(&replaceRequestArray, "replace-request-content", "")
+	flag.Int64Var(&requestBodyLimit, "request-body-limit", requestBodyLimit, "")
+	flag.Var(&reverseMapHeaderArray, "reverse-map-header", "")
+	flag.Var(&trustedProxyArray, "trusted-proxy", "")
+	flag.BoolVar(&proxyProtocol, "proxy-protocol", proxyProtocol, "")
+	flag.BoolVar(&stripForwardedHeaders, "strip-forwarded-headers", stripForwardedHeaders, "")
+	flag.Var(&reqHeaderRuleArray, "req-header-rule", "")
+	flag.Var(&resHeaderRuleArray, "res-header-rule", "")
 
 	flag.Usage = printHelp
 
@@ -146,23 +479,329 @@ func main() {
 
 	server := flag.Arg(0)
 
-	if server == "" {
+	// the target is optional for forward proxy
+	if server == "" && !forwardProxy {
 		fmt.Printf("ERR: proxy server is required\n\n")
 		printHelp()
 		os.Exit(1)
 	}
 
-	u, err := url.Parse(server)
+	var (
+		u      *url.URL
+		target = "any host requested by clients"
+	)
+
+	if server != "" {
+		parsed, err := url.Parse(server)
+
+		if err != nil {
+			panic("invalid host")
+		}
+
+		if parsed.Scheme != "http" && parsed.Scheme != "https" {
+			panic("invalid proxy target")
+		}
+
+		u = parsed
+		target = fmt.Sprintf("%s://%s", u.Scheme, u.Host)
+	}
+	upstreams := []*url.URL{}
+
+	for _, v := range upstreamsArray {
+		upstream, err := url.Parse(v)
+
+		if err != nil || (upstream.Scheme != "http" && upstream.Scheme != "https") {
+			log.Panicf("invalid upstream '%s'\n", v)
+		}
+
+		upstreams = append(upstreams, upstream)
+	}
+
+	retryStatuses := []int{}
+
+	for _, v := range retryStatusArray {
+		status, err := strconv.Atoi(v)
+
+		if err != nil || status < 100 || status > 599 {
+			log.Panicf("invalid retry status '%s'\n", v)
+		}
+
+		retryStatuses = append(retryStatuses, status)
+	}
+
+	for _, v := range append(append([]string{}, replaceContentArray...), replaceRequestArray...) {
+		if !strings.Contains(v, "=") || strings.HasPrefix(v, "=") {
+			log.Panicf("invalid replace content '%s', it should be like 'a=b'\n", v)
+		}
+	}
+
+	upstreamTLSMinVersion, err := forward.ParseTLSVersion(upstreamTLSMin)
 
 	if err != nil {
-		panic("invalid host")
+		log.Panicln(err)
+	}
+
+	upstreamTLSOptions := forward.UpstreamTLSOptions{
+		RootCAFiles:        upstreamCAArray,
+		InsecureSkipVerify: upstreamInsecure,
+		CertFile:           upstreamCertFilePath,
+		KeyFile:            upstreamKeyFilePath,
+		MinVersion:         upstreamTLSMinVersion,
 	}
 
-	if u.Scheme != "http" && u.Scheme != "https" {
-		panic("invalid proxy target")
+	upstreamTLSConfig, err := forward.NewUpstreamTLSConfig(upstreamTLSOptions)
+
+	if err != nil {
+		log.Panicln(err)
 	}
 
-	target := fmt.Sprintf("%s://%s", u.Scheme, u.Host)
+	upstreamTLSConfigs := map[string]*tls.Config{}
+
+	// the server name is sent to the target only, the other upstreams are different hosts
+	if upstreamSNI != "" {
+		if u == nil {
+			log.Panicln("--upstream-sni requires the target, use sni of --upstream-tls for the hosts of forward proxy")
+		}
+
+		options := upstreamTLSOptions
+		options.ServerName = upstreamSNI
+
+		config, err := forward.NewUpstreamTLSConfig(options)
+
+		if err != nil {
+			log.Panicln(err)
+		}
+
+		upstreamTLSConfigs[strings.ToLower(u.Host)] = config
+	}
+
+	for _, v := range upstreamTLSArray {
+		host, options, err := parseUpstreamTLS(v, upstreamTLSOptions)
+
+		if err != nil {
+			log.Panicln(err)
+		}
+
+		// the options of the target replace the config of --upstream-sni
+		if u != nil && (strings.EqualFold(host, u.Host) || strings.EqualFold(host, u.Hostname())) {
+			delete(upstreamTLSConfigs, strings.ToLower(u.Host))
+
+			if options.ServerName == "" {
+				options.ServerName = upstreamSNI
+			}
+		}
+
+		config, err := forward.NewUpstreamTLSConfig(options)
+
+		if err != nil {
+			log.Panicln(err)
+		}
+
+		upstreamTLSConfigs[host] = config
+	}
+
+	var upstreamProxyURL *url.URL
+
+	if upstreamProxy != "" {
+		if upstreamProxyURL, err = parseProxyURL(upstreamProxy); err != nil {
+			log.Panicln(err)
+		}
+	}
+
+	upstreamProxies := map[string]*url.URL{}
+
+	for _, paren := range upstreamProxyForArray {
+		arr := strings.Split(paren, "=")
+		value := strings.Join(arr[1:], "=")
+
+		if len(arr) < 2 || arr[0] == "" {
+			log.Panicf("invalid upstream proxy for '%s'\n", paren)
+		}
+
+		if value == "direct" {
+			upstreamProxies[arr[0]] = nil
+			continue
+		}
+
+		proxyURL, err := parseProxyURL(value)
+
+		if err != nil {
+			log.Panicln(err)
+		}
+
+		upstreamProxies[arr[0]] = proxyURL
+	}
+
+	noProxy := []string{}
+
+	for _, v := range noProxyArray {
+		noProxy = append(noProxy, strings.Split(v, ",")...)
+	}
+
+	var mitmCA *tls.Certificate
+
+	if len(mitmArray) > 0 {
+		if !forwardProxy {
+			log.Panicln("the flag '--mitm=<host>' requires '--forward-proxy'")
+		}
+
+		if mitmCACertFilePath == "" || mitmCAKeyFilePath == "" {
+			configDir, err := os.UserConfigDir()
+
+			if err != nil {
+				log.Panicln(err)
+			}
+
+			if mitmCACertFilePath == "" {
+				mitmCACertFilePath = filepath.Join(configDir, "forward-cli", "ca.pem")
+			}
+
+			if mitmCAKeyFilePath == "" {
+				mitmCAKeyFilePath = filepath.Join(configDir, "forward-cli", "ca-key.pem")
+			}
+		}
+
+		if mitmCA, err = forward.LoadOrCreateCA(mitmCACertFilePath, mitmCAKeyFilePath); err != nil {
+			log.Panicln(err)
+		}
+
+		log.Printf("MITM CA '%s', trust it in your client to decrypt %s\n", mitmCACertFilePath, strings.Join(mitmArray, ", "))
+	}
+
+	faults := []forward.FaultRule{}
+
+	for _, v := range faultArray {
+		rule, err := forward.ParseFaultRule(v)
+
+		if err != nil {
+			log.Panicln(err)
+		}
+
+		faults = append(faults, rule)
+	}
+
+	throttles := []forward.ThrottleRule{}
+
+	for _, v := range throttleArray {
+		rule, err := forward.ParseThrottleRule(v)
+
+		if err != nil {
+			log.Panicln(err)
+		}
+
+		throttles = append(throttles, rule)
+	}
+
+	rateLimits := []forward.RateLimitRule{}
+
+	for _, v := range rateLimitArray {
+		rule, err := forward.ParseRateLimitRule(v)
+
+		if err != nil {
+			log.Panicln(err)
+		}
+
+		rateLimits = append(rateLimits, rule)
+	}
+
+	trustedProxies := []*net.IPNet{}
+
+	for _, v := range trustedProxyArray {
+		ipNet, err := forward.ParseTrustedProxy(v)
+
+		if err != nil {
+			log.Panicln(err)
+		}
+
+		trustedProxies = append(trustedProxies, ipNet)
+	}
+
+	if proxyProtocol && len(trustedProxies) == 0 {
+		log.Panicln("--proxy-protocol requires --trusted-proxy, any client could forge the address otherwise")
+	}
+
+	forwardProxyClients := []*net.IPNet{}
+
+	for _, v := range forwardClientArray {
+		ipNet, err := forward.ParseForwardProxyClient(v)
+
+		if err != nil {
+			log.Panicln(err)
+		}
+
+		forwardProxyClients = append(forwardProxyClients, ipNet)
+	}
+
+	var corsPolicy *forward.CorsPolicy
+
+	if cors || len(corsOriginArray) > 0 {
+		corsPolicy = &forward.CorsPolicy{
+			Origins:       corsOriginArray,
+			Methods:       corsMethodArray,
+			Headers:       corsHeaderArray,
+			ExposeHeaders: corsExposeHeaderArray,
+			Credentials:   corsCredentials,
+			MaxAge:        corsMaxAge,
+		}
+	}
+
+	switch permanentRedirect {
+	case forward.RedirectDowngrade, forward.RedirectKeep:
+	default:
+		log.Panicln("the flag '--permanent-redirect' must be keep or downgrade")
+	}
+
+	jsonReplaceRules := []forward.JSONReplaceRule{}
+
+	for _, v := range replaceJSONArray {
+		rule, err := forward.ParseJSONReplaceRule(v)
+
+		if err != nil {
+			log.Panicln(err)
+		}
+
+		jsonReplaceRules = append(jsonReplaceRules, rule)
+	}
+
+	securityHeaders := map[string]string{}
+
+	for _, v := range securityHeaderArray {
+		name, action, err := forward.ParseSecurityHeader(v)
+
+		if err != nil {
+			log.Panicln(err)
+		}
+
+		securityHeaders[name] = action
+	}
+
+	headerRules := []forward.HeaderRule{}
+
+	for _, v := range reqHeaderRuleArray {
+		rule, err := forward.ParseHeaderRule(forward.HeaderSideRequest, v)
+
+		if err != nil {
+			log.Panicln(err)
+		}
+
+		headerRules = append(headerRules, rule)
+	}
+
+	for _, v := range resHeaderRuleArray {
+		rule, err := forward.ParseHeaderRule(forward.HeaderSideResponse, v)
+
+		if err != nil {
+			log.Panicln(err)
+		}
+
+		headerRules = append(headerRules, rule)
+	}
+
+	switch balance {
+	case forward.BalanceRoundRobin, forward.BalanceLeastConnections, forward.BalanceCookie, forward.BalanceIPHash:
+	default:
+		log.Panicf("invalid balance strategy '%s'\n", balance)
+	}
 	requestHeaders := http.Header{}
 	responseHeaders := http.Header{}
 
@@ -203,19 +842,104 @@ func main() {
 	}
 
 	proxy := forward.NewProxyServer(&forward.ProxyServerOptions{
-		ReqHeaders:           requestHeaders,
-		ResHeaders:           responseHeaders,
-		Cors:                 cors,
-		ProxyExternal:        proxyExternal,
-		ProxyExternalIgnores: proxyExternalIgnores,
-		Target:               u,
-		NoCache:              noCache,
-		OverwriteFolder:      overwriteFolder,
-		UseSSL:               useTLS,
-		ReplaceContent:       replaceContentArray,
+		ReqHeaders:              requestHeaders,
+		ResHeaders:              responseHeaders,
+		Cors:                    cors,
+		ProxyExternal:           proxyExternal,
+		ProxyExternalIgnores:    proxyExternalIgnores,
+		Target:                  u,
+		NoCache:                 noCache,
+		OverwriteFolder:         overwriteFolder,
+		UseSSL:                  useTLS,
+		ReplaceContent:          replaceContentArray,
+		GRPC:                    grpc,
+		GRPCWeb:                 grpcWeb,
+		Upstreams:               upstreams,
+		Balance:                 balance,
+		HealthCheckPath:         healthCheckPath,
+		HealthCheckInterval:     healthCheckInterval,
+		MaxFails:                maxFails,
+		FailTimeout:             failTimeout,
+		Retries:                 retries,
+		RetryStatuses:           retryStatuses,
+		RetryBackoff:            retryBackoff,
+		RetryMaxBackoff:         retryMaxBackoff,
+		RetryBodyLimit:          retryBodyLimit,
+		CircuitBreakerThreshold: circuitBreaker,
+		CircuitBreakerTimeout:   circuitBreakerTimeout,
+		DialTimeout:             dialTimeout,
+		TLSHandshakeTimeout:     tlsHandshakeTimeout,
+		ResponseHeaderTimeout:   responseHeaderTimeout,
+		RequestTimeout:          requestTimeout,
+		MaxIdleConns:            maxIdleConns,
+		MaxIdleConnsPerHost:     maxIdleConnsPerHost,
+		MaxConnsPerHost:         maxConnsPerHost,
+		IdleConnTimeout:         idleConnTimeout,
+		KeepAlive:               keepAlive,
+		DisableKeepAlives:       disableKeepAlives,
+		ServerReadTimeout:       readTimeout,
+		ServerReadHeaderTimeout: readHeaderTimeout,
+		ServerWriteTimeout:      writeTimeout,
+		ServerIdleTimeout:       idleTimeout,
+		UpstreamTLSConfig:       upstreamTLSConfig,
+		UpstreamTLSConfigs:      upstreamTLSConfigs,
+		UpstreamProxy:           upstreamProxyURL,
+		UpstreamProxies:         upstreamProxies,
+		NoProxy:                 noProxy,
+		ForwardProxy:            forwardProxy,
+		ForwardProxyClients:     forwardProxyClients,
+		ForwardProxyHosts:       forwardHostArray,
+		MITMHosts:               mitmArray,
+		MITMCA:                  mitmCA,
+		Faults:                  faults,
+		MetricsRoutes:           metricsRouteArray,
+		Throttles:               throttles,
+		ThrottleHeader:          throttleHeader,
+		RateLimits:              rateLimits,
+		UpstreamConcurrency:     upstreamConcurrency,
+		TraceEndpoint:           traceEndpoint,
+		TraceFile:               traceFile,
+		TraceServiceName:        traceServiceName,
+		RewriteRequestBody:      rewriteRequestBody,
+		ReplaceRequestContent:   replaceRequestArray,
+		RequestBodyLimit:        requestBodyLimit,
+		ReverseMapHeaders:       reverseMapHeaderArray,
+		TrustedProxies:          trustedProxies,
+		ProxyProtocol:           proxyProtocol,
+		StripForwardedHeaders:   stripForwardedHeaders,
+		HeaderRules:             headerRules,
+		CorsPolicy:              corsPolicy,
+		SecurityHeaders:         securityHeaders,
+		PermanentRedirect:       permanentRedirect,
+		FollowRedirects:         followRedirectArray,
+		MaxRedirects:            maxRedirects,
+		RewriteResponseHeaders:  rewriteResHeaderArray,
+		JSONReplaceRules:        jsonReplaceRules,
+		RewriteContentTypes:     rewriteContentTypes,
+		NoRewriteContentTypes:   noRewriteContentTypes,
+		DefaultCharset:          defaultCharset,
+		ServeUTF8:               serveUTF8,
+		FlushInterval:           flushInterval,
+		BufferStreams:           bufferStreams,
 	})
 
-	http.HandleFunc("/", proxy.Handler())
+	if traceEndpoint != "" || traceFile != "" {
+		// export the remaining spans before exit
+		go func() {
+			signals := make(chan os.Signal, 1)
+			signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+			<-signals
+			proxy.Close()
+			os.Exit(0)
+		}()
+	}
+
+	if adminAddress != "" {
+		go func() {
+			log.Printf("Admin listening on 'http://%s'\n", adminAddress)
+			log.Fatal(http.ListenAndServe(adminAddress, proxy.AdminHandler()))
+		}()
+	}
 
 	scheme := "http"
 
@@ -232,9 +956,24 @@ func main() {
 		log.Printf("Proxy '%s://%s:%s' to '%s'\n", scheme, address, port, target)
 	}
 
+	srv := proxy.Server(fmt.Sprintf("%s:%s", address, port))
+
+	ln, err := proxy.Listen(srv.Addr)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	if certFilePath != "" && keyFilePath != "" {
-		log.Fatal(http.ListenAndServeTLS(fmt.Sprintf("%s:%s", address, port), certFilePath, keyFilePath, nil))
+		log.Fatal(srv.ServeTLS(ln, certFilePath, keyFilePath))
 	} else {
-		log.Fatal(http.ListenAndServe(fmt.Sprintf("%s:%s", address, port), nil))
+		// native gRPC clients speak HTTP/2 with prior knowledge when TLS is disabled
+		if grpc {
+			if err := forward.EnableH2C(srv); err != nil {
+				log.Printf("WARN: %s\n", err)
+			}
+		}
+
+		log.Fatal(srv.Serve(ln))
 	}
 }
@@ -0,0 +1,219 @@
+package forward
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// the kinds of content, which decide how the body is rewritten
+const (
+	contentHTML        = "html"
+	contentCSS         = "css"
+	contentJavaScript  = "javascript"
+	contentJSON        = "json"
+	contentManifest    = "manifest"
+	contentXML         = "xml"
+	contentSVG         = "svg"
+	contentYAML        = "yaml"
+	contentText        = "text"
+	contentEventStream = "event-stream"
+)
+
+// contentTypes classifies the media types, it does not depend on the mime tables of the host.
+var contentTypes = map[string]string{
+	"text/html":                 contentHTML,
+	"application/xhtml+xml":     contentHTML,
+	"text/css":                  contentCSS,
+	"text/javascript":           contentJavaScript,
+	"text/ecmascript":           contentJavaScript,
+	"text/jscript":              contentJavaScript,
+	"text/x-javascript":         contentJavaScript,
+	"application/javascript":    contentJavaScript,
+	"application/ecmascript":    contentJavaScript,
+	"application/x-javascript":  contentJavaScript,
+	"application/x-ecmascript":  contentJavaScript,
+	"application/json":          contentJSON,
+	"application/x-json":        contentJSON,
+	"text/json":                 contentJSON,
+	"text/x-json":               contentJSON,
+	"application/manifest+json": contentManifest,
+	"application/xml":           contentXML,
+	"text/xml":                  contentXML,
+	"image/svg+xml":             contentSVG,
+	"application/yaml":          contentYAML,
+	"application/x-yaml":        contentYAML,
+	"text/yaml":                 contentYAML,
+	"text/x-yaml":               contentYAML,
+	"text/plain":                contentText,
+	"text/event-stream":         contentEventStream,
+}
+
+// extContentKinds classifies the responses without the media type by the extension of the path.
+var extContentKinds = map[string]string{
+	".html":        contentHTML,
+	".htm":         contentHTML,
+	".xhtml":       contentHTML,
+	".css":         contentCSS,
+	".js":          contentJavaScript,
+	".mjs":         contentJavaScript,
+	".json":        contentJSON,
+	".map":         contentJSON,
+	".webmanifest": contentManifest,
+	".xml":         contentXML,
+	".svg":         contentSVG,
+	".yml":         contentYAML,
+	".yaml":        contentYAML,
+	".txt":         contentText,
+}
+
+// unknownContentTypes are sent for the content the upstream does not know, the body is sniffed.
+var unknownContentTypes = []string{"", "application/octet-stream", "binary/octet-stream", "application/unknown", "unknown/unknown"}
+
+// the bytes sniffed, the same as http.DetectContentType
+const sniffLen = 512
+
+// mediaType returns the lower case media type without the parameters.
+func mediaType(contentType string) string {
+	if t, _, err := mime.ParseMediaType(contentType); err == nil {
+		return t
+	}
+
+	return strings.ToLower(strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0]))
+}
+
+// matchMediaType reports whether the media type matches the pattern like text/* or application/*+json.
+func matchMediaType(pattern, mediaType string) bool {
+	matched, err := path.Match(strings.ToLower(strings.TrimSpace(pattern)), mediaType)
+
+	return err == nil && matched
+}
+
+// classifyMediaType returns the kind of the media type, the structured syntax suffixes +json and +xml are recognized.
+func classifyMediaType(mediaType string) string {
+	if kind, ok := contentTypes[mediaType]; ok {
+		return kind
+	}
+
+	switch {
+	case strings.HasSuffix(mediaType, "+json"):
+		return contentJSON
+	case strings.HasSuffix(mediaType, "+xml"):
+		return contentXML
+	}
+
+	return ""
+}
+
+// contentKind returns the kind of the response content, the empty string if it is not rewritten.
+// It returns true if the kind should be sniffed from the body.
+func (p *ProxyServer) contentKind(res *http.Response) (string, bool) {
+	t := mediaType(res.Header.Get("Content-Type"))
+
+	for _, pattern := range p.NoRewriteContentTypes {
+		if matchMediaType(pattern, t) {
+			return "", false
+		}
+	}
+
+	if kind := classifyMediaType(t); kind != "" {
+		return kind, false
+	}
+
+	for _, pattern := range p.RewriteContentTypes {
+		if matchMediaType(pattern, t) {
+			return contentText, false
+		}
+	}
+
+	if !contains(unknownContentTypes, t) {
+		return "", false
+	}
+
+	if kind, ok := extContentKinds[strings.ToLower(path.Ext(res.Request.URL.Path))]; ok {
+		return kind, false
+	}
+
+	// the client does not sniff either
+	if strings.EqualFold(strings.TrimSpace(res.Header.Get("X-Content-Type-Options")), "nosniff") {
+		return "", false
+	}
+
+	return "", true
+}
+
+// sniffContentKind detects the kind of the beginning of the content.
+func sniffContentKind(content []byte) string {
+	trimmed := bytes.TrimLeft(content, "\xef\xbb\xbf \t\r\n")
+
+	switch mediaType(http.DetectContentType(content)) {
+	case "text/html":
+		return contentHTML
+	case "text/xml":
+		if bytes.Contains(bytes.ToLower(trimmed), []byte("<svg")) {
+			return contentSVG
+		}
+
+		return contentXML
+	case "text/plain":
+		if len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') {
+			return contentJSON
+		}
+
+		return contentText
+	}
+
+	return ""
+}
+
+// sniffContent reads the beginning of the body to detect the kind, the body is restored to be read again.
+func sniffContent(res *http.Response, encoding string) string {
+	prefix := make([]byte, sniffLen)
+	n, _ := io.ReadFull(res.Body, prefix)
+	prefix = prefix[:n]
+
+	res.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(prefix), res.Body), res.Body}
+
+	if n == 0 {
+		return ""
+	}
+
+	var reader io.Reader = bytes.NewReader(prefix)
+
+	// the truncated stream is decoded as far as possible
+	switch encoding {
+	case "gzip":
+		r, err := gzip.NewReader(reader)
+
+		if err != nil {
+			return ""
+		}
+
+		reader = r
+	case "deflate":
+		r, err := zlib.NewReader(reader)
+
+		if err != nil {
+			return ""
+		}
+
+		reader = r
+	case "br":
+		reader = brotli.NewReader(reader)
+	}
+
+	content := make([]byte, sniffLen)
+	n, _ = io.ReadFull(reader, content)
+
+	return sniffContentKind(content[:n])
+}
@@ -0,0 +1,113 @@
+package forward
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestProxyServer_contentKind(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		path        string
+		nosniff     bool
+		options     ProxyServerOptions
+		want        string
+		wantSniff   bool
+	}{
+		{name: "html with charset", contentType: "text/html; charset=UTF-8", want: contentHTML},
+		{name: "upper case", contentType: "Text/HTML", want: contentHTML},
+		{name: "javascript", contentType: "application/x-javascript", want: contentJavaScript},
+		{name: "module", contentType: "text/javascript; charset=utf-8", want: contentJavaScript},
+		{name: "manifest", contentType: "application/manifest+json", want: contentManifest},
+		{name: "json suffix", contentType: "application/ld+json", want: contentJSON},
+		{name: "problem", contentType: "application/problem+json; charset=utf-8", want: contentJSON},
+		{name: "svg", contentType: "image/svg+xml", want: contentSVG},
+		{name: "xml suffix", contentType: "application/atom+xml", want: contentXML},
+		{name: "event stream", contentType: "text/event-stream", want: contentEventStream},
+		{name: "image", contentType: "image/png", path: "/a.html", want: ""},
+		{name: "invalid parameters", contentType: "text/css; charset", want: contentCSS},
+		{name: "excluded", contentType: "image/svg+xml", options: ProxyServerOptions{NoRewriteContentTypes: []string{"image/svg+xml"}}, want: ""},
+		{name: "excluded pattern", contentType: "application/json", options: ProxyServerOptions{NoRewriteContentTypes: []string{"application/*"}}, want: ""},
+		{name: "included", contentType: "text/markdown", options: ProxyServerOptions{RewriteContentTypes: []string{"text/*"}}, want: contentText},
+		{name: "not included", contentType: "text/markdown", want: ""},
+		{name: "missing with extension", path: "/site.webmanifest", want: contentManifest},
+		{name: "octet stream with extension", contentType: "application/octet-stream", path: "/static/app.JS", want: contentJavaScript},
+		{name: "missing", path: "/api", wantSniff: true},
+		{name: "missing with nosniff", path: "/api", nosniff: true, want: ""},
+		{name: "binary", contentType: "binary/octet-stream", path: "/download", wantSniff: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &ProxyServer{ProxyServerOptions: &tt.options}
+
+			path := tt.path
+
+			if path == "" {
+				path = "/"
+			}
+
+			res := &http.Response{Header: http.Header{}, Request: httptest.NewRequest(http.MethodGet, path, nil)}
+
+			if tt.contentType != "" {
+				res.Header.Set("Content-Type", tt.contentType)
+			}
+
+			if tt.nosniff {
+				res.Header.Set("X-Content-Type-Options", "nosniff")
+			}
+
+			got, sniff := p.contentKind(res)
+
+			if got != tt.want || sniff != tt.wantSniff {
+				t.Errorf("contentKind() = %q, %v, want %q, %v", got, sniff, tt.want, tt.wantSniff)
+			}
+		})
+	}
+}
+
+func Test_sniffContent(t *testing.T) {
+	gzipped := func(s string) []byte {
+		buf := &bytes.Buffer{}
+		w := gzip.NewWriter(buf)
+		_, _ = w.Write([]byte(s))
+		_ = w.Close()
+		return buf.Bytes()
+	}
+
+	large := "<!DOCTYPE html><html><body>" + string(bytes.Repeat([]byte("<p>https://example.com</p>"), 100)) + "</body></html>"
+
+	tests := []struct {
+		name     string
+		encoding string
+		body     []byte
+		want     string
+	}{
+		{name: "html", body: []byte("  <!doctype html><title>a</title>"), want: contentHTML},
+		{name: "json", body: []byte(`{"url": "https://example.com"}`), want: contentJSON},
+		{name: "svg", body: []byte(`<?xml version="1.0"?><svg xmlns="http://www.w3.org/2000/svg"></svg>`), want: contentSVG},
+		{name: "xml", body: []byte(`<?xml version="1.0"?><feed></feed>`), want: contentXML},
+		{name: "text", body: []byte("hello https://example.com"), want: contentText},
+		{name: "binary", body: []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"), want: ""},
+		{name: "empty", body: []byte{}, want: ""},
+		{name: "gzip", encoding: "gzip", body: gzipped(large), want: contentHTML},
+		{name: "large", body: []byte(large), want: contentHTML},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := &http.Response{Body: ioutil.NopCloser(bytes.NewReader(tt.body))}
+
+			if got := sniffContent(res, tt.encoding); got != tt.want {
+				t.Errorf("sniffContent() = %q, want %q", got, tt.want)
+			}
+
+			if body, _ := ioutil.ReadAll(res.Body); !bytes.Equal(body, tt.body) {
+				t.Errorf("the body is not restored, got %d bytes, want %d", len(body), len(tt.body))
+			}
+		})
+	}
+}
@@ -0,0 +1,246 @@
+package forward
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var defaultCorsMethods = []string{
+	http.MethodGet,
+	http.MethodHead,
+	http.MethodPost,
+	http.MethodPut,
+	http.MethodPatch,
+	http.MethodDelete,
+	http.MethodOptions,
+}
+
+// CorsPolicy answers the preflight requests locally and sets the CORS headers of the responses.
+type CorsPolicy struct {
+	Origins       []string      // the allowed origins like https://example.com or https://*.example.com, "*" or empty allows all
+	Methods       []string      // the allowed methods, defaults to GET, HEAD, POST, PUT, PATCH, DELETE and OPTIONS
+	Headers       []string      // the allowed request headers, the requested headers are reflected if empty
+	ExposeHeaders []string      // the response headers exposed to the browser
+	Credentials   bool          // whether to allow cookies and authorization headers
+	MaxAge        time.Duration // how long the preflight result could be cached, not sent if 0
+
+	origins []*regexp.Regexp
+	any     bool
+}
+
+func (c *CorsPolicy) compile() error {
+	c.origins = nil
+	c.any = len(c.Origins) == 0
+
+	for _, origin := range c.Origins {
+		if origin == "*" {
+			c.any = true
+			continue
+		}
+
+		// the wildcard matches the labels of the host, eg. https://*.example.com
+		pattern := strings.ReplaceAll(regexp.QuoteMeta(strings.ToLower(origin)), `\*`, `[a-z0-9-]+(\.[a-z0-9-]+)*`)
+
+		reg, err := regexp.Compile("^" + pattern + "$")
+
+		if err != nil {
+			return errors.Wrapf(err, "invalid CORS origin '%s'", origin)
+		}
+
+		c.origins = append(c.origins, reg)
+	}
+
+	// reflecting any origin with credentials lets any site read the logged-in responses
+	if c.any && c.Credentials {
+		log.Printf("WARN: CORS credentials are disabled, they require the explicit origins instead of '*'\n")
+		c.Credentials = false
+	}
+
+	if len(c.Methods) == 0 {
+		c.Methods = append([]string{}, defaultCorsMethods...)
+	}
+
+	for i, method := range c.Methods {
+		c.Methods[i] = strings.ToUpper(method)
+	}
+
+	if c.MaxAge < 0 {
+		return fmt.Errorf("invalid CORS max age '%s'", c.MaxAge)
+	}
+
+	return nil
+}
+
+func newCorsPolicy(options *ProxyServerOptions) *CorsPolicy {
+	policy := options.CorsPolicy
+
+	if policy == nil {
+		if !options.Cors {
+			return nil
+		}
+
+		policy = &CorsPolicy{}
+	}
+
+	if err := policy.compile(); err != nil {
+		log.Printf("WARN: ignore the CORS policy: %+v\n", err)
+		return nil
+	}
+
+	return policy
+}
+
+// allowOrigin returns the value of Access-Control-Allow-Origin, empty if the origin is not allowed.
+func (c *CorsPolicy) allowOrigin(origin string) string {
+	if origin == "" {
+		return ""
+	}
+
+	if c.any {
+		return "*"
+	}
+
+	for _, reg := range c.origins {
+		if reg.MatchString(strings.ToLower(origin)) {
+			return origin
+		}
+	}
+
+	return ""
+}
+
+func (c *CorsPolicy) allowMethod(method string) bool {
+	for _, m := range c.Methods {
+		if m == method {
+			return true
+		}
+	}
+
+	return false
+}
+
+// allowHeaders returns the value of Access-Control-Allow-Headers, false if any requested header is not allowed.
+func (c *CorsPolicy) allowHeaders(requested string) (string, bool) {
+	// the literal "*" is not a wildcard with credentials, the requested headers are reflected instead
+	if len(c.Headers) == 0 || (contains(c.Headers, "*") && c.Credentials) {
+		return requested, true
+	}
+
+	for _, name := range strings.Split(requested, ",") {
+		name = strings.TrimSpace(name)
+
+		if name == "" {
+			continue
+		}
+
+		allowed := false
+
+		for _, h := range c.Headers {
+			if h == "*" || strings.EqualFold(h, name) {
+				allowed = true
+				break
+			}
+		}
+
+		if !allowed {
+			return "", false
+		}
+	}
+
+	return strings.Join(c.Headers, ", "), true
+}
+
+// setHeaders sets the CORS headers of the actual response.
+func (c *CorsPolicy) setHeaders(header http.Header, origin string) {
+	// the response differs by the origin unless it is the wildcard
+	if !c.any {
+		header.Add("Vary", "Origin")
+	}
+
+	allowOrigin := c.allowOrigin(origin)
+
+	if allowOrigin == "" {
+		return
+	}
+
+	header.Set("Access-Control-Allow-Origin", allowOrigin)
+
+	if c.Credentials {
+		header.Set("Access-Control-Allow-Credentials", "true")
+	}
+
+	if len(c.ExposeHeaders) > 0 {
+		header.Set("Access-Control-Expose-Headers", strings.Join(c.ExposeHeaders, ", "))
+	}
+}
+
+// isPreflight reports whether the request is a CORS preflight request.
+func isPreflight(r *http.Request) bool {
+	return r.Method == http.MethodOptions && r.Header.Get("Origin") != "" && r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// serveCors answers the preflight request or sets the CORS headers of the response,
+// it returns false if the request has been answered.
+func (p *ProxyServer) serveCors(w http.ResponseWriter, r *http.Request) bool {
+	if p.cors == nil {
+		return true
+	}
+
+	origin := r.Header.Get("Origin")
+
+	if !isPreflight(r) {
+		p.cors.setHeaders(w.Header(), origin)
+		return true
+	}
+
+	header := w.Header()
+
+	header.Add("Vary", "Origin")
+	header.Add("Vary", "Access-Control-Request-Method")
+	header.Add("Vary", "Access-Control-Request-Headers")
+
+	allowOrigin := p.cors.allowOrigin(origin)
+	method := r.Header.Get("Access-Control-Request-Method")
+	allowHeaders, ok := p.cors.allowHeaders(r.Header.Get("Access-Control-Request-Headers"))
+
+	if allowOrigin == "" || !p.cors.allowMethod(method) || !ok {
+		log.Printf("CORS preflight rejected: %s %s from %s\n", method, r.URL.String(), origin)
+		http.Error(w, "CORS preflight rejected", http.StatusForbidden)
+		return false
+	}
+
+	header.Set("Access-Control-Allow-Origin", allowOrigin)
+	header.Set("Access-Control-Allow-Methods", strings.Join(p.cors.Methods, ", "))
+
+	if allowHeaders != "" {
+		header.Set("Access-Control-Allow-Headers", allowHeaders)
+	}
+
+	if p.cors.Credentials {
+		header.Set("Access-Control-Allow-Credentials", "true")
+	}
+
+	if p.cors.MaxAge > 0 {
+		header.Set("Access-Control-Max-Age", strconv.Itoa(int(p.cors.MaxAge/time.Second)))
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+
+	return false
+}
+
+// removeCorsHeaders removes the CORS headers of the upstream, which are replaced by the policy.
+func removeCorsHeaders(header http.Header) {
+	for name := range header {
+		if strings.HasPrefix(name, "Access-Control-") {
+			header.Del(name)
+		}
+	}
+}
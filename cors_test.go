@@ -0,0 +1,213 @@
+package forward
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCorsPolicy_allowOrigin(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy CorsPolicy
+		origin string
+		want   string
+	}{
+		{name: "any without credentials", policy: CorsPolicy{}, origin: "https://a.com", want: "*"},
+		{name: "any with credentials", policy: CorsPolicy{Credentials: true}, origin: "https://a.com", want: "*"},
+		{name: "wildcard origin with credentials", policy: CorsPolicy{Origins: []string{"*"}, Credentials: true}, origin: "https://a.com", want: "*"},
+		{name: "listed", policy: CorsPolicy{Origins: []string{"https://a.com"}}, origin: "https://a.com", want: "https://a.com"},
+		{name: "not listed", policy: CorsPolicy{Origins: []string{"https://a.com"}}, origin: "https://b.com", want: ""},
+		{name: "wildcard", policy: CorsPolicy{Origins: []string{"https://*.example.com"}}, origin: "https://a.b.example.com", want: "https://a.b.example.com"},
+		{name: "wildcard requires subdomain", policy: CorsPolicy{Origins: []string{"https://*.example.com"}}, origin: "https://example.com", want: ""},
+		{name: "wildcard suffix", policy: CorsPolicy{Origins: []string{"https://*.example.com"}}, origin: "https://evil.com.example.com.evil", want: ""},
+		{name: "scheme", policy: CorsPolicy{Origins: []string{"https://*.example.com"}}, origin: "http://a.example.com", want: ""},
+		{name: "no origin", policy: CorsPolicy{}, origin: "", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := tt.policy
+			if err := policy.compile(); err != nil {
+				t.Fatal(err)
+			}
+			if got := policy.allowOrigin(tt.origin); got != tt.want {
+				t.Errorf("allowOrigin() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCorsPolicy_allowHeaders(t *testing.T) {
+	tests := []struct {
+		name      string
+		policy    CorsPolicy
+		requested string
+		want      string
+		wantOK    bool
+	}{
+		{name: "reflected", policy: CorsPolicy{}, requested: "x-a, x-b", want: "x-a, x-b", wantOK: true},
+		{name: "listed", policy: CorsPolicy{Headers: []string{"X-A"}}, requested: "x-a", want: "X-A", wantOK: true},
+		{name: "not listed", policy: CorsPolicy{Headers: []string{"X-A"}}, requested: "x-b", want: "", wantOK: false},
+		{name: "wildcard", policy: CorsPolicy{Headers: []string{"*"}}, requested: "x-b", want: "*", wantOK: true},
+		{name: "wildcard with credentials", policy: CorsPolicy{Origins: []string{"https://a.com"}, Headers: []string{"*"}, Credentials: true}, requested: "x-b", want: "x-b", wantOK: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := tt.policy
+			if err := policy.compile(); err != nil {
+				t.Fatal(err)
+			}
+			got, ok := policy.allowHeaders(tt.requested)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("allowHeaders() = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestCorsPolicy_compileCredentials(t *testing.T) {
+	for _, origins := range [][]string{nil, {"*"}, {"https://a.com", "*"}} {
+		policy := CorsPolicy{Origins: origins, Credentials: true}
+
+		if err := policy.compile(); err != nil {
+			t.Fatal(err)
+		}
+
+		if policy.Credentials {
+			t.Errorf("credentials of the origins %v are allowed", origins)
+		}
+	}
+}
+
+func TestProxyServer_serveCors(t *testing.T) {
+	upstreamRequests := 0
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamRequests++
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Vary", "Accept-Encoding")
+	}))
+	defer upstream.Close()
+
+	target, _ := url.Parse(upstream.URL)
+
+	server := NewProxyServer(&ProxyServerOptions{
+		Target: target,
+		CorsPolicy: &CorsPolicy{
+			Origins:       []string{"http://localhost:3000"},
+			Headers:       []string{"Content-Type", "Authorization"},
+			ExposeHeaders: []string{"X-Total"},
+			Credentials:   true,
+			MaxAge:        10 * time.Minute,
+		},
+	})
+	defer server.Close()
+
+	proxyServer := httptest.NewServer(http.HandlerFunc(server.Handler()))
+	defer proxyServer.Close()
+
+	tests := []struct {
+		name         string
+		method       string
+		headers      map[string]string
+		wantStatus   int
+		wantUpstream bool
+		wantHeaders  map[string][]string
+	}{
+		{
+			name:       "preflight",
+			method:     http.MethodOptions,
+			headers:    map[string]string{"Origin": "http://localhost:3000", "Access-Control-Request-Method": "PUT", "Access-Control-Request-Headers": "content-type"},
+			wantStatus: http.StatusNoContent,
+			wantHeaders: map[string][]string{
+				"Access-Control-Allow-Origin":      {"http://localhost:3000"},
+				"Access-Control-Allow-Methods":     {"GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS"},
+				"Access-Control-Allow-Headers":     {"Content-Type, Authorization"},
+				"Access-Control-Allow-Credentials": {"true"},
+				"Access-Control-Max-Age":           {"600"},
+				"Vary":                             {"Origin", "Access-Control-Request-Method", "Access-Control-Request-Headers"},
+			},
+		},
+		{
+			name:       "preflight of disallowed origin",
+			method:     http.MethodOptions,
+			headers:    map[string]string{"Origin": "http://evil.com", "Access-Control-Request-Method": "GET"},
+			wantStatus: http.StatusForbidden,
+			wantHeaders: map[string][]string{
+				"Access-Control-Allow-Origin": nil,
+			},
+		},
+		{
+			name:       "preflight of disallowed header",
+			method:     http.MethodOptions,
+			headers:    map[string]string{"Origin": "http://localhost:3000", "Access-Control-Request-Method": "GET", "Access-Control-Request-Headers": "x-secret"},
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:         "actual request",
+			method:       http.MethodGet,
+			headers:      map[string]string{"Origin": "http://localhost:3000"},
+			wantStatus:   http.StatusOK,
+			wantUpstream: true,
+			wantHeaders: map[string][]string{
+				"Access-Control-Allow-Origin":      {"http://localhost:3000"},
+				"Access-Control-Allow-Credentials": {"true"},
+				"Access-Control-Expose-Headers":    {"X-Total"},
+				"Vary":                             {"Origin", "Accept-Encoding"},
+			},
+		},
+		{
+			name:         "actual request of disallowed origin",
+			method:       http.MethodGet,
+			headers:      map[string]string{"Origin": "http://evil.com"},
+			wantStatus:   http.StatusOK,
+			wantUpstream: true,
+			wantHeaders: map[string][]string{
+				"Access-Control-Allow-Origin": nil,
+				"Vary":                        {"Origin", "Accept-Encoding"},
+			},
+		},
+		{
+			name:         "options without preflight headers",
+			method:       http.MethodOptions,
+			wantStatus:   http.StatusOK,
+			wantUpstream: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstreamRequests = 0
+
+			req, _ := http.NewRequest(tt.method, proxyServer.URL, nil)
+
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+
+			res, err := http.DefaultClient.Do(req)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			res.Body.Close()
+
+			if res.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d, want %d", res.StatusCode, tt.wantStatus)
+			}
+
+			if (upstreamRequests > 0) != tt.wantUpstream {
+				t.Errorf("upstream requests = %d, want upstream %v", upstreamRequests, tt.wantUpstream)
+			}
+
+			for k, v := range tt.wantHeaders {
+				if got := res.Header.Values(k); !reflect.DeepEqual(got, v) && !(len(got) == 0 && len(v) == 0) {
+					t.Errorf("%s = %q, want %q", k, got, v)
+				}
+			}
+		})
+	}
+}
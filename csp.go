@@ -0,0 +1,230 @@
+package forward
+
+import (
+	"net"
+	"regexp"
+	"strings"
+)
+
+// the directives whose values are not source lists
+var cspNonSourceDirectives = map[string]bool{
+	"report-uri":                true,
+	"report-to":                 true,
+	"sandbox":                   true,
+	"plugin-types":              true,
+	"trusted-types":             true,
+	"require-trusted-types-for": true,
+	"upgrade-insecure-requests": true,
+	"block-all-mixed-content":   true,
+}
+
+// <meta http-equiv="Content-Security-Policy" content="default-src 'self'">
+var regMetaCSP = regexp.MustCompile(`(?i)(<meta\s[^>]*http-equiv=["']?content-security-policy["']?[^>]*\scontent=)("[^"]*"|'[^']*')`)
+
+// cspDirective is a directive of the policy like "script-src 'self' 'nonce-abc' https://example.com".
+type cspDirective struct {
+	name   string
+	values []string
+}
+
+// parseCSP parses the serialized policy, the duplicated directives are kept as they are.
+func parseCSP(policy string) []cspDirective {
+	directives := []cspDirective{}
+
+	for _, token := range strings.Split(policy, ";") {
+		fields := strings.Fields(token)
+
+		if len(fields) == 0 {
+			continue
+		}
+
+		directives = append(directives, cspDirective{name: strings.ToLower(fields[0]), values: fields[1:]})
+	}
+
+	return directives
+}
+
+func formatCSP(directives []cspDirective) string {
+	tokens := []string{}
+
+	for _, d := range directives {
+		tokens = append(tokens, strings.Join(append([]string{d.name}, d.values...), " "))
+	}
+
+	return strings.Join(tokens, "; ")
+}
+
+// cspHostSource splits the host source like "https://*.example.com:8080/path" into the scheme, host and the rest.
+// It returns false for the keywords, nonces, hashes and scheme sources, which are kept as they are.
+func cspHostSource(source string) (string, string, string, bool) {
+	if strings.HasPrefix(source, "'") || source == "*" || strings.HasSuffix(source, ":") {
+		return "", "", "", false
+	}
+
+	scheme := ""
+
+	if i := strings.Index(source, "://"); i >= 0 {
+		scheme, source = source[:i], source[i+3:]
+	}
+
+	host, rest := source, ""
+
+	if i := strings.IndexAny(source, "/?#"); i >= 0 {
+		host, rest = source[:i], source[i:]
+	}
+
+	if host == "" {
+		return "", "", "", false
+	}
+
+	return scheme, strings.ToLower(host), rest, true
+}
+
+// matchCSPHost reports whether the host source matches the host of the upstream.
+// The source without port matches any port, the wildcard matches the subdomains.
+func matchCSPHost(source, host string) bool {
+	host = strings.ToLower(host)
+	hostname, port := host, ""
+
+	if h, p, err := net.SplitHostPort(host); err == nil {
+		hostname, port = h, p
+	}
+
+	sourceName, sourcePort := source, ""
+
+	if h, p, err := net.SplitHostPort(source); err == nil {
+		sourceName, sourcePort = h, p
+	}
+
+	// the host without port uses the default port of the scheme
+	if port == "" && (sourcePort == "80" || sourcePort == "443") {
+		sourcePort = ""
+	}
+
+	if sourcePort != "" && sourcePort != "*" && sourcePort != port {
+		return false
+	}
+
+	if strings.HasPrefix(sourceName, "*.") {
+		return strings.HasSuffix(hostname, sourceName[1:])
+	}
+
+	return sourceName == hostname
+}
+
+// rewriteCSP maps the host sources of the upstream to the proxy origin. The external hosts are mapped too
+// if they are proxied with forward_url. Nonces and hashes are preserved.
+func (p *ProxyServer) rewriteCSP(policy string, m hostMapping) string {
+	if m.forwarded {
+		return policy
+	}
+
+	scheme := "http"
+
+	if m.useSSL {
+		scheme = "https"
+	}
+
+	proxyOrigin := scheme + "://" + m.proxyHost
+	directives := []cspDirective{}
+
+	for _, d := range parseCSP(policy) {
+		switch {
+		case d.name == "upgrade-insecure-requests":
+			// the proxy serves the resources over HTTP, they could not be upgraded
+			if !m.useSSL {
+				continue
+			}
+		case d.name == "report-uri":
+			for i, v := range d.values {
+				d.values[i] = p.replaceHosts(v, m)
+			}
+		case !cspNonSourceDirectives[d.name]:
+			d.values = p.rewriteCSPSources(d.values, m, proxyOrigin)
+		}
+
+		directives = append(directives, d)
+	}
+
+	return formatCSP(directives)
+}
+
+func (p *ProxyServer) rewriteCSPSources(sources []string, m hostMapping, proxyOrigin string) []string {
+	result := []string{}
+
+	add := func(source string) {
+		if !contains(result, source) {
+			result = append(result, source)
+		}
+	}
+
+	for _, source := range sources {
+		sourceScheme, host, rest, ok := cspHostSource(source)
+
+		if !ok {
+			add(source)
+
+			// the resources of the proxy are requested over HTTP, which the scheme source of HTTPS does not allow
+			if !m.useSSL && (strings.EqualFold(source, "https:") || strings.EqualFold(source, "wss:")) {
+				add(proxyOrigin)
+			}
+
+			continue
+		}
+
+		// the proxy host mapped before, eg. the meta tag of the rewritten HTML
+		if strings.EqualFold(host, m.proxyHost) {
+			// the query of forward_url is not a part of the source
+			add(strings.SplitN(source, "?", 2)[0])
+			continue
+		}
+
+		origin := proxyOrigin
+
+		// the websocket of the upstream is proxied too
+		if sourceScheme == "ws" || sourceScheme == "wss" {
+			origin = "ws" + strings.TrimPrefix(proxyOrigin, "http")
+		}
+
+		matched := false
+
+		for _, originHost := range m.originHosts {
+			if matchCSPHost(host, originHost) {
+				matched = true
+				break
+			}
+		}
+
+		external := p.ProxyExternal && !contains(p.ProxyExternalIgnores, host) && sourceScheme != "ws" && sourceScheme != "wss"
+
+		switch {
+		case matched && strings.HasPrefix(host, "*."):
+			// the other subdomains are requested directly unless external hosts are proxied
+			if !p.ProxyExternal {
+				add(source)
+			}
+
+			add(origin)
+		case matched:
+			add(origin + rest)
+		case external:
+			// the external resources are proxied as /?forward_url=...
+			add(proxyOrigin)
+		default:
+			add(source)
+		}
+	}
+
+	return result
+}
+
+// rewriteMetaCSP rewrites the policies of the meta tags in the HTML.
+func (p *ProxyServer) rewriteMetaCSP(html string, m hostMapping) string {
+	return regMetaCSP.ReplaceAllStringFunc(html, func(s string) string {
+		sub := regMetaCSP.FindStringSubmatch(s)
+		quote := sub[2][:1]
+		policy := sub[2][1 : len(sub[2])-1]
+
+		return sub[1] + quote + p.rewriteCSP(policy, m) + quote
+	})
+}
@@ -0,0 +1,107 @@
+package forward
+
+import (
+	"testing"
+)
+
+func TestProxyServer_rewriteCSP(t *testing.T) {
+	m := hostMapping{originHosts: []string{"www.example.com"}, proxyHost: "localhost:8080"}
+
+	tests := []struct {
+		name    string
+		options ProxyServerOptions
+		m       hostMapping
+		policy  string
+		want    string
+	}{
+		{
+			name:   "upstream hosts",
+			m:      m,
+			policy: "default-src 'self' https://www.example.com; img-src www.example.com/images/ data:",
+			want:   "default-src 'self' http://localhost:8080; img-src http://localhost:8080/images/ data:",
+		},
+		{
+			name:   "nonces and hashes",
+			m:      m,
+			policy: "script-src 'nonce-r4nd0m' 'sha256-abc=' 'strict-dynamic' https://www.example.com:443",
+			want:   "script-src 'nonce-r4nd0m' 'sha256-abc=' 'strict-dynamic' http://localhost:8080",
+		},
+		{
+			name:   "websocket",
+			m:      m,
+			policy: "connect-src 'self' wss://www.example.com",
+			want:   "connect-src 'self' ws://localhost:8080",
+		},
+		{
+			name:   "wildcard",
+			m:      m,
+			policy: "script-src *.example.com",
+			want:   "script-src *.example.com http://localhost:8080",
+		},
+		{
+			name:   "external hosts",
+			m:      m,
+			policy: "script-src https://cdn.example.org",
+			want:   "script-src https://cdn.example.org",
+		},
+		{
+			name:    "external hosts proxied via forward_url",
+			options: ProxyServerOptions{ProxyExternal: true, ProxyExternalIgnores: []string{"fonts.example.org"}},
+			m:       m,
+			policy:  "script-src https://cdn.example.org *.example.com; font-src fonts.example.org",
+			want:    "script-src http://localhost:8080; font-src fonts.example.org",
+		},
+		{
+			name:   "scheme source over HTTP",
+			m:      m,
+			policy: "img-src https:",
+			want:   "img-src https: http://localhost:8080",
+		},
+		{
+			name:   "upgrade-insecure-requests over HTTP",
+			m:      m,
+			policy: "upgrade-insecure-requests; default-src 'self'",
+			want:   "default-src 'self'",
+		},
+		{
+			name:   "upgrade-insecure-requests over HTTPS",
+			m:      hostMapping{originHosts: m.originHosts, proxyHost: m.proxyHost, useSSL: true},
+			policy: "upgrade-insecure-requests; default-src https://www.example.com",
+			want:   "upgrade-insecure-requests; default-src https://localhost:8080",
+		},
+		{
+			name:   "report-uri and sandbox",
+			m:      m,
+			policy: "sandbox allow-scripts; report-uri https://www.example.com/csp",
+			want:   "sandbox allow-scripts; report-uri http://localhost:8080/csp",
+		},
+		{
+			name:   "forward proxy",
+			m:      hostMapping{originHosts: m.originHosts, proxyHost: m.proxyHost, forwarded: true},
+			policy: "upgrade-insecure-requests; default-src www.example.com",
+			want:   "upgrade-insecure-requests; default-src www.example.com",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			options := tt.options
+			p := &ProxyServer{ProxyServerOptions: &options}
+
+			if got := p.rewriteCSP(tt.policy, tt.m); got != tt.want {
+				t.Errorf("rewriteCSP() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProxyServer_rewriteMetaCSP(t *testing.T) {
+	p := &ProxyServer{ProxyServerOptions: &ProxyServerOptions{}}
+	m := hostMapping{originHosts: []string{"www.example.com"}, proxyHost: "localhost:8080"}
+
+	html := `<head><meta http-equiv="Content-Security-Policy" content="script-src 'self' www.example.com"><meta name="a" content="www.example.com"></head>`
+	want := `<head><meta http-equiv="Content-Security-Policy" content="script-src 'self' http://localhost:8080"><meta name="a" content="www.example.com"></head>`
+
+	if got := p.rewriteMetaCSP(html, m); got != want {
+		t.Errorf("rewriteMetaCSP() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,469 @@
+package forward
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// FaultRule injects a fault into the matched requests, for resilience testing.
+type FaultRule struct {
+	Path        string        // regular expression matching the URL path, matches all if empty
+	Methods     []string      // the request methods, matches all if empty
+	Host        string        // the host pattern, matches all if empty
+	Probability float64       // the probability (0-1] of injecting the fault, 1 if 0
+	After       bool          // inject after the upstream call instead of before
+	Delay       time.Duration // add latency
+	Abort       bool          // abort the connection
+	Status      int           // respond with the status code
+	Truncate    int64         // truncate the response body to the number of bytes, disabled if 0
+	Bandwidth   int64         // throttle the response body to bytes per second, disabled if 0
+
+	path *regexp.Regexp
+}
+
+type faultRuleJSON struct {
+	Path        string   `json:"path,omitempty"`
+	Methods     []string `json:"methods,omitempty"`
+	Host        string   `json:"host,omitempty"`
+	Probability float64  `json:"probability,omitempty"`
+	After       bool     `json:"after,omitempty"`
+	Delay       string   `json:"delay,omitempty"`
+	Abort       bool     `json:"abort,omitempty"`
+	Status      int      `json:"status,omitempty"`
+	Truncate    int64    `json:"truncate,omitempty"`
+	Bandwidth   int64    `json:"bandwidth,omitempty"`
+}
+
+func (f FaultRule) MarshalJSON() ([]byte, error) {
+	v := faultRuleJSON{
+		Path:        f.Path,
+		Methods:     f.Methods,
+		Host:        f.Host,
+		Probability: f.Probability,
+		After:       f.After,
+		Abort:       f.Abort,
+		Status:      f.Status,
+		Truncate:    f.Truncate,
+		Bandwidth:   f.Bandwidth,
+	}
+
+	if f.Delay > 0 {
+		v.Delay = f.Delay.String()
+	}
+
+	return json.Marshal(v)
+}
+
+func (f FaultRule) String() string {
+	b, _ := f.MarshalJSON()
+
+	return string(b)
+}
+
+func (f *FaultRule) UnmarshalJSON(b []byte) error {
+	var v faultRuleJSON
+
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+
+	*f = FaultRule{
+		Path:        v.Path,
+		Methods:     v.Methods,
+		Host:        v.Host,
+		Probability: v.Probability,
+		After:       v.After,
+		Abort:       v.Abort,
+		Status:      v.Status,
+		Truncate:    v.Truncate,
+		Bandwidth:   v.Bandwidth,
+	}
+
+	if v.Delay != "" {
+		d, err := time.ParseDuration(v.Delay)
+
+		if err != nil {
+			return err
+		}
+
+		f.Delay = d
+	}
+
+	return nil
+}
+
+// ParseFaultRule parses the rule like "path=^/api,method=GET,probability=0.5,delay=2s,status=503,after".
+// The keys are path, method, host, probability, delay, abort, status, truncate, bandwidth and after.
+// Commas in the regular expressions are escaped as "\,".
+func ParseFaultRule(value string) (FaultRule, error) {
+	rule := FaultRule{}
+
+	for _, paren := range splitEscaped(value, ',') {
+		kv := strings.SplitN(strings.TrimSpace(paren), "=", 2)
+		key := kv[0]
+		val := ""
+
+		if len(kv) == 2 {
+			val = kv[1]
+		}
+
+		var err error
+
+		switch key {
+		case "":
+			continue
+		case "path":
+			rule.Path = val
+		case "method":
+			rule.Methods = append(rule.Methods, strings.ToUpper(val))
+		case "host":
+			rule.Host = val
+		case "probability":
+			rule.Probability, err = strconv.ParseFloat(val, 64)
+		case "delay":
+			rule.Delay, err = time.ParseDuration(val)
+		case "abort":
+			rule.Abort = val == "" || val == "true"
+		case "status":
+			rule.Status, err = strconv.Atoi(val)
+		case "truncate":
+			rule.Truncate, err = strconv.ParseInt(val, 10, 64)
+		case "bandwidth":
+			rule.Bandwidth, err = strconv.ParseInt(val, 10, 64)
+		case "after":
+			rule.After = val == "" || val == "true"
+		default:
+			err = fmt.Errorf("unknown key '%s'", key)
+		}
+
+		if err != nil {
+			return rule, errors.Wrapf(err, "invalid fault '%s'", value)
+		}
+	}
+
+	return rule, rule.compile()
+}
+
+func (f *FaultRule) compile() error {
+	if f.Probability < 0 || f.Probability > 1 {
+		return fmt.Errorf("invalid fault probability %v, it should be in (0, 1]", f.Probability)
+	}
+
+	if f.Status != 0 && (f.Status < 100 || f.Status > 599) {
+		return fmt.Errorf("invalid fault status %d", f.Status)
+	}
+
+	if f.Path == "" {
+		f.path = nil
+		return nil
+	}
+
+	reg, err := regexp.Compile(f.Path)
+
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	f.path = reg
+
+	return nil
+}
+
+func (f *FaultRule) match(r *http.Request) bool {
+	if f.path != nil && !f.path.MatchString(r.URL.Path) {
+		return false
+	}
+
+	if len(f.Methods) > 0 && !contains(f.Methods, r.Method) {
+		return false
+	}
+
+	if f.Host != "" && !matchHostPattern(f.Host, r.Host) {
+		return false
+	}
+
+	probability := f.Probability
+
+	if probability == 0 {
+		probability = 1
+	}
+
+	return rand.Float64() < probability
+}
+
+// faultInjector holds the fault rules, which could be toggled and replaced at runtime.
+type faultInjector struct {
+	enabled int32 // accessed atomically
+	mux     sync.RWMutex
+	rules   []FaultRule
+}
+
+func newFaultInjector(rules []FaultRule) *faultInjector {
+	f := &faultInjector{}
+
+	if err := f.setRules(rules); err != nil {
+		log.Printf("WARN: faults are disabled: %+v\n", err)
+		return f
+	}
+
+	if len(rules) > 0 {
+		f.enabled = 1
+	}
+
+	return f
+}
+
+func (f *faultInjector) setRules(rules []FaultRule) error {
+	compiled := make([]FaultRule, len(rules))
+
+	for i, rule := range rules {
+		if err := rule.compile(); err != nil {
+			return err
+		}
+		compiled[i] = rule
+	}
+
+	f.mux.Lock()
+	f.rules = compiled
+	f.mux.Unlock()
+
+	return nil
+}
+
+// match returns the faults to inject into the request before and after the upstream call.
+func (f *faultInjector) match(r *http.Request) (before, after *FaultRule) {
+	if atomic.LoadInt32(&f.enabled) == 0 {
+		return nil, nil
+	}
+
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	for i := range f.rules {
+		rule := f.rules[i]
+
+		if (rule.After && after != nil) || (!rule.After && before != nil) {
+			continue
+		}
+
+		if !rule.match(r) {
+			continue
+		}
+
+		if rule.After {
+			after = &rule
+		} else {
+			before = &rule
+		}
+	}
+
+	return before, after
+}
+
+// serve injects the faults around the handler.
+func (f *faultInjector) serve(w http.ResponseWriter, r *http.Request, next func(http.ResponseWriter, *http.Request)) {
+	before, after := f.match(r)
+
+	if before != nil {
+		log.Printf("fault [%s]: %s before upstream %s\n", r.Method, r.URL.String(), before)
+
+		if before.Delay > 0 {
+			if err := sleepContext(r.Context(), before.Delay); err != nil {
+				return
+			}
+		}
+
+		if before.Abort {
+			panic(http.ErrAbortHandler)
+		}
+
+		if before.Status != 0 {
+			http.Error(w, fmt.Sprintf("fault injected by forward: %d %s", before.Status, http.StatusText(before.Status)), before.Status)
+			return
+		}
+
+		if before.Bandwidth > 0 {
+			w = &throttledResponseWriter{ResponseWriter: w, ctx: r.Context(), throttle: newThrottle(before.Bandwidth)}
+		}
+	}
+
+	if after == nil {
+		next(w, r)
+		return
+	}
+
+	log.Printf("fault [%s]: %s after upstream %s\n", r.Method, r.URL.String(), after)
+
+	fw := &faultResponseWriter{ResponseWriter: w, r: r, rule: after}
+
+	if after.Bandwidth > 0 {
+		fw.ResponseWriter = &throttledResponseWriter{ResponseWriter: w, ctx: r.Context(), throttle: newThrottle(after.Bandwidth)}
+	}
+
+	next(fw, r)
+
+	// the body has been cut, make sure the client notices it
+	if fw.truncated {
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// faultResponseWriter injects the fault into the response of the upstream.
+type faultResponseWriter struct {
+	http.ResponseWriter
+	r           *http.Request
+	rule        *FaultRule
+	wroteHeader bool
+	written     int64
+	truncated   bool
+	err         error // the client is gone during the delay
+}
+
+func (w *faultResponseWriter) WriteHeader(statusCode int) {
+	if w.wroteHeader {
+		return
+	}
+
+	w.wroteHeader = true
+
+	if w.rule.Delay > 0 {
+		if err := sleepContext(w.r.Context(), w.rule.Delay); err != nil {
+			w.err = err
+			return
+		}
+	}
+
+	if w.rule.Abort {
+		panic(http.ErrAbortHandler)
+	}
+
+	if w.rule.Status != 0 {
+		statusCode = w.rule.Status
+	}
+
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *faultResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	if w.rule.Truncate > 0 {
+		remain := w.rule.Truncate - w.written
+
+		if remain <= 0 {
+			w.truncated = true
+			return 0, errors.New("response truncated by fault injection")
+		}
+
+		if int64(len(b)) > remain {
+			n, err := w.ResponseWriter.Write(b[:remain])
+			w.written += int64(n)
+			w.truncated = true
+
+			if err != nil {
+				return n, err
+			}
+
+			// send what was written, the handler aborts the connection on the error
+			w.Flush()
+
+			return n, errors.New("response truncated by fault injection")
+		}
+	}
+
+	n, err := w.ResponseWriter.Write(b)
+	w.written += int64(n)
+
+	return n, err
+}
+
+func (w *faultResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *faultResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// faultHandler shows the fault rules, toggles them with "POST /faults?enabled=false",
+// or replaces them with "PUT /faults" and a JSON array of rules, which enables the non-empty rules.
+func (p *ProxyServer) faultHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		enabled, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+
+		if err != nil {
+			http.Error(w, "the query 'enabled' should be true or false", http.StatusBadRequest)
+			return
+		}
+
+		var v int32
+
+		if enabled {
+			v = 1
+		}
+
+		atomic.StoreInt32(&p.faults.enabled, v)
+		log.Printf("faults enabled: %v\n", enabled)
+	case http.MethodPut:
+		rules := []FaultRule{}
+
+		if err := json.NewDecoder(r.Body).Decode(&rules); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := p.faults.setRules(rules); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// the rules are put to be injected, the proxy might be started without any
+		if len(rules) > 0 {
+			atomic.StoreInt32(&p.faults.enabled, 1)
+		}
+
+		log.Printf("faults replaced with %d rules\n", len(rules))
+	default:
+		w.Header().Set("Allow", "GET, POST, PUT")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	p.faults.mux.RLock()
+	status := struct {
+		Enabled bool        `json:"enabled"`
+		Rules   []FaultRule `json:"rules"`
+	}{
+		Enabled: atomic.LoadInt32(&p.faults.enabled) == 1,
+		Rules:   p.faults.rules,
+	}
+	p.faults.mux.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+
+	_ = encoder.Encode(status)
+}
@@ -0,0 +1,142 @@
+package forward
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseFaultRule(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    FaultRule
+		wantErr bool
+	}{
+		{
+			name:  "basic",
+			value: "path=^/api,method=get,method=POST,probability=0.5,status=503",
+			want:  FaultRule{Path: "^/api", Methods: []string{"GET", "POST"}, Probability: 0.5, Status: 503},
+		},
+		{
+			name:  "after upstream",
+			value: "delay=2s,truncate=100,bandwidth=1024,abort,after",
+			want:  FaultRule{Delay: 2 * time.Second, Truncate: 100, Bandwidth: 1024, Abort: true, After: true},
+		},
+		{
+			name:  "escaped comma",
+			value: `path=^/v\d{1\,2}/,status=503`,
+			want:  FaultRule{Path: `^/v\d{1,2}/`, Status: 503},
+		},
+		{name: "unknown key", value: "foo=bar", wantErr: true},
+		{name: "invalid probability", value: "probability=2", wantErr: true},
+		{name: "invalid path", value: "path=(", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseFaultRule(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseFaultRule() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if tt.wantErr {
+				return
+			}
+			got.path = nil
+			if got.Path != tt.want.Path || !equalStrings(got.Methods, tt.want.Methods) || got.Probability != tt.want.Probability ||
+				got.Delay != tt.want.Delay || got.Status != tt.want.Status || got.Abort != tt.want.Abort ||
+				got.Truncate != tt.want.Truncate || got.Bandwidth != tt.want.Bandwidth || got.After != tt.want.After {
+				t.Errorf("ParseFaultRule() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProxyServer_faults(t *testing.T) {
+	upstreamCalls := 0
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamCalls++
+		w.Header().Set("Content-Type", "application/octet-stream")
+		_, _ = w.Write([]byte("0123456789"))
+	}))
+	defer upstream.Close()
+
+	target, _ := url.Parse(upstream.URL)
+
+	server := NewProxyServer(&ProxyServerOptions{
+		Target: target,
+		Faults: []FaultRule{
+			{Path: "^/before", Status: http.StatusServiceUnavailable},
+			{Path: "^/after", Status: http.StatusBadGateway, After: true},
+			{Path: "^/truncate", Truncate: 4, After: true},
+		},
+	})
+	defer server.Close()
+
+	proxyServer := httptest.NewServer(http.HandlerFunc(server.Handler()))
+	defer proxyServer.Close()
+
+	admin := httptest.NewServer(server.AdminHandler())
+	defer admin.Close()
+
+	get := func(path string) (int, string, error) {
+		res, err := http.Get(proxyServer.URL + path)
+
+		if err != nil {
+			return 0, "", err
+		}
+
+		defer res.Body.Close()
+
+		body, err := ioutil.ReadAll(res.Body)
+
+		return res.StatusCode, string(body), err
+	}
+
+	if status, _, _ := get("/before"); status != http.StatusServiceUnavailable || upstreamCalls != 0 {
+		t.Errorf("before: status = %d, upstream calls = %d", status, upstreamCalls)
+	}
+
+	if status, body, _ := get("/after"); status != http.StatusBadGateway || body != "0123456789" || upstreamCalls != 1 {
+		t.Errorf("after: status = %d, body = %q, upstream calls = %d", status, body, upstreamCalls)
+	}
+
+	if _, body, err := get("/truncate"); err == nil || body != "0123" {
+		t.Errorf("truncate: body = %q, err = %v", body, err)
+	}
+
+	res, err := http.Post(admin.URL+"/faults?enabled=false", "", nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if b, _ := ioutil.ReadAll(res.Body); !strings.Contains(string(b), `"enabled": false`) {
+		t.Errorf("POST /faults = %s", b)
+	}
+	res.Body.Close()
+
+	if status, _, _ := get("/before"); status != http.StatusOK {
+		t.Errorf("disabled: status = %d, want %d", status, http.StatusOK)
+	}
+
+	req, _ := http.NewRequest(http.MethodPut, admin.URL+"/faults", strings.NewReader(`[{"path": "^/new", "status": 418, "delay": "1ms"}]`))
+
+	if res, err = http.DefaultClient.Do(req); err != nil {
+		t.Fatal(err)
+	}
+
+	if b, _ := ioutil.ReadAll(res.Body); !strings.Contains(string(b), `"delay": "1ms"`) || !strings.Contains(string(b), `"enabled": true`) {
+		t.Errorf("PUT /faults = %s", b)
+	}
+	res.Body.Close()
+
+	if status, _, _ := get("/new"); status != http.StatusTeapot {
+		t.Errorf("replaced: status = %d, want %d", status, http.StatusTeapot)
+	}
+}
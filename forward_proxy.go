@@ -0,0 +1,290 @@
+package forward
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+type forwardTargetContextKey struct{}
+
+// withForwardTarget marks the absolute-form request of a forward proxy client,
+// the request is proxied to the host of its URL instead of the target.
+func withForwardTarget(r *http.Request) *http.Request {
+	target := &url.URL{
+		Scheme: r.URL.Scheme,
+		Host:   r.URL.Host,
+	}
+
+	return r.WithContext(context.WithValue(r.Context(), forwardTargetContextKey{}, target))
+}
+
+func forwardTargetFromContext(ctx context.Context) *url.URL {
+	u, _ := ctx.Value(forwardTargetContextKey{}).(*url.URL)
+
+	return u
+}
+
+// skipHostMapping reports whether the hosts of the request are kept as they are,
+// the forward proxy client requests the hosts themselves instead of the proxy host.
+func skipHostMapping(req *http.Request) bool {
+	return forwardTargetFromContext(req.Context()) != nil
+}
+
+// serveConnect handles the CONNECT request of a forward proxy client.
+// The connection is decrypted if the host should be MITM, or tunnelled to the host as it is.
+func (p *ProxyServer) serveConnect(w http.ResponseWriter, r *http.Request) {
+	hijacker, ok := w.(http.Hijacker)
+
+	if !ok {
+		http.Error(w, "CONNECT is only supported over HTTP/1.x", http.StatusHTTPVersionNotSupported)
+		return
+	}
+
+	host := r.Host
+
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, "443")
+	}
+
+	mitm := p.shouldMITM(host)
+
+	var upstream net.Conn
+
+	if !mitm {
+		conn, err := p.dialTunnel(r.Context(), host)
+
+		if err != nil {
+			log.Printf("[CONNECT]: %s %+v\n", host, err)
+			http.Error(w, err.Error(), upstreamErrorStatus(err))
+			return
+		}
+
+		upstream = conn
+	}
+
+	conn, rw, err := hijacker.Hijack()
+
+	if err != nil {
+		if upstream != nil {
+			_ = upstream.Close()
+		}
+		if errors.Is(err, http.ErrNotSupported) {
+			http.Error(w, "CONNECT is only supported over HTTP/1.x", http.StatusHTTPVersionNotSupported)
+			return
+		}
+		log.Printf("[CONNECT]: %s %+v\n", host, err)
+		return
+	}
+
+	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		_ = conn.Close()
+		if upstream != nil {
+			_ = upstream.Close()
+		}
+		return
+	}
+
+	// the client may have sent data along with the CONNECT request
+	var client net.Conn = &bufferedConn{Conn: conn, r: rw.Reader}
+
+	if mitm {
+		log.Printf("[CONNECT]: %s (MITM)\n", host)
+		p.serveMITM(client, host)
+		return
+	}
+
+	log.Printf("[CONNECT]: %s\n", host)
+	tunnel(client, upstream)
+}
+
+// allowForward reports whether the client could request the host through the forward proxy,
+// the request is answered with 403 if not.
+func (p *ProxyServer) allowForward(w http.ResponseWriter, r *http.Request, host string) bool {
+	allowed := len(p.ForwardProxyClients) == 0
+
+	if ip := net.ParseIP(clientIP(r)); ip != nil {
+		for _, ipNet := range p.ForwardProxyClients {
+			if ipNet.Contains(ip) {
+				allowed = true
+				break
+			}
+		}
+	}
+
+	if allowed && len(p.ForwardProxyHosts) > 0 {
+		allowed = false
+
+		for _, pattern := range p.ForwardProxyHosts {
+			if matchHostPattern(pattern, host) {
+				allowed = true
+				break
+			}
+		}
+	}
+
+	if !allowed {
+		log.Printf("WARN: forward proxy denied %s to %s\n", clientIP(r), host)
+		http.Error(w, "the forward proxy is not allowed", http.StatusForbidden)
+	}
+
+	return allowed
+}
+
+// shouldMITM reports whether the connection to the host should be decrypted.
+func (p *ProxyServer) shouldMITM(host string) bool {
+	if p.mitm == nil {
+		return false
+	}
+
+	for _, pattern := range p.MITMHosts {
+		if matchHostPattern(pattern, host) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// serveMITM terminates TLS with a certificate issued by the MITM CA, then serves
+// the decrypted requests like the absolute-form requests of a forward proxy client.
+func (p *ProxyServer) serveMITM(conn net.Conn, host string) {
+	hostname, _, _ := net.SplitHostPort(host)
+
+	tlsConn := tls.Server(conn, &tls.Config{
+		NextProtos: []string{"http/1.1"},
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			// the certificates are only issued for the MITM hosts
+			if hello.ServerName != "" && p.shouldMITM(hello.ServerName) {
+				return p.mitm.certificate(hello.ServerName)
+			}
+			return p.mitm.certificate(hostname)
+		},
+	})
+
+	handler := p.Handler()
+
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// the server does not see the *tls.Conn behind the listener
+			state := tlsConn.ConnectionState()
+			r.TLS = &state
+			r.URL.Scheme = "https"
+			r.URL.Host = r.Host
+
+			if r.URL.Host == "" {
+				r.URL.Host = host
+			}
+
+			handler(w, r)
+		}),
+		ReadHeaderTimeout: p.ServerReadHeaderTimeout,
+		ReadTimeout:       p.ServerReadTimeout,
+		WriteTimeout:      p.ServerWriteTimeout,
+		IdleTimeout:       p.ServerIdleTimeout,
+		ErrorLog:          log.New(ioutil.Discard, "", 0),
+	}
+
+	_ = server.Serve(newSingleConnListener(tlsConn))
+}
+
+// tunnel copies data between the connections until either side is closed.
+func tunnel(client, upstream net.Conn) {
+	var wg sync.WaitGroup
+
+	pipe := func(dst, src net.Conn) {
+		defer wg.Done()
+		_, _ = io.Copy(dst, src)
+
+		// half close to let the other direction drain
+		if c, ok := dst.(interface{ CloseWrite() error }); ok {
+			_ = c.CloseWrite()
+		} else {
+			_ = dst.Close()
+		}
+	}
+
+	wg.Add(2)
+	go pipe(upstream, client)
+	go pipe(client, upstream)
+	wg.Wait()
+
+	_ = client.Close()
+	_ = upstream.Close()
+}
+
+// bufferedConn is a connection reading from the buffered reader of a hijacked connection first.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// singleConnListener is a listener accepting a single connection,
+// Accept blocks until the connection is closed and then reports io.EOF.
+type singleConnListener struct {
+	conn   net.Conn
+	once   sync.Once
+	closed chan struct{}
+}
+
+func newSingleConnListener(conn net.Conn) *singleConnListener {
+	return &singleConnListener{conn: conn, closed: make(chan struct{})}
+}
+
+func (l *singleConnListener) Accept() (net.Conn, error) {
+	var conn net.Conn
+
+	l.once.Do(func() {
+		conn = &closeNotifyConn{Conn: l.conn, closed: l.closed}
+	})
+
+	if conn != nil {
+		return conn, nil
+	}
+
+	<-l.closed
+
+	return nil, io.EOF
+}
+
+func (l *singleConnListener) Close() error {
+	return nil
+}
+
+func (l *singleConnListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+type closeNotifyConn struct {
+	net.Conn
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (c *closeNotifyConn) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+	})
+
+	return c.Conn.Close()
+}
@@ -0,0 +1,316 @@
+package forward
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+func newForwardProxyClient(t *testing.T, options *ProxyServerOptions, rootCAs *x509.CertPool) *http.Client {
+	options.ForwardProxy = true
+
+	server := NewProxyServer(options)
+	t.Cleanup(server.Close)
+
+	proxyServer := httptest.NewServer(http.HandlerFunc(server.Handler()))
+	t.Cleanup(proxyServer.Close)
+
+	proxyURL, _ := url.Parse(proxyServer.URL)
+
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyURL(proxyURL),
+			TLSClientConfig: &tls.Config{RootCAs: rootCAs},
+		},
+	}
+}
+
+func TestProxyServer_forwardProxy(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write([]byte("hello " + r.Header.Get("X-Injected")))
+	}))
+	defer upstream.Close()
+
+	client := newForwardProxyClient(t, &ProxyServerOptions{
+		ReqHeaders:     http.Header{"X-Injected": []string{"world"}},
+		ReplaceContent: []string{"hello=hi"},
+	}, nil)
+
+	res, err := client.Get(upstream.URL)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer res.Body.Close()
+
+	if body, _ := ioutil.ReadAll(res.Body); string(body) != "hi world" {
+		t.Errorf("body = %q, want %q", body, "hi world")
+	}
+}
+
+func TestProxyServer_forwardProxyMITM(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write([]byte("secret"))
+	}))
+	defer upstream.Close()
+
+	dir := t.TempDir()
+
+	ca, err := LoadOrCreateCA(filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upstreamCAs := x509.NewCertPool()
+	upstreamCAs.AddCert(upstream.Certificate())
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.Leaf)
+
+	client := newForwardProxyClient(t, &ProxyServerOptions{
+		MITMHosts:         []string{"127.0.0.1"},
+		MITMCA:            ca,
+		UpstreamTLSConfig: &tls.Config{RootCAs: upstreamCAs},
+		ReplaceContent:    []string{"secret=decrypted"},
+	}, clientCAs)
+
+	res, err := client.Get(upstream.URL)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer res.Body.Close()
+
+	if body, _ := ioutil.ReadAll(res.Body); string(body) != "decrypted" {
+		t.Errorf("body = %q, want %q", body, "decrypted")
+	}
+
+	// the CA is loaded from the files on the next start
+	loaded, err := LoadOrCreateCA(filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem"))
+
+	if err != nil || !loaded.Leaf.Equal(ca.Leaf) {
+		t.Errorf("LoadOrCreateCA() = %v, %v", loaded, err)
+	}
+}
+
+// newConnectProxy starts the HTTP proxy answering CONNECT requests, the number of tunnels is counted.
+func newConnectProxy(t *testing.T, tunnels *int32) *url.URL {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect || r.Header.Get("Proxy-Authorization") != "Basic dXNlcjpwYXNz" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+
+		upstream, err := net.Dial("tcp", r.Host)
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		atomic.AddInt32(tunnels, 1)
+
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		_, _ = conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+
+		tunnel(conn, upstream)
+	}))
+	t.Cleanup(server.Close)
+
+	u, _ := url.Parse(server.URL)
+	u.User = url.UserPassword("user", "pass")
+
+	return u
+}
+
+// newSOCKS5Proxy starts the SOCKS5 proxy without authentication, the number of tunnels is counted.
+func newSOCKS5Proxy(t *testing.T, tunnels *int32) *url.URL {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { _ = ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+
+			if err != nil {
+				return
+			}
+
+			go func() {
+				r := bufio.NewReader(conn)
+				head := make([]byte, 2)
+				_, _ = io.ReadFull(r, head)
+				_, _ = io.ReadFull(r, make([]byte, head[1]))
+				_, _ = conn.Write([]byte{0x05, 0x00})
+
+				req := make([]byte, 5)
+				_, _ = io.ReadFull(r, req)
+				host := make([]byte, req[4])
+				_, _ = io.ReadFull(r, host)
+				port := make([]byte, 2)
+				_, _ = io.ReadFull(r, port)
+
+				upstream, err := net.Dial("tcp", net.JoinHostPort(string(host), strconv.Itoa(int(port[0])<<8|int(port[1]))))
+
+				if err != nil {
+					_, _ = conn.Write([]byte{0x05, 0x05, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+					_ = conn.Close()
+					return
+				}
+
+				atomic.AddInt32(tunnels, 1)
+
+				_, _ = conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 127, 0, 0, 1, 0, 0})
+
+				tunnel(&bufferedConn{Conn: conn, r: r}, upstream)
+			}()
+		}
+	}()
+
+	return &url.URL{Scheme: "socks5", Host: ln.Addr().String()}
+}
+
+func TestProxyServer_dialTunnel(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("tunnelled"))
+	}))
+	defer upstream.Close()
+
+	// the host name is resolved by the outbound proxy
+	_, port, _ := net.SplitHostPort(upstream.Listener.Addr().String())
+	host := net.JoinHostPort("localhost", port)
+
+	var tunnels int32
+
+	tests := []struct {
+		name        string
+		proxy       *url.URL
+		noProxy     []string
+		wantTunnels int32
+	}{
+		{name: "direct", proxy: nil, wantTunnels: 0},
+		{name: "http", proxy: newConnectProxy(t, &tunnels), wantTunnels: 1},
+		{name: "socks5", proxy: newSOCKS5Proxy(t, &tunnels), wantTunnels: 1},
+		{name: "no proxy", proxy: newConnectProxy(t, &tunnels), noProxy: []string{"localhost"}, wantTunnels: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			atomic.StoreInt32(&tunnels, 0)
+
+			p := NewProxyServer(&ProxyServerOptions{UpstreamProxy: tt.proxy, NoProxy: tt.noProxy})
+			defer p.Close()
+
+			conn, err := p.dialTunnel(context.Background(), host)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer conn.Close()
+
+			_, _ = fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n", host)
+
+			res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer res.Body.Close()
+
+			if body, _ := ioutil.ReadAll(res.Body); string(body) != "tunnelled" {
+				t.Errorf("body = %q, want %q", body, "tunnelled")
+			}
+
+			if got := atomic.LoadInt32(&tunnels); got != tt.wantTunnels {
+				t.Errorf("tunnels of the outbound proxy = %d, want %d", got, tt.wantTunnels)
+			}
+		})
+	}
+}
+
+func TestProxyServer_allowForward(t *testing.T) {
+	local, _ := ParseForwardProxyClient("192.0.2.0/24")
+
+	tests := []struct {
+		name       string
+		options    ProxyServerOptions
+		remoteAddr string
+		host       string
+		want       bool
+	}{
+		{name: "open", remoteAddr: "203.0.113.1:1234", host: "127.0.0.1:22", want: true},
+		{name: "allowed client", options: ProxyServerOptions{ForwardProxyClients: []*net.IPNet{local}}, remoteAddr: "192.0.2.7:1234", host: "example.com:443", want: true},
+		{name: "denied client", options: ProxyServerOptions{ForwardProxyClients: []*net.IPNet{local}}, remoteAddr: "203.0.113.1:1234", host: "example.com:443", want: false},
+		{name: "allowed host", options: ProxyServerOptions{ForwardProxyHosts: []string{".example.com"}}, remoteAddr: "203.0.113.1:1234", host: "www.example.com:443", want: true},
+		{name: "denied host", options: ProxyServerOptions{ForwardProxyHosts: []string{".example.com"}}, remoteAddr: "203.0.113.1:1234", host: "127.0.0.1:22", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &ProxyServer{ProxyServerOptions: &tt.options}
+			r := httptest.NewRequest(http.MethodConnect, "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			w := httptest.NewRecorder()
+
+			if got := p.allowForward(w, r, tt.host); got != tt.want {
+				t.Errorf("allowForward() = %v, want %v", got, tt.want)
+			}
+
+			if !tt.want && w.Code != http.StatusForbidden {
+				t.Errorf("status = %d, want %d", w.Code, http.StatusForbidden)
+			}
+		})
+	}
+}
+
+func Test_mitmCertificatesEviction(t *testing.T) {
+	dir := t.TempDir()
+
+	ca, err := LoadOrCreateCA(filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := newMITMCertificates(ca)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i <= mitmCacheSize; i++ {
+		if _, err := m.certificate(fmt.Sprintf("host%d.example.com", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(m.certs) != mitmCacheSize || len(m.order) != mitmCacheSize {
+		t.Errorf("cached %d certificates, want %d", len(m.certs), mitmCacheSize)
+	}
+
+	if _, ok := m.certs["host0.example.com"]; ok {
+		t.Error("the oldest certificate is not evicted")
+	}
+}
@@ -7,3 +7,5 @@ require github.com/andybalholm/brotli v1.0.4
 require github.com/pkg/errors v0.9.1
 
 require mvdan.cc/xurls/v2 v2.3.0
+
+require golang.org/x/text v0.3.8
@@ -0,0 +1,351 @@
+package forward
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/textproto"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	contentTypeGRPC        = "application/grpc"
+	contentTypeGRPCWeb     = "application/grpc-web"
+	contentTypeGRPCWebText = "application/grpc-web-text"
+
+	// https://github.com/grpc/grpc/blob/master/doc/PROTOCOL-WEB.md
+	grpcWebTrailerFlag byte = 0x80
+
+	// https://github.com/grpc/grpc/blob/master/doc/statuscodes.md
+	grpcStatusUnavailable = 14
+)
+
+// isGRPCContentType reports whether the content type belongs to the gRPC family,
+// including gRPC-Web.
+func isGRPCContentType(contentType string) bool {
+	return strings.HasPrefix(strings.ToLower(strings.TrimSpace(contentType)), contentTypeGRPC)
+}
+
+func isGRPCWebContentType(contentType string) bool {
+	return strings.HasPrefix(strings.ToLower(strings.TrimSpace(contentType)), contentTypeGRPCWeb)
+}
+
+func isGRPCWebTextContentType(contentType string) bool {
+	return strings.HasPrefix(strings.ToLower(strings.TrimSpace(contentType)), contentTypeGRPCWebText)
+}
+
+// grpcWebToGRPCContentType converts a gRPC-Web content type to the native one.
+// eg. application/grpc-web-text+proto -> application/grpc+proto
+func grpcWebToGRPCContentType(contentType string) string {
+	contentType = strings.ToLower(strings.TrimSpace(contentType))
+
+	for _, prefix := range []string{contentTypeGRPCWebText, contentTypeGRPCWeb} {
+		if strings.HasPrefix(contentType, prefix) {
+			return contentTypeGRPC + strings.TrimPrefix(contentType, prefix)
+		}
+	}
+
+	return contentType
+}
+
+// grpcToGRPCWebContentType converts a native gRPC content type to the gRPC-Web one.
+// eg. application/grpc+proto -> application/grpc-web+proto
+func grpcToGRPCWebContentType(contentType string, text bool) string {
+	contentType = strings.ToLower(strings.TrimSpace(contentType))
+
+	prefix := contentTypeGRPCWeb
+
+	if text {
+		prefix = contentTypeGRPCWebText
+	}
+
+	if strings.HasPrefix(contentType, contentTypeGRPC) {
+		return prefix + strings.TrimPrefix(contentType, contentTypeGRPC)
+	}
+
+	return prefix
+}
+
+// newGRPCProxy returns the proxy of gRPC requests. It shares the health, circuit and sticky cookie of upstreams
+// with the HTTP proxy, but the content is never rewritten.
+func (p *ProxyServer) newGRPCProxy(director func(*http.Request), transport http.RoundTripper) *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Director:      director,
+		Transport:     transport,
+		FlushInterval: -1, // gRPC streams must be flushed immediately
+		ModifyResponse: func(res *http.Response) error {
+			u := upstreamFromContext(res.Request.Context())
+
+			if u == nil {
+				return nil
+			}
+
+			// the trailers-only response of UNAVAILABLE tells the upstream could not serve the call
+			if res.Header.Get("Grpc-Status") == fmt.Sprint(grpcStatusUnavailable) {
+				p.pool.markFailure(u, fmt.Errorf("grpc-status %d: %s", grpcStatusUnavailable, res.Header.Get("Grpc-Message")))
+			} else {
+				p.pool.markSuccess(u)
+			}
+
+			p.setStickyCookie(res, u)
+
+			return nil
+		},
+		ErrorHandler: func(rw http.ResponseWriter, r *http.Request, err error) {
+			p.metrics.upstreamErrors.inc(upstreamErrorType(err))
+
+			if errors.Is(err, context.Canceled) {
+				return
+			}
+
+			log.Printf("grpc: %+v\n", err)
+
+			var circuitErr *errCircuitOpen
+			if u := upstreamFromContext(r.Context()); u != nil && !errors.As(err, &circuitErr) {
+				p.pool.markFailure(u, err)
+			}
+
+			writeGRPCError(rw, grpcStatusUnavailable, err.Error())
+		},
+	}
+}
+
+// writeGRPCError writes a trailers-only response.
+// https://github.com/grpc/grpc/blob/master/doc/PROTOCOL-HTTP2.md#responses
+func writeGRPCError(rw http.ResponseWriter, code int, msg string) {
+	rw.Header().Set("Content-Type", contentTypeGRPC)
+	rw.Header().Set("Grpc-Status", fmt.Sprint(code))
+	rw.Header().Set("Grpc-Message", msg)
+	rw.WriteHeader(http.StatusOK)
+}
+
+// serveGRPC proxies native gRPC and gRPC-Web requests without touching their content.
+func (p *ProxyServer) serveGRPC(w http.ResponseWriter, r *http.Request) {
+	contentType := r.Header.Get("Content-Type")
+
+	if !p.GRPCWeb || !isGRPCWebContentType(contentType) {
+		p.grpcProxy.ServeHTTP(w, r)
+		return
+	}
+
+	text := isGRPCWebTextContentType(contentType)
+
+	req := r.Clone(r.Context())
+	req.Header.Set("Content-Type", grpcWebToGRPCContentType(contentType))
+	req.Header.Set("Te", "trailers")
+	req.Header.Del("Content-Length")
+	req.Header.Del("X-Grpc-Web")
+	req.ContentLength = -1
+
+	if text {
+		req.Body = io.NopCloser(&grpcWebTextReader{r: r.Body})
+	}
+
+	rw := &grpcWebResponseWriter{ResponseWriter: w, text: text}
+
+	p.grpcProxy.ServeHTTP(rw, req)
+
+	if err := rw.finish(); err != nil {
+		log.Printf("grpc-web: %+v\n", err)
+	}
+}
+
+// grpcWebTextReader decodes the base64 body of application/grpc-web-text requests.
+// Clients may send several padded base64 chunks, so it decodes quantum by quantum.
+type grpcWebTextReader struct {
+	r       io.Reader
+	pending []byte // encoded bytes that do not form a full quantum yet
+	decoded []byte // decoded bytes that have not been read yet
+	err     error
+}
+
+func (t *grpcWebTextReader) Read(b []byte) (int, error) {
+	for len(t.decoded) == 0 {
+		if t.err != nil {
+			if t.err == io.EOF && len(t.pending) > 0 {
+				return 0, io.ErrUnexpectedEOF
+			}
+			return 0, t.err
+		}
+
+		buf := make([]byte, 4096)
+		n, err := t.r.Read(buf)
+		t.err = err
+		t.pending = append(t.pending, buf[:n]...)
+
+		full := len(t.pending) / 4 * 4
+
+		for i := 0; i < full; i += 4 {
+			quantum := make([]byte, 3)
+			m, err := base64.StdEncoding.Decode(quantum, t.pending[i:i+4])
+
+			if err != nil {
+				return 0, err
+			}
+
+			t.decoded = append(t.decoded, quantum[:m]...)
+		}
+
+		t.pending = t.pending[full:]
+	}
+
+	n := copy(b, t.decoded)
+	t.decoded = t.decoded[n:]
+
+	return n, nil
+}
+
+// grpcWebResponseWriter converts a native gRPC response into a gRPC-Web one.
+// The HTTP trailers of the upstream are written as a trailer frame at the end of the body.
+type grpcWebResponseWriter struct {
+	http.ResponseWriter
+	text          bool
+	wroteHeader   bool
+	trailersOnly  bool
+	trailerKeys   []string
+	encodePending []byte // bytes that do not form a full base64 quantum yet
+}
+
+func (g *grpcWebResponseWriter) WriteHeader(statusCode int) {
+	if g.wroteHeader {
+		return
+	}
+
+	g.wroteHeader = true
+
+	header := g.Header()
+
+	for _, v := range header.Values("Trailer") {
+		for _, k := range strings.Split(v, ",") {
+			if k = strings.TrimSpace(k); k != "" {
+				g.trailerKeys = append(g.trailerKeys, textproto.CanonicalMIMEHeaderKey(k))
+			}
+		}
+	}
+
+	g.trailersOnly = header.Get("Grpc-Status") != ""
+
+	header.Del("Trailer")
+	header.Del("Content-Length")
+	header.Set("Content-Type", grpcToGRPCWebContentType(header.Get("Content-Type"), g.text))
+	header.Add("Access-Control-Expose-Headers", "Grpc-Status, Grpc-Message, Grpc-Status-Details-Bin")
+
+	g.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (g *grpcWebResponseWriter) Write(b []byte) (int, error) {
+	if !g.wroteHeader {
+		g.WriteHeader(http.StatusOK)
+	}
+
+	if err := g.write(b); err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+func (g *grpcWebResponseWriter) write(b []byte) error {
+	if !g.text {
+		_, err := g.ResponseWriter.Write(b)
+		return err
+	}
+
+	g.encodePending = append(g.encodePending, b...)
+
+	full := len(g.encodePending) / 3 * 3
+
+	if full == 0 {
+		return nil
+	}
+
+	_, err := g.ResponseWriter.Write([]byte(base64.StdEncoding.EncodeToString(g.encodePending[:full])))
+	g.encodePending = g.encodePending[full:]
+
+	return err
+}
+
+func (g *grpcWebResponseWriter) Flush() {
+	if f, ok := g.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (g *grpcWebResponseWriter) Unwrap() http.ResponseWriter {
+	return g.ResponseWriter
+}
+
+// finish writes the trailer frame once the upstream response has been copied.
+func (g *grpcWebResponseWriter) finish() error {
+	if !g.wroteHeader {
+		g.WriteHeader(http.StatusOK)
+	}
+
+	trailers := http.Header{}
+
+	for _, k := range g.trailerKeys {
+		if values := g.Header().Values(k); len(values) > 0 {
+			trailers[k] = values
+		}
+	}
+
+	for k, values := range g.Header() {
+		if strings.HasPrefix(k, http.TrailerPrefix) {
+			trailers[textproto.CanonicalMIMEHeaderKey(strings.TrimPrefix(k, http.TrailerPrefix))] = values
+		}
+	}
+
+	if len(trailers) > 0 || !g.trailersOnly {
+		if err := g.write(encodeGRPCWebTrailer(trailers)); err != nil {
+			return err
+		}
+	}
+
+	if g.text && len(g.encodePending) > 0 {
+		if _, err := g.ResponseWriter.Write([]byte(base64.StdEncoding.EncodeToString(g.encodePending))); err != nil {
+			return err
+		}
+		g.encodePending = nil
+	}
+
+	g.Flush()
+
+	return nil
+}
+
+// encodeGRPCWebTrailer encodes the trailers as a gRPC-Web trailer frame.
+func encodeGRPCWebTrailer(trailers http.Header) []byte {
+	keys := make([]string, 0, len(trailers))
+
+	for k := range trailers {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	var block bytes.Buffer
+
+	for _, k := range keys {
+		for _, v := range trailers[k] {
+			block.WriteString(strings.ToLower(k))
+			block.WriteString(": ")
+			block.WriteString(v)
+			block.WriteString("\r\n")
+		}
+	}
+
+	frame := make([]byte, 5, 5+block.Len())
+	frame[0] = grpcWebTrailerFlag
+	binary.BigEndian.PutUint32(frame[1:], uint32(block.Len()))
+
+	return append(frame, block.Bytes()...)
+}
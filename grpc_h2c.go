@@ -0,0 +1,33 @@
+//go:build go1.24
+// +build go1.24
+
+package forward
+
+import (
+	"net/http"
+)
+
+// h2cSupported reports whether HTTP/2 over cleartext (h2c) is available.
+const h2cSupported = true
+
+// newGRPCTransport returns a transport that always speaks HTTP/2,
+// over TLS for https upstreams and over cleartext (h2c) for http upstreams.
+func newGRPCTransport(base *http.Transport) *http.Transport {
+	transport := base.Clone()
+	transport.Protocols = new(http.Protocols)
+	transport.Protocols.SetHTTP2(true)
+	transport.Protocols.SetUnencryptedHTTP2(true)
+
+	return transport
+}
+
+// EnableH2C allows the server to accept HTTP/2 over cleartext connections
+// with prior knowledge, which native gRPC clients use without TLS.
+func EnableH2C(server *http.Server) error {
+	server.Protocols = new(http.Protocols)
+	server.Protocols.SetHTTP1(true)
+	server.Protocols.SetHTTP2(true)
+	server.Protocols.SetUnencryptedHTTP2(true)
+
+	return nil
+}
@@ -0,0 +1,28 @@
+//go:build !go1.24
+// +build !go1.24
+
+package forward
+
+import (
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+// h2cSupported reports whether HTTP/2 over cleartext (h2c) is available.
+const h2cSupported = false
+
+// newGRPCTransport returns a transport that speaks HTTP/2 over TLS.
+// Cleartext upstreams fall back to HTTP/1.1 because h2c requires go1.24 or later.
+func newGRPCTransport(base *http.Transport) *http.Transport {
+	transport := base.Clone()
+	transport.ForceAttemptHTTP2 = true
+
+	return transport
+}
+
+// EnableH2C allows the server to accept HTTP/2 over cleartext connections
+// with prior knowledge, which native gRPC clients use without TLS.
+func EnableH2C(server *http.Server) error {
+	return errors.New("h2c requires forward to be built with go1.24 or later")
+}
@@ -0,0 +1,188 @@
+package forward
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func Test_grpcWebToGRPCContentType(t *testing.T) {
+	tests := []struct {
+		contentType string
+		want        string
+	}{
+		{contentType: "application/grpc-web", want: "application/grpc"},
+		{contentType: "application/grpc-web+proto", want: "application/grpc+proto"},
+		{contentType: "application/grpc-web-text", want: "application/grpc"},
+		{contentType: "application/grpc-web-text+proto", want: "application/grpc+proto"},
+		{contentType: "application/grpc+json", want: "application/grpc+json"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.contentType, func(t *testing.T) {
+			if got := grpcWebToGRPCContentType(tt.contentType); got != tt.want {
+				t.Errorf("grpcWebToGRPCContentType() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_grpcWebTextReader(t *testing.T) {
+	// clients may concatenate several padded chunks
+	body := base64.StdEncoding.EncodeToString([]byte("hello")) + base64.StdEncoding.EncodeToString([]byte(" world!"))
+
+	got, err := ioutil.ReadAll(&grpcWebTextReader{r: strings.NewReader(body)})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(got) != "hello world!" {
+		t.Errorf("grpcWebTextReader = %q, want %q", got, "hello world!")
+	}
+}
+
+func Test_encodeGRPCWebTrailer(t *testing.T) {
+	got := encodeGRPCWebTrailer(http.Header{
+		"Grpc-Status":  []string{"0"},
+		"Grpc-Message": []string{"OK"},
+	})
+
+	want := append([]byte{0x80, 0, 0, 0, 34}, []byte("grpc-message: OK\r\ngrpc-status: 0\r\n")...)
+
+	if !bytes.Equal(got, want) {
+		t.Errorf("encodeGRPCWebTrailer() = %q, want %q", got, want)
+	}
+}
+
+func TestProxyServer_serveGRPCWeb(t *testing.T) {
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			t.Errorf("upstream protocol = %s, want HTTP/2", r.Proto)
+		}
+
+		if got := r.Header.Get("Content-Type"); got != "application/grpc+proto" {
+			t.Errorf("upstream content type = %s", got)
+		}
+
+		body, _ := ioutil.ReadAll(r.Body)
+
+		w.Header().Set("Content-Type", "application/grpc+proto")
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(body)
+		w.Header().Set("Grpc-Status", "0")
+	}))
+	upstream.EnableHTTP2 = true
+	upstream.StartTLS()
+	defer upstream.Close()
+
+	target, _ := url.Parse(upstream.URL)
+
+	server := NewProxyServer(&ProxyServerOptions{
+		Target:  target,
+		GRPCWeb: true,
+	})
+	server.grpcProxy.Transport = upstream.Client().Transport
+
+	message := []byte{0, 0, 0, 0, 3, 'a', 'b', 'c'}
+
+	req := httptest.NewRequest(http.MethodPost, "/echo.Echo/Echo", strings.NewReader(base64.StdEncoding.EncodeToString(message)))
+	req.Header.Set("Content-Type", "application/grpc-web-text+proto")
+
+	rec := httptest.NewRecorder()
+
+	server.Handler()(rec, req)
+
+	if got := rec.Header().Get("Content-Type"); got != "application/grpc-web-text+proto" {
+		t.Errorf("content type = %s", got)
+	}
+
+	decoded, err := ioutil.ReadAll(&grpcWebTextReader{r: rec.Body})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := append(message, encodeGRPCWebTrailer(http.Header{"Grpc-Status": []string{"0"}})...)
+
+	if !bytes.Equal(decoded, want) {
+		t.Errorf("body = %q, want %q", decoded, want)
+	}
+}
+
+func TestProxyServer_grpcUpstream(t *testing.T) {
+	tests := []struct {
+		name           string
+		threshold      int
+		calls          int
+		header         http.Header
+		err            error
+		wantFails      int
+		wantRoundTrips int
+		wantSticky     bool
+	}{
+		{name: "success", calls: 1, header: http.Header{"Grpc-Status": []string{"0"}}, wantFails: 0, wantRoundTrips: 1, wantSticky: true},
+		{name: "unavailable", calls: 1, header: http.Header{"Grpc-Status": []string{"14"}}, wantFails: 1, wantRoundTrips: 1, wantSticky: true},
+		{name: "error", calls: 1, err: errors.New("connection refused"), wantFails: 1, wantRoundTrips: 1},
+		{name: "circuit open", threshold: 1, calls: 2, err: errors.New("connection refused"), wantFails: 1, wantRoundTrips: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target, _ := url.Parse("http://127.0.0.1:50051")
+
+			server := NewProxyServer(&ProxyServerOptions{
+				Target:                  target,
+				GRPC:                    true,
+				Balance:                 BalanceCookie,
+				CircuitBreakerThreshold: tt.threshold,
+			})
+			defer server.Close()
+
+			roundTrips := 0
+			server.grpcProxy = server.newGRPCProxy(server.proxy.Director, server.wrapTransport(roundTripFunc(func(req *http.Request) (*http.Response, error) {
+				roundTrips++
+
+				if tt.err != nil {
+					return nil, tt.err
+				}
+
+				header := tt.header.Clone()
+				header.Set("Content-Type", "application/grpc")
+
+				return &http.Response{StatusCode: http.StatusOK, Header: header, Body: http.NoBody, Request: req}, nil
+			})))
+
+			var rec *httptest.ResponseRecorder
+
+			for i := 0; i < tt.calls; i++ {
+				req := httptest.NewRequest(http.MethodPost, "/echo.Echo/Echo", strings.NewReader(""))
+				req.Header.Set("Content-Type", "application/grpc")
+
+				rec = httptest.NewRecorder()
+				server.Handler()(rec, req)
+			}
+
+			if roundTrips != tt.wantRoundTrips {
+				t.Errorf("round trips = %d, want %d", roundTrips, tt.wantRoundTrips)
+			}
+
+			if fails := server.pool.upstreams[0].fails; fails != tt.wantFails {
+				t.Errorf("fails = %d, want %d", fails, tt.wantFails)
+			}
+
+			if sticky := strings.Contains(rec.Header().Get("Set-Cookie"), stickyCookieName); sticky != tt.wantSticky {
+				t.Errorf("sticky cookie = %v, want %v", sticky, tt.wantSticky)
+			}
+
+			if tt.err != nil && rec.Header().Get("Grpc-Status") != "14" {
+				t.Errorf("grpc-status = %q, want %q", rec.Header().Get("Grpc-Status"), "14")
+			}
+		})
+	}
+}
@@ -0,0 +1,310 @@
+package forward
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	HeaderSideRequest  = "request"
+	HeaderSideResponse = "response"
+)
+
+const (
+	HeaderActionSet     = "set"     // replace all the values of the header
+	HeaderActionAdd     = "add"     // append a value to the header
+	HeaderActionRemove  = "remove"  // remove the header
+	HeaderActionRename  = "rename"  // move the values to another header
+	HeaderActionReplace = "replace" // rewrite the values matched by the regular expression
+)
+
+type requestIDContextKey struct{}
+
+// HeaderRule rewrites a header of the requests sent to the upstream or the responses sent to the client.
+// The value is a template, the variables are ${client_ip}, ${method}, ${host}, ${path}, ${query}, ${upstream},
+// ${timestamp} and ${request_id}.
+type HeaderRule struct {
+	Side        string   // request or response
+	Action      string   // set, add, remove, rename or replace
+	Name        string   // the header name
+	Value       string   // the value template, or the replacement of replace, which supports $1
+	To          string   // the new header name of rename
+	Match       string   // regular expression matching the values of replace
+	Path        string   // regular expression matching the URL path, matches all if empty
+	Status      []string // the response status like 404 or 4xx, matches all if empty
+	ContentType string   // regular expression matching the Content-Type of the request or response, matches all if empty
+
+	path        *regexp.Regexp
+	match       *regexp.Regexp
+	contentType *regexp.Regexp
+}
+
+// ParseHeaderRule parses the rule like "action=set,name=Cache-Control,value=no-store,path=^/static/,status=2xx".
+// Commas in the value are escaped as "\,".
+func ParseHeaderRule(side, value string) (HeaderRule, error) {
+	rule := HeaderRule{Side: side}
+
+	for _, paren := range splitEscaped(value, ',') {
+		kv := strings.SplitN(strings.TrimSpace(paren), "=", 2)
+		key := kv[0]
+		val := ""
+
+		if len(kv) == 2 {
+			val = kv[1]
+		}
+
+		var err error
+
+		switch key {
+		case "":
+			continue
+		case "action":
+			rule.Action = strings.ToLower(val)
+		case "name":
+			rule.Name = val
+		case "value":
+			rule.Value = val
+		case "to":
+			rule.To = val
+		case "match":
+			rule.Match = val
+		case "path":
+			rule.Path = val
+		case "status":
+			rule.Status = append(rule.Status, strings.ToLower(val))
+		case "content-type":
+			rule.ContentType = val
+		default:
+			err = fmt.Errorf("unknown key '%s'", key)
+		}
+
+		if err != nil {
+			return rule, errors.Wrapf(err, "invalid header rule '%s'", value)
+		}
+	}
+
+	return rule, rule.compile()
+}
+
+// splitEscaped splits the string by the separator, which is kept if escaped with a backslash.
+func splitEscaped(s string, sep byte) []string {
+	parts := []string{}
+	part := []byte{}
+
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) && s[i+1] == sep {
+			part = append(part, sep)
+			i++
+			continue
+		}
+
+		if s[i] == sep {
+			parts = append(parts, string(part))
+			part = []byte{}
+			continue
+		}
+
+		part = append(part, s[i])
+	}
+
+	return append(parts, string(part))
+}
+
+func (r *HeaderRule) compile() error {
+	switch r.Side {
+	case HeaderSideRequest, HeaderSideResponse:
+	default:
+		return fmt.Errorf("invalid side '%s' of the header rule", r.Side)
+	}
+
+	if r.Name == "" {
+		return errors.New("the header rule requires a name")
+	}
+
+	switch r.Action {
+	case HeaderActionSet, HeaderActionAdd, HeaderActionRemove:
+	case HeaderActionRename:
+		if r.To == "" {
+			return fmt.Errorf("the header rule of '%s' requires the new name", r.Name)
+		}
+	case HeaderActionReplace:
+		if r.Match == "" {
+			return fmt.Errorf("the header rule of '%s' requires the match", r.Name)
+		}
+	default:
+		return fmt.Errorf("invalid action '%s' of the header rule", r.Action)
+	}
+
+	if len(r.Status) > 0 && r.Side != HeaderSideResponse {
+		return errors.New("the status of the header rule only applies to the response")
+	}
+
+	for _, status := range r.Status {
+		if ok, _ := regexp.MatchString(`^[1-5]([0-9]{2}|xx)$`, status); !ok {
+			return fmt.Errorf("invalid status '%s' of the header rule", status)
+		}
+	}
+
+	var err error
+
+	if r.Path != "" {
+		if r.path, err = regexp.Compile(r.Path); err != nil {
+			return errors.Wrapf(err, "invalid path of the header rule '%s'", r.Path)
+		}
+	}
+
+	if r.Match != "" {
+		if r.match, err = regexp.Compile(r.Match); err != nil {
+			return errors.Wrapf(err, "invalid match of the header rule '%s'", r.Match)
+		}
+	}
+
+	if r.ContentType != "" {
+		if r.contentType, err = regexp.Compile(r.ContentType); err != nil {
+			return errors.Wrapf(err, "invalid content type of the header rule '%s'", r.ContentType)
+		}
+	}
+
+	return nil
+}
+
+func newHeaderRules(rules []HeaderRule) []HeaderRule {
+	compiled := []HeaderRule{}
+
+	for _, rule := range rules {
+		if err := rule.compile(); err != nil {
+			log.Printf("WARN: ignore the header rule: %+v\n", err)
+			continue
+		}
+
+		compiled = append(compiled, rule)
+	}
+
+	return compiled
+}
+
+// matches reports whether the rule applies, status is 0 for the request.
+func (r *HeaderRule) matches(req *http.Request, header http.Header, status int) bool {
+	if r.path != nil && !r.path.MatchString(req.URL.Path) {
+		return false
+	}
+
+	if r.contentType != nil && !r.contentType.MatchString(header.Get("Content-Type")) {
+		return false
+	}
+
+	if len(r.Status) == 0 {
+		return true
+	}
+
+	code := strconv.Itoa(status)
+
+	for _, s := range r.Status {
+		if s == code || (strings.HasSuffix(s, "xx") && s[0] == code[0]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// withRequestID attaches a random ID to the request, which is shared by the request and response rules.
+func withRequestID(r *http.Request) *http.Request {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+
+	return r.WithContext(context.WithValue(r.Context(), requestIDContextKey{}, hex.EncodeToString(b)))
+}
+
+// expandHeaderTemplate expands the variables of the outbound request, the values are escaped if escape is not nil.
+func expandHeaderTemplate(template string, req *http.Request, escape func(string) string) string {
+	if !strings.Contains(template, "${") {
+		return template
+	}
+
+	requestID, _ := req.Context().Value(requestIDContextKey{}).(string)
+
+	host := req.Header.Get(headerXOriginHost)
+
+	if host == "" {
+		host = req.Host
+	}
+
+	variables := []string{
+		"${client_ip}", clientIP(req),
+		"${method}", req.Method,
+		"${host}", host,
+		"${path}", req.URL.Path,
+		"${query}", req.URL.RawQuery,
+		"${upstream}", req.URL.Host,
+		"${timestamp}", strconv.FormatInt(time.Now().Unix(), 10),
+		"${request_id}", requestID,
+	}
+
+	if escape != nil {
+		for i := 1; i < len(variables); i += 2 {
+			variables[i] = escape(variables[i])
+		}
+	}
+
+	return strings.NewReplacer(variables...).Replace(template)
+}
+
+// applyHeaderRules applies the rules of the side in order, status is 0 for the request.
+func (p *ProxyServer) applyHeaderRules(side string, req *http.Request, header http.Header, status int) {
+	for i := range p.headerRules {
+		rule := &p.headerRules[i]
+
+		if rule.Side != side || !rule.matches(req, header, status) {
+			continue
+		}
+
+		switch rule.Action {
+		case HeaderActionSet:
+			header.Set(rule.Name, expandHeaderTemplate(rule.Value, req, nil))
+		case HeaderActionAdd:
+			header.Add(rule.Name, expandHeaderTemplate(rule.Value, req, nil))
+		case HeaderActionRemove:
+			header.Del(rule.Name)
+		case HeaderActionRename:
+			values := header.Values(rule.Name)
+
+			if len(values) == 0 {
+				continue
+			}
+
+			header.Del(rule.Name)
+
+			for _, v := range values {
+				header.Add(rule.To, v)
+			}
+		case HeaderActionReplace:
+			values := header.Values(rule.Name)
+
+			if len(values) == 0 {
+				continue
+			}
+
+			// the expanded variables are literal in the replacement, unlike $1 of the rule
+			replacement := expandHeaderTemplate(rule.Value, req, func(s string) string {
+				return strings.ReplaceAll(s, "$", "$$")
+			})
+
+			header.Del(rule.Name)
+
+			for _, v := range values {
+				header.Add(rule.Name, rule.match.ReplaceAllString(v, replacement))
+			}
+		}
+	}
+}
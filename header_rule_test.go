@@ -0,0 +1,165 @@
+package forward
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestParseHeaderRule(t *testing.T) {
+	tests := []struct {
+		name    string
+		side    string
+		value   string
+		want    HeaderRule
+		wantErr bool
+	}{
+		{
+			name:  "set with escaped comma",
+			side:  HeaderSideResponse,
+			value: `action=set,name=Cache-Control,value=no-cache\, no-store,status=2xx,status=404`,
+			want:  HeaderRule{Side: HeaderSideResponse, Action: HeaderActionSet, Name: "Cache-Control", Value: "no-cache, no-store", Status: []string{"2xx", "404"}},
+		},
+		{
+			name:  "rename",
+			side:  HeaderSideRequest,
+			value: "action=rename,name=X-Token,to=Authorization,path=^/api/",
+			want:  HeaderRule{Side: HeaderSideRequest, Action: HeaderActionRename, Name: "X-Token", To: "Authorization", Path: "^/api/"},
+		},
+		{name: "unknown key", side: HeaderSideRequest, value: "action=set,name=a,foo=bar", wantErr: true},
+		{name: "unknown action", side: HeaderSideRequest, value: "action=drop,name=a", wantErr: true},
+		{name: "missing name", side: HeaderSideRequest, value: "action=remove", wantErr: true},
+		{name: "rename without to", side: HeaderSideRequest, value: "action=rename,name=a", wantErr: true},
+		{name: "replace without match", side: HeaderSideResponse, value: "action=replace,name=a", wantErr: true},
+		{name: "status of request", side: HeaderSideRequest, value: "action=remove,name=a,status=200", wantErr: true},
+		{name: "invalid status", side: HeaderSideResponse, value: "action=remove,name=a,status=6xx", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseHeaderRule(tt.side, tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseHeaderRule() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err != nil {
+				return
+			}
+			got.path, got.match, got.contentType = nil, nil, nil
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseHeaderRule() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProxyServer_applyHeaderRules(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for k, v := range r.Header {
+			w.Header()["Echo-"+k] = v
+		}
+
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Server", "nginx")
+		w.Header().Set("Cache-Control", "max-age=3600")
+		w.Header().Set("Set-Cookie", "a=1; Domain=example.com")
+
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer upstream.Close()
+
+	target, _ := url.Parse(upstream.URL)
+
+	rules := []HeaderRule{}
+
+	for _, v := range []struct{ side, value string }{
+		{HeaderSideRequest, "action=set,name=X-Trace,value=${method} ${path} ${upstream}"},
+		{HeaderSideRequest, "action=rename,name=X-Token,to=Authorization"},
+		{HeaderSideRequest, "action=remove,name=X-Debug,path=^/api/"},
+		{HeaderSideResponse, "action=remove,name=Server"},
+		{HeaderSideResponse, "action=set,name=Cache-Control,value=no-store,status=4xx"},
+		{HeaderSideResponse, "action=replace,name=Set-Cookie,match=Domain=[^;]+,value=Domain=${host}"},
+		{HeaderSideResponse, "action=add,name=X-Html,value=1,content-type=^text/html"},
+	} {
+		rule, err := ParseHeaderRule(v.side, v.value)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rules = append(rules, rule)
+	}
+
+	server := NewProxyServer(&ProxyServerOptions{
+		Target:      target,
+		ResHeaders:  http.Header{"X-Powered-By": []string{"forward"}},
+		HeaderRules: rules,
+	})
+	defer server.Close()
+
+	proxyServer := httptest.NewServer(http.HandlerFunc(server.Handler()))
+	defer proxyServer.Close()
+
+	proxyURL, _ := url.Parse(proxyServer.URL)
+
+	tests := []struct {
+		name        string
+		path        string
+		headers     map[string]string
+		wantHeaders map[string]string
+	}{
+		{
+			name:    "api",
+			path:    "/api/users",
+			headers: map[string]string{"X-Token": "secret", "X-Debug": "1"},
+			wantHeaders: map[string]string{
+				"Echo-X-Trace":       "GET /api/users " + target.Host,
+				"Echo-Authorization": "secret",
+				"Echo-X-Token":       "",
+				"Echo-X-Debug":       "",
+				"Server":             "",
+				"Cache-Control":      "max-age=3600",
+				"Set-Cookie":         "a=1; Domain=" + proxyURL.Host,
+				"X-Html":             "1",
+				"X-Powered-By":       "forward",
+			},
+		},
+		{
+			name:    "not found",
+			path:    "/missing",
+			headers: map[string]string{"X-Debug": "1"},
+			wantHeaders: map[string]string{
+				"Echo-X-Debug":  "1",
+				"Cache-Control": "no-store",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, proxyServer.URL+tt.path, nil)
+
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+
+			res, err := http.DefaultClient.Do(req)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, _ = ioutil.ReadAll(res.Body)
+			res.Body.Close()
+
+			for k, v := range tt.wantHeaders {
+				if got := res.Header.Get(k); got != v {
+					t.Errorf("%s = %q, want %q", k, got, v)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,330 @@
+package forward
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// JSONReplaceRule replaces the content of the string values matched by the JSONPath.
+type JSONReplaceRule struct {
+	Path string // the JSONPath like $.data.items[*].url or $..avatar, supports $, .key, ['key'], [n], [*], .* and ..key
+	Old  string // the content to be replaced
+	New  string // the new content
+
+	path []jsonPathSegment
+}
+
+type jsonPathSegment struct {
+	key       string
+	index     int  // -1 if the segment is not an index
+	wildcard  bool // .* or [*]
+	recursive bool // ..key, the descendants of any depth
+}
+
+// ParseJSONReplaceRule parses the rule like "path=$..avatar,old=cdn.example.com,new=localhost:8080".
+// Commas in the values are escaped as "\,".
+func ParseJSONReplaceRule(value string) (JSONReplaceRule, error) {
+	rule := JSONReplaceRule{}
+
+	for _, paren := range splitEscaped(value, ',') {
+		kv := strings.SplitN(strings.TrimSpace(paren), "=", 2)
+		key := kv[0]
+		val := ""
+
+		if len(kv) == 2 {
+			val = kv[1]
+		}
+
+		switch key {
+		case "":
+			continue
+		case "path":
+			rule.Path = val
+		case "old":
+			rule.Old = val
+		case "new":
+			rule.New = val
+		default:
+			return rule, fmt.Errorf("invalid JSON replacement '%s': unknown key '%s'", value, key)
+		}
+	}
+
+	return rule, rule.compile()
+}
+
+func (r *JSONReplaceRule) compile() error {
+	if r.Old == "" {
+		return fmt.Errorf("the JSON replacement of '%s' requires the old content", r.Path)
+	}
+
+	path, err := parseJSONPath(r.Path)
+
+	if err != nil {
+		return errors.Wrapf(err, "invalid JSONPath '%s'", r.Path)
+	}
+
+	r.path = path
+
+	return nil
+}
+
+func newJSONReplaceRules(rules []JSONReplaceRule) []JSONReplaceRule {
+	compiled := []JSONReplaceRule{}
+
+	for _, rule := range rules {
+		if err := rule.compile(); err != nil {
+			log.Printf("WARN: ignore the JSON replacement: %+v\n", err)
+			continue
+		}
+
+		compiled = append(compiled, rule)
+	}
+
+	return compiled
+}
+
+// parseJSONPath parses the subset of JSONPath.
+func parseJSONPath(path string) ([]jsonPathSegment, error) {
+	if !strings.HasPrefix(path, "$") {
+		return nil, errors.New("the path should start with $")
+	}
+
+	segments := []jsonPathSegment{}
+	s := path[1:]
+
+	for s != "" {
+		segment := jsonPathSegment{index: -1}
+
+		switch {
+		case strings.HasPrefix(s, ".."):
+			segment.recursive = true
+			s = s[2:]
+		case strings.HasPrefix(s, "."):
+			s = s[1:]
+		case strings.HasPrefix(s, "["):
+		default:
+			return nil, fmt.Errorf("unexpected '%s'", s)
+		}
+
+		if strings.HasPrefix(s, "[") {
+			end := strings.Index(s, "]")
+
+			if end < 0 {
+				return nil, errors.New("missing ]")
+			}
+
+			inner := s[1:end]
+			s = s[end+1:]
+
+			switch {
+			case inner == "*":
+				segment.wildcard = true
+			case len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0]:
+				segment.key = inner[1 : len(inner)-1]
+			default:
+				index, err := strconv.Atoi(inner)
+
+				if err != nil || index < 0 {
+					return nil, fmt.Errorf("invalid index '%s'", inner)
+				}
+
+				segment.index = index
+			}
+		} else {
+			end := strings.IndexAny(s, ".[")
+
+			if end < 0 {
+				end = len(s)
+			}
+
+			name := s[:end]
+			s = s[end:]
+
+			switch name {
+			case "":
+				return nil, errors.New("empty key")
+			case "*":
+				segment.wildcard = true
+			default:
+				segment.key = name
+			}
+		}
+
+		segments = append(segments, segment)
+	}
+
+	return segments, nil
+}
+
+// jsonPathElement is the key of object or the index of array.
+type jsonPathElement struct {
+	key   string
+	index int // -1 for the key of object
+}
+
+func (s jsonPathSegment) match(e jsonPathElement) bool {
+	if s.wildcard {
+		return true
+	}
+
+	if s.index >= 0 {
+		return e.index == s.index
+	}
+
+	return e.index < 0 && e.key == s.key
+}
+
+// matchJSONPath reports whether the location of the value matches the path.
+func matchJSONPath(path []jsonPathSegment, location []jsonPathElement) bool {
+	if len(path) == 0 {
+		return len(location) == 0
+	}
+
+	if len(location) == 0 {
+		return false
+	}
+
+	if path[0].recursive {
+		for i := range location {
+			if path[0].match(location[i]) && matchJSONPath(path[1:], location[i+1:]) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	return path[0].match(location[0]) && matchJSONPath(path[1:], location[1:])
+}
+
+// jsonContainer is the object or array being scanned.
+type jsonContainer struct {
+	array     bool
+	index     int
+	key       string
+	expectKey bool
+}
+
+// rewriteJSON rewrites the string values of the JSON, the formatting, keys, numbers and the order are kept.
+// It returns false if the content is not valid JSON.
+func rewriteJSON(content []byte, rewrite func(value string, location []jsonPathElement) string) ([]byte, bool) {
+	if !json.Valid(content) {
+		return content, false
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(content)))
+	stack := []*jsonContainer{}
+
+	location := func() []jsonPathElement {
+		elements := make([]jsonPathElement, 0, len(stack))
+
+		for _, c := range stack {
+			if c.array {
+				elements = append(elements, jsonPathElement{index: c.index})
+			} else {
+				elements = append(elements, jsonPathElement{key: c.key, index: -1})
+			}
+		}
+
+		return elements
+	}
+
+	for i := 0; i < len(content); i++ {
+		c := content[i]
+
+		var top *jsonContainer
+
+		if len(stack) > 0 {
+			top = stack[len(stack)-1]
+		}
+
+		switch c {
+		case '{':
+			stack = append(stack, &jsonContainer{expectKey: true})
+		case '[':
+			stack = append(stack, &jsonContainer{array: true})
+		case '}', ']':
+			stack = stack[:len(stack)-1]
+		case ',':
+			if top.array {
+				top.index++
+			} else {
+				top.expectKey = true
+			}
+		case ':':
+			top.expectKey = false
+		case '"':
+			end := i + 1
+
+			for content[end] != '"' {
+				if content[end] == '\\' {
+					end++
+				}
+
+				end++
+			}
+
+			literal := content[i : end+1]
+			i = end
+
+			if top != nil && !top.array && top.expectKey {
+				_ = json.Unmarshal(literal, &top.key)
+				out.Write(literal)
+				continue
+			}
+
+			var value string
+
+			_ = json.Unmarshal(literal, &value)
+
+			if newValue := rewrite(value, location()); newValue != value {
+				literal = encodeJSONString(newValue, bytes.Contains(literal, []byte(`\/`)))
+			}
+
+			out.Write(literal)
+			continue
+		}
+
+		out.WriteByte(c)
+	}
+
+	return out.Bytes(), true
+}
+
+// encodeJSONString encodes the string, the slashes are escaped if the original one escapes them.
+func encodeJSONString(s string, escapeSlash bool) []byte {
+	buf := &bytes.Buffer{}
+	encoder := json.NewEncoder(buf)
+	encoder.SetEscapeHTML(false)
+
+	_ = encoder.Encode(s)
+
+	literal := bytes.TrimRight(buf.Bytes(), "\n")
+
+	if escapeSlash {
+		literal = bytes.ReplaceAll(literal, []byte("/"), []byte(`\/`))
+	}
+
+	return literal
+}
+
+// modifyJSONContent maps the hosts and applies the JSONPath-scoped replacements in the string values of the JSON.
+func (p *ProxyServer) modifyJSONContent(body []byte, m hostMapping) ([]byte, bool) {
+	return rewriteJSON(body, func(value string, location []jsonPathElement) string {
+		value = p.replaceHosts(value, m)
+
+		for _, rule := range p.jsonReplaces {
+			if matchJSONPath(rule.path, location) {
+				value = strings.ReplaceAll(value, rule.Old, rule.New)
+			}
+		}
+
+		return value
+	})
+}
@@ -0,0 +1,149 @@
+package forward
+
+import (
+	"testing"
+)
+
+func Test_matchJSONPath(t *testing.T) {
+	location := []jsonPathElement{{key: "data", index: -1}, {index: 2}, {key: "user", index: -1}, {key: "avatar", index: -1}}
+
+	tests := []struct {
+		path    string
+		want    bool
+		wantErr bool
+	}{
+		{path: "$.data[2].user.avatar", want: true},
+		{path: "$.data[*].user.avatar", want: true},
+		{path: "$['data'][*]['user'].*", want: true},
+		{path: "$..avatar", want: true},
+		{path: "$..user.avatar", want: true},
+		{path: "$.data..avatar", want: true},
+		{path: "$.data[1].user.avatar", want: false},
+		{path: "$.data[*].user", want: false},
+		{path: "$..name", want: false},
+		{path: "data.user", wantErr: true},
+		{path: "$.data[x]", wantErr: true},
+		{path: "$.data[0", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			path, err := parseJSONPath(tt.path)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseJSONPath() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err != nil {
+				return
+			}
+			if got := matchJSONPath(path, location); got != tt.want {
+				t.Errorf("matchJSONPath() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProxyServer_modifyJSONContent(t *testing.T) {
+	m := hostMapping{originHosts: []string{"example.com"}, proxyHost: "localhost:8080"}
+
+	rule, err := ParseJSONReplaceRule("path=$.items[*].avatar,old=cdn.example.org,new=img.example.org")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &ProxyServer{
+		ProxyServerOptions: &ProxyServerOptions{ReplaceContent: []string{"secret=public"}},
+		jsonReplaces:       []JSONReplaceRule{rule},
+	}
+
+	tests := []struct {
+		name   string
+		body   string
+		want   string
+		wantOK bool
+	}{
+		{
+			name:   "escaped slashes",
+			body:   `{"url": "https:\/\/example.com\/a\/b", "n": 1.50}`,
+			want:   `{"url": "http:\/\/localhost:8080\/a\/b", "n": 1.50}`,
+			wantOK: true,
+		},
+		{
+			name:   "unicode escapes",
+			body:   "{\n  \"url\": \"https\\u003a//example.com/\\u4f60\"\n}",
+			want:   "{\n  \"url\": \"http://localhost:8080/你\"\n}",
+			wantOK: true,
+		},
+		{
+			name:   "keys and unchanged values are kept",
+			body:   `{"https://example.com":"A","a":[true,null,"secret"]}`,
+			want:   `{"https://example.com":"A","a":[true,null,"secret"]}`,
+			wantOK: true,
+		},
+		{
+			name:   "html is not escaped",
+			body:   `["<a href=\"https://example.com/\">&</a>"]`,
+			want:   `["<a href=\"http://localhost:8080/\">&</a>"]`,
+			wantOK: true,
+		},
+		{
+			name:   "json path",
+			body:   `{"items":[{"avatar":"https://cdn.example.org/1.png"}],"logo":"https://cdn.example.org/logo.png"}`,
+			want:   `{"items":[{"avatar":"https://img.example.org/1.png"}],"logo":"https://cdn.example.org/logo.png"}`,
+			wantOK: true,
+		},
+		{
+			name:   "invalid json",
+			body:   `{"url": "https://example.com"`,
+			want:   `{"url": "https://example.com"`,
+			wantOK: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := p.modifyJSONContent([]byte(tt.body), m)
+			if string(got) != tt.want || ok != tt.wantOK {
+				t.Errorf("modifyJSONContent() = %s, %v, want %s, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestProxyServer_modifyContentJSON(t *testing.T) {
+	m := hostMapping{originHosts: []string{"example.com"}, proxyHost: "localhost:8080"}
+
+	tests := []struct {
+		name    string
+		replace []string
+		body    string
+		want    string
+	}{
+		{
+			name:    "replacements match the raw content",
+			replace: []string{`"debug":true="debug":false`, `secret=public`},
+			body:    `{"debug":true,"secret":"https:\/\/example.com\/secret"}`,
+			want:    `{"debug":false,"public":"http:\/\/localhost:8080\/public"}`,
+		},
+		{
+			name:    "replacements matching escaped strings",
+			replace: []string{`\u4f60=\u597d`},
+			body:    `["\u4f60"]`,
+			want:    `["\u597d"]`,
+		},
+		{
+			name:    "invalid replacement is ignored",
+			replace: []string{"secret", "=public"},
+			body:    `["secret"]`,
+			want:    `["secret"]`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &ProxyServer{ProxyServerOptions: &ProxyServerOptions{ReplaceContent: tt.replace}, metrics: newMetrics(nil)}
+
+			if got := string(p.modifyContent(contentJSON, []byte(tt.body), m)); got != tt.want {
+				t.Errorf("modifyContent() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,414 @@
+package forward
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+	sourceOverwrite = "overwrite"
+	sourceUpstream  = "upstream"
+
+	// the label value of the routes, methods and upstreams which are not known
+	labelOther = "other"
+	// the max number of series per family, the new series beyond are counted as other
+	maxSeries = 1000
+)
+
+var (
+	latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+	rewriteBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1}
+
+	// the methods of RFC 9110 and PATCH, the others sent by clients are counted as other
+	standardMethods = []string{
+		http.MethodGet,
+		http.MethodHead,
+		http.MethodPost,
+		http.MethodPut,
+		http.MethodPatch,
+		http.MethodDelete,
+		http.MethodConnect,
+		http.MethodOptions,
+		http.MethodTrace,
+	}
+)
+
+// metric is a family of series in the Prometheus text exposition format.
+type metric interface {
+	write(w io.Writer)
+}
+
+// labelKey joins the label values as the key of a series.
+func labelKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+// otherKey is the key of the series counting the new label values beyond maxSeries.
+func otherKey(values []string) string {
+	others := make([]string, len(values))
+
+	for i := range others {
+		others[i] = labelOther
+	}
+
+	return labelKey(others)
+}
+
+func formatLabels(names []string, key string, extra ...string) string {
+	pairs := []string{}
+
+	if len(names) > 0 {
+		for i, v := range strings.Split(key, "\xff") {
+			pairs = append(pairs, fmt.Sprintf(`%s="%s"`, names[i], escapeLabelValue(v)))
+		}
+	}
+
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extra[i], escapeLabelValue(extra[i+1])))
+	}
+
+	if len(pairs) == 0 {
+		return ""
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapeLabelValue(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+	mux    sync.Mutex
+	values map[string]float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: map[string]float64{}}
+}
+
+func (c *counterVec) add(v float64, labelValues ...string) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	key := labelKey(labelValues)
+
+	if _, ok := c.values[key]; !ok && len(c.values) >= maxSeries {
+		key = otherKey(labelValues)
+	}
+
+	c.values[key] += v
+}
+
+func (c *counterVec) inc(labelValues ...string) {
+	c.add(1, labelValues...)
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+
+	keys := make([]string, 0, len(c.values))
+
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, k), formatFloat(c.values[k]))
+	}
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	mux     sync.Mutex
+	values  map[string]*histogram
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, values: map[string]*histogram{}}
+}
+
+func (h *histogramVec) observe(v float64, labelValues ...string) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	key := labelKey(labelValues)
+
+	if _, ok := h.values[key]; !ok && len(h.values) >= maxSeries {
+		key = otherKey(labelValues)
+	}
+
+	s, ok := h.values[key]
+
+	if !ok {
+		s = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = s
+	}
+
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		s.counts[i]++
+	}
+
+	s.count++
+	s.sum += v
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+
+	keys := make([]string, 0, len(h.values))
+
+	for k := range h.values {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		s := h.values[k]
+
+		var cumulative uint64
+
+		for i, le := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, k, "le", formatFloat(le)), cumulative)
+		}
+
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, k, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, k), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, k), s.count)
+	}
+}
+
+// metrics collects the metrics of the proxy server, exposed on the admin listener.
+type metrics struct {
+	requests        *counterVec
+	receivedBytes   *counterVec
+	sentBytes       *counterVec
+	served          *counterVec
+	upstreamLatency *histogramVec
+	upstreamErrors  *counterVec
+	rewriteDuration *histogramVec
+	rewriteBytes    *counterVec
+	routes          []string // the path prefixes labelled as routes
+}
+
+func newMetrics(routes []string) *metrics {
+	return &metrics{
+		routes:          routes,
+		requests:        newCounterVec("forward_requests_total", "The number of client requests.", "method", "status", "route"),
+		receivedBytes:   newCounterVec("forward_received_bytes_total", "The bytes of request bodies received from clients.", "route"),
+		sentBytes:       newCounterVec("forward_sent_bytes_total", "The bytes of response bodies sent to clients.", "route"),
+		served:          newCounterVec("forward_served_total", "The number of requests served from the overwrite folder or the upstream.", "source"),
+		upstreamLatency: newHistogramVec("forward_upstream_latency_seconds", "The time until the response headers of the upstream.", latencyBuckets, "upstream"),
+		upstreamErrors:  newCounterVec("forward_upstream_errors_total", "The number of failed upstream requests.", "type"),
+		rewriteDuration: newHistogramVec("forward_rewrite_duration_seconds", "The time spent rewriting response content.", rewriteBuckets),
+		rewriteBytes:    newCounterVec("forward_rewrite_bytes_total", "The bytes of response content before and after rewriting.", "stage"),
+	}
+}
+
+func (m *metrics) write(w io.Writer) {
+	for _, family := range []metric{
+		m.requests,
+		m.receivedBytes,
+		m.sentBytes,
+		m.served,
+		m.upstreamLatency,
+		m.upstreamErrors,
+		m.rewriteDuration,
+		m.rewriteBytes,
+	} {
+		family.write(w)
+	}
+}
+
+// observeRewrite records the duration and the size delta of a content rewrite.
+func (m *metrics) observeRewrite(start time.Time, before, after int) {
+	m.rewriteDuration.observe(time.Since(start).Seconds())
+	m.rewriteBytes.add(float64(before), "before")
+	m.rewriteBytes.add(float64(after), "after")
+}
+
+// routeLabel returns the longest route prefixing the path, or other. The path comes from the client,
+// so only the configured routes are labelled, which keeps the cardinality of the route label low.
+func routeLabel(routes []string, path string) string {
+	label := labelOther
+
+	for _, route := range routes {
+		matched := path == route || strings.HasPrefix(path, strings.TrimSuffix(route, "/")+"/")
+
+		if matched && (label == labelOther || len(route) > len(label)) {
+			label = route
+		}
+	}
+
+	return label
+}
+
+// methodLabel returns the standard method, or other.
+func methodLabel(method string) string {
+	if contains(standardMethods, method) {
+		return method
+	}
+
+	return labelOther
+}
+
+// metricsResponseWriter records the status and the bytes of the response.
+type metricsResponseWriter struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (w *metricsResponseWriter) WriteHeader(statusCode int) {
+	if w.status == 0 {
+		w.status = statusCode
+	}
+
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *metricsResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	n, err := w.ResponseWriter.Write(b)
+	w.written += int64(n)
+
+	return n, err
+}
+
+func (w *metricsResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *metricsResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+
+	if w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+
+	return hijacker.Hijack()
+}
+
+func (w *metricsResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// countingReader counts the bytes read from the request body.
+type countingReader struct {
+	io.ReadCloser
+	read int64
+}
+
+func (r *countingReader) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	r.read += int64(n)
+
+	return n, err
+}
+
+// instrument wraps the response writer and request body of the client,
+// the returned function records the request once it is served.
+func (m *metrics) instrument(w http.ResponseWriter, r *http.Request) (*metricsResponseWriter, *http.Request, func()) {
+	mw := &metricsResponseWriter{ResponseWriter: w}
+
+	var body *countingReader
+
+	if r.Body != nil && r.Body != http.NoBody {
+		body = &countingReader{ReadCloser: r.Body}
+		r.Body = body
+	}
+
+	method := methodLabel(r.Method)
+	route := routeLabel(m.routes, r.URL.Path)
+
+	return mw, r, func() {
+		status := mw.status
+
+		if status == 0 {
+			// aborted without a response
+			status = 499
+		}
+
+		m.requests.inc(method, strconv.Itoa(status), route)
+		m.sentBytes.add(float64(mw.written), route)
+
+		if body != nil {
+			m.receivedBytes.add(float64(body.read), route)
+		}
+	}
+}
+
+// metricsTransport records the latency of the upstreams.
+type metricsTransport struct {
+	http.RoundTripper
+	metrics *metrics
+	pool    *upstreamPool // the configured upstreams, the hosts of the forward proxy are labelled as other
+}
+
+func (t *metricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+
+	res, err := t.RoundTripper.RoundTrip(req)
+
+	upstream := labelOther
+
+	if t.pool.has(req.URL.Host) {
+		upstream = req.URL.Host
+	}
+
+	t.metrics.upstreamLatency.observe(time.Since(start).Seconds(), upstream)
+
+	return res, err
+}
+
+// metricsHandler exposes the metrics in the Prometheus text format.
+func (p *ProxyServer) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", metricsContentType)
+
+	p.metrics.write(w)
+}
@@ -0,0 +1,201 @@
+package forward
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_histogramVec_write(t *testing.T) {
+	h := newHistogramVec("test_seconds", "Test.", []float64{0.1, 1}, "upstream")
+
+	h.observe(0.05, `a"b`)
+	h.observe(0.5, `a"b`)
+	h.observe(5, `a"b`)
+
+	var b bytes.Buffer
+	h.write(&b)
+
+	want := `# HELP test_seconds Test.
+# TYPE test_seconds histogram
+test_seconds_bucket{upstream="a\"b",le="0.1"} 1
+test_seconds_bucket{upstream="a\"b",le="1"} 2
+test_seconds_bucket{upstream="a\"b",le="+Inf"} 3
+test_seconds_sum{upstream="a\"b"} 5.55
+test_seconds_count{upstream="a\"b"} 3
+`
+
+	if b.String() != want {
+		t.Errorf("write() = %s, want %s", b.String(), want)
+	}
+}
+
+func Test_routeLabel(t *testing.T) {
+	routes := []string{"/", "/api", "/static/"}
+
+	tests := []struct {
+		routes []string
+		path   string
+		want   string
+	}{
+		{routes: routes, path: "/", want: "/"},
+		{routes: routes, path: "/favicon.ico", want: "/"},
+		{routes: routes, path: "/api/users/1", want: "/api"},
+		{routes: routes, path: "/api", want: "/api"},
+		{routes: routes, path: "/apis", want: "/"},
+		{routes: routes, path: "/static/app.js", want: "/static/"},
+		{routes: nil, path: "/api/users/1", want: labelOther},
+		{routes: []string{"/api"}, path: "/random-1234", want: labelOther},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			if got := routeLabel(tt.routes, tt.path); got != tt.want {
+				t.Errorf("routeLabel() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_methodLabel(t *testing.T) {
+	tests := []struct {
+		method string
+		want   string
+	}{
+		{method: http.MethodGet, want: http.MethodGet},
+		{method: http.MethodPatch, want: http.MethodPatch},
+		{method: "PROPFIND", want: labelOther},
+		{method: "get", want: labelOther},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			if got := methodLabel(tt.method); got != tt.want {
+				t.Errorf("methodLabel() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_counterVec_maxSeries(t *testing.T) {
+	c := newCounterVec("test_total", "Test.", "route", "status")
+
+	for i := 0; i < maxSeries+10; i++ {
+		c.inc(fmt.Sprint(i), "200")
+	}
+
+	if len(c.values) != maxSeries+1 {
+		t.Errorf("series = %d, want %d", len(c.values), maxSeries+1)
+	}
+
+	if got := c.values[labelKey([]string{labelOther, labelOther})]; got != 10 {
+		t.Errorf("other = %v, want %v", got, 10)
+	}
+}
+
+func TestProxyServer_metrics(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write([]byte("hello"))
+	}))
+	defer upstream.Close()
+
+	dir := t.TempDir()
+
+	if err := os.MkdirAll(filepath.Join(dir, "static"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "static", "app.js"), []byte("local"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	target, _ := url.Parse(upstream.URL)
+
+	server := NewProxyServer(&ProxyServerOptions{
+		Target:          target,
+		OverwriteFolder: dir,
+		ReplaceContent:  []string{"hello=hi"},
+		MetricsRoutes:   []string{"/api", "/static"},
+	})
+	defer server.Close()
+
+	proxyServer := httptest.NewServer(http.HandlerFunc(server.Handler()))
+	defer proxyServer.Close()
+
+	for _, path := range []string{"/api/hello", "/static/app.js", "/random"} {
+		req, _ := http.NewRequest(http.MethodGet, proxyServer.URL+path, nil)
+
+		if path == "/random" {
+			req.Method = "PROPFIND"
+		}
+
+		res, err := http.DefaultClient.Do(req)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, _ = ioutil.ReadAll(res.Body)
+		res.Body.Close()
+	}
+
+	w := httptest.NewRecorder()
+	server.AdminHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	if w.Header().Get("Content-Type") != metricsContentType {
+		t.Errorf("Content-Type = %q, want %q", w.Header().Get("Content-Type"), metricsContentType)
+	}
+
+	for _, line := range []string{
+		`forward_requests_total{method="GET",status="200",route="/api"} 1`,
+		`forward_requests_total{method="GET",status="200",route="/static"} 1`,
+		`forward_requests_total{method="other",status="200",route="other"} 1`,
+		`forward_sent_bytes_total{route="/api"} 2`,
+		`forward_served_total{source="overwrite"} 1`,
+		`forward_served_total{source="upstream"} 2`,
+		`forward_upstream_latency_seconds_count{upstream="` + target.Host + `"} 2`,
+		`forward_rewrite_bytes_total{stage="after"} 4`,
+		`forward_rewrite_bytes_total{stage="before"} 10`,
+		`forward_rewrite_duration_seconds_count 2`,
+	} {
+		if !strings.Contains(w.Body.String(), line+"\n") {
+			t.Errorf("metrics do not contain %q:\n%s", line, w.Body.String())
+		}
+	}
+}
+
+func Test_metricsTransport(t *testing.T) {
+	target, _ := url.Parse("http://example.com")
+	m := newMetrics(nil)
+	transport := &metricsTransport{
+		RoundTripper: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+		}),
+		metrics: m,
+		pool:    newUpstreamPool(&ProxyServerOptions{Target: target}),
+	}
+
+	for _, u := range []string{"http://example.com/a", "http://127.0.0.1:22/", "http://random.example.org/"} {
+		if _, err := transport.RoundTrip(httptest.NewRequest(http.MethodGet, u, nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var b bytes.Buffer
+	m.upstreamLatency.write(&b)
+
+	for _, line := range []string{
+		`forward_upstream_latency_seconds_count{upstream="example.com"} 1`,
+		`forward_upstream_latency_seconds_count{upstream="other"} 2`,
+	} {
+		if !strings.Contains(b.String(), line+"\n") {
+			t.Errorf("metrics do not contain %q:\n%s", line, b.String())
+		}
+	}
+}
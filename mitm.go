@@ -0,0 +1,194 @@
+package forward
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// LoadOrCreateCA loads the CA used to decrypt MITM hosts.
+// A new CA is generated and saved to the files if they do not exist,
+// then it should be trusted by the clients.
+func LoadOrCreateCA(certFile, keyFile string) (*tls.Certificate, error) {
+	if _, err := os.Stat(certFile); err == nil {
+		ca, err := tls.LoadX509KeyPair(certFile, keyFile)
+
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		if ca.Leaf, err = x509.ParseCertificate(ca.Certificate[0]); err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		return &ca, nil
+	} else if !os.IsNotExist(err) {
+		return nil, errors.WithStack(err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          randomSerialNumber(),
+		Subject:               pkix.Name{CommonName: "Forward CLI MITM CA", Organization: []string{"forward-cli"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	for _, file := range []string{certFile, keyFile} {
+		if err := os.MkdirAll(filepath.Dir(file), 0o700); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
+
+func randomSerialNumber() *big.Int {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+
+	if err != nil {
+		return big.NewInt(time.Now().UnixNano())
+	}
+
+	return serial
+}
+
+// the max number of the cached certificates of MITM hosts
+const mitmCacheSize = 1024
+
+// mitmCertificates issues and caches the certificates of MITM hosts, signed by the CA.
+type mitmCertificates struct {
+	ca    *tls.Certificate
+	key   *ecdsa.PrivateKey // shared by all issued certificates
+	mux   sync.Mutex
+	certs map[string]*tls.Certificate
+	order []string // the host names in the order of issuing, the oldest is evicted first
+}
+
+func newMITMCertificates(ca *tls.Certificate) (*mitmCertificates, error) {
+	if ca.Leaf == nil {
+		leaf, err := x509.ParseCertificate(ca.Certificate[0])
+
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		ca.Leaf = leaf
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return &mitmCertificates{
+		ca:    ca,
+		key:   key,
+		certs: map[string]*tls.Certificate{},
+	}, nil
+}
+
+// certificate returns the certificate of the host name.
+func (m *mitmCertificates) certificate(hostname string) (*tls.Certificate, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	if cert, ok := m.certs[hostname]; ok && time.Now().Before(cert.Leaf.NotAfter) {
+		return cert, nil
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: randomSerialNumber(),
+		Subject:      pkix.Name{CommonName: hostname, Organization: []string{"forward-cli"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(0, 0, 390), // browsers reject certificates valid longer than 398 days
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	if ip := net.ParseIP(hostname); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{hostname}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, m.ca.Leaf, &m.key.PublicKey, m.ca.PrivateKey)
+
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	cert := &tls.Certificate{
+		Certificate: [][]byte{der, m.ca.Certificate[0]},
+		PrivateKey:  m.key,
+		Leaf:        leaf,
+	}
+
+	if _, ok := m.certs[hostname]; !ok {
+		m.order = append(m.order, hostname)
+	}
+
+	m.certs[hostname] = cert
+
+	for len(m.order) > mitmCacheSize {
+		delete(m.certs, m.order[0])
+		m.order = m.order[1:]
+	}
+
+	return cert, nil
+}
@@ -5,10 +5,12 @@ import (
 	"compress/gzip"
 	"compress/zlib"
 	"context"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"math"
 	"mime"
 	"net"
 	"net/http"
@@ -18,9 +20,12 @@ import (
 	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/andybalholm/brotli"
 	"github.com/pkg/errors"
+	"golang.org/x/text/encoding/htmlindex"
 )
 
 var (
@@ -31,123 +36,430 @@ const (
 	headerXProxyTarget = "X-Proxy-Target"
 	headerXOriginHost  = "X-Origin-Host"
 	headerXProxyClient = "X-Proxy-Client"
+
+	headerXForwardThrottle = "X-Forward-Throttle"
 )
 
 type ProxyServer struct {
 	*ProxyServerOptions
-	proxy *httputil.ReverseProxy
+	proxy     *httputil.ReverseProxy
+	grpcProxy *httputil.ReverseProxy
+	breakers  *circuitBreakers // the circuits of upstreams, nil if the circuit breaker is disabled
+	pool      *upstreamPool
+	transport *upstreamTransport
+	proxies   *proxySelector
+	mitm      *mitmCertificates
+	faults    *faultInjector
+	throttles []ThrottleRule
+
+	rateLimiters []*rateLimiter
+	headerRules  []HeaderRule
+	cors         *CorsPolicy
+	jsonReplaces []JSONReplaceRule
+	proxyURLs    proxyURLPatterns
+	metrics      *metrics
+	tracer       *tracer
+	closeOnce    sync.Once
 }
 
 type ProxyServerOptions struct {
-	Target               *url.URL    // proxy target
-	UseSSL               bool        // use SSL
-	ReqHeaders           http.Header // set request headers
-	ResHeaders           http.Header // set response headers
-	ProxyExternal        bool        // whether to proxy external host
-	ProxyExternalIgnores []string    // the host name that should ignore when enable proxy external
-	Cors                 bool        // whether enable cors
-	NoCache              bool        // disabled cache for response
-	OverwriteFolder      string      // overwrite request with paths
-	ReplaceContent       []string    // overwrite request with paths
+	Target                  *url.URL               // proxy target
+	UseSSL                  bool                   // use SSL
+	ReqHeaders              http.Header            // set request headers
+	ResHeaders              http.Header            // set response headers
+	ProxyExternal           bool                   // whether to proxy external host
+	ProxyExternalIgnores    []string               // the host name that should ignore when enable proxy external
+	Cors                    bool                   // whether enable cors, any origin is allowed if CorsPolicy is nil
+	NoCache                 bool                   // disabled cache for response
+	OverwriteFolder         string                 // overwrite request with paths
+	ReplaceContent          []string               // overwrite request with paths
+	GRPC                    bool                   // whether to proxy gRPC requests over HTTP/2 (h2c for http target)
+	GRPCWeb                 bool                   // whether to translate gRPC-Web requests to gRPC for the upstream
+	Upstreams               []*url.URL             // additional upstreams sharing the route with the target
+	Balance                 string                 // load balancing strategy: round-robin, least-conn, cookie or ip-hash
+	HealthCheckPath         string                 // the path requested to check the health of upstreams, disabled if empty
+	HealthCheckInterval     time.Duration          // the interval of active health checks
+	MaxFails                int                    // eject the upstream after the number of consecutive failures, disabled if 0
+	FailTimeout             time.Duration          // how long an ejected upstream is excluded from balancing
+	Retries                 int                    // the max number of retries for idempotent requests, disabled if 0
+	RetryStatuses           []int                  // the upstream status codes to retry on
+	RetryBackoff            time.Duration          // the initial delay between retries, doubled on each retry
+	RetryMaxBackoff         time.Duration          // the max delay between retries
+	RetryBodyLimit          int64                  // requests with a larger body are not retried
+	CircuitBreakerThreshold int                    // open the circuit of an upstream after the number of consecutive failures, disabled if 0
+	CircuitBreakerTimeout   time.Duration          // how long the circuit stays open before a trial request
+	DialTimeout             time.Duration          // the timeout of connecting upstreams
+	TLSHandshakeTimeout     time.Duration          // the timeout of TLS handshake with upstreams
+	ResponseHeaderTimeout   time.Duration          // the timeout of waiting for the response headers of upstreams
+	RequestTimeout          time.Duration          // the overall deadline of a proxied request, disabled if 0
+	MaxIdleConns            int                    // the max number of idle upstream connections
+	MaxIdleConnsPerHost     int                    // the max number of idle connections per upstream
+	MaxConnsPerHost         int                    // the max number of connections per upstream, unlimited if 0
+	IdleConnTimeout         time.Duration          // how long an idle upstream connection is kept
+	KeepAlive               time.Duration          // the interval of TCP keep-alive probes, negative to disable
+	DisableKeepAlives       bool                   // do not reuse upstream connections
+	ServerReadTimeout       time.Duration          // the timeout of reading the entire client request
+	ServerReadHeaderTimeout time.Duration          // the timeout of reading the client request headers
+	ServerWriteTimeout      time.Duration          // the timeout of writing the response to client
+	ServerIdleTimeout       time.Duration          // how long an idle client connection is kept
+	UpstreamTLSConfig       *tls.Config            // the TLS config for upstreams
+	UpstreamTLSConfigs      map[string]*tls.Config // the TLS config per upstream host, overrides UpstreamTLSConfig
+	UpstreamProxy           *url.URL               // the outbound proxy (http, https or socks5) for upstreams, use proxy environment variables if nil
+	UpstreamProxies         map[string]*url.URL    // the outbound proxy per host pattern, nil value means direct connection
+	NoProxy                 []string               // the host patterns connected directly without the outbound proxy
+	ForwardProxy            bool                   // whether to serve as a forward HTTP proxy, the target is optional
+	ForwardProxyClients     []*net.IPNet           // the clients allowed to use the forward proxy, any client if empty
+	ForwardProxyHosts       []string               // the host patterns reachable through the forward proxy, any host if empty
+	MITMHosts               []string               // the host patterns decrypted for CONNECT requests, requires MITMCA
+	MITMCA                  *tls.Certificate       // the CA issuing certificates for MITM hosts
+	Faults                  []FaultRule            // the faults injected into matched requests, could be toggled on the admin listener
+	MetricsRoutes           []string               // the path prefixes labelled as routes in metrics, the other paths are labelled as other
+	Throttles               []ThrottleRule         // the network profiles simulated for matched requests, the first match wins
+	ThrottleHeader          bool                   // whether the request header X-Forward-Throttle selects the network profile
+	RateLimits              []RateLimitRule        // the rate limits of matched requests, all of them are checked
+	UpstreamConcurrency     int64                  // the max number of in-flight requests per upstream, unlimited if 0
+	TraceEndpoint           string                 // the OTLP/HTTP endpoint receiving the spans, eg. http://127.0.0.1:4318
+	TraceFile               string                 // the file receiving the spans as OTLP JSON lines, used if TraceEndpoint is empty
+	TraceServiceName        string                 // the service name of the spans, defaults to forward-cli
+	RewriteRequestBody      bool                   // whether to map the proxy host back to the target in JSON, form and multipart request bodies
+	ReplaceRequestContent   []string               // the contents to be replaced in JSON, form and multipart request bodies, eg. "a=b"
+	RequestBodyLimit        int64                  // request bodies larger than the limit are not rewritten, defaults to 10MB
+	ReverseMapHeaders       []string               // the request headers mapped from the proxy host back to the upstream, besides Referer and Origin
+	TrustedProxies          []*net.IPNet           // the peers whose Forwarded, X-Forwarded-* and PROXY protocol headers are trusted
+	ProxyProtocol           bool                   // whether the listener accepts the PROXY protocol v1/v2 header from the trusted proxies
+	StripForwardedHeaders   bool                   // whether to send neither Forwarded, X-Forwarded-* nor X-Real-IP to the upstream
+	HeaderRules             []HeaderRule           // the rules rewriting the request and response headers, applied in order after ReqHeaders and ResHeaders
+	CorsPolicy              *CorsPolicy            // the CORS policy answering the preflight requests locally
+	SecurityHeaders         map[string]string      // the actions of the security headers: keep, strip, rewrite or report, CSP and Expect-CT are stripped by default
+	PermanentRedirect       string                 // keep or downgrade the permanent redirects 301 and 308, defaults to downgrade
+	FollowRedirects         []string               // the host patterns between which the redirects are followed by the proxy, the final response is returned
+	MaxRedirects            int                    // the max hops of the followed redirects, defaults to 10
+	RewriteResponseHeaders  []string               // the response headers whose URLs are mapped to the proxy host, besides Link, Refresh, Content-Location and so on
+	JSONReplaceRules        []JSONReplaceRule      // the replacements of the string values matched by JSONPath in JSON responses
+	RewriteContentTypes     []string               // the additional media types rewritten as text, eg. text/markdown or application/vnd.*
+	NoRewriteContentTypes   []string               // the media types never rewritten, eg. image/svg+xml or text/*
+	DefaultCharset          string                 // the charset of the content declaring none, eg. gbk, shift_jis or iso-8859-1
+	ServeUTF8               bool                   // whether to serve the transcoded content as UTF-8 instead of the original charset
+	FlushInterval           time.Duration          // the interval of flushing the response to client, negative to flush immediately, event streams are always flushed immediately
+	BufferStreams           bool                   // whether to buffer the entire responses without Content-Length to rewrite, by default they are rewritten line by line, or buffered up to 8MB for JSON
 }
 
 func NewProxyServer(options *ProxyServerOptions) *ProxyServer {
-	proxy := httputil.NewSingleHostReverseProxy(options.Target)
+	// the target is optional for forward proxy
+	proxy := &httputil.ReverseProxy{Director: func(*http.Request) {}}
+
+	if options.Target != nil {
+		proxy = httputil.NewSingleHostReverseProxy(options.Target)
+	}
+
+	proxy.FlushInterval = options.FlushInterval
 
 	server := &ProxyServer{
-		options,
-		proxy,
+		ProxyServerOptions: options,
+		proxy:              proxy,
+		pool:               newUpstreamPool(options),
+		transport:          newUpstreamTransport(options),
+		proxies:            newProxySelector(options),
+		faults:             newFaultInjector(options.Faults),
+		throttles:          newThrottleRules(options.Throttles),
+		rateLimiters:       newRateLimiters(options.RateLimits),
+		headerRules:        newHeaderRules(options.HeaderRules),
+		cors:               newCorsPolicy(options),
+		jsonReplaces:       newJSONReplaceRules(options.JSONReplaceRules),
+		metrics:            newMetrics(options.MetricsRoutes),
+		tracer:             newTracer(options),
 	}
 
 	originalDirector := proxy.Director
 	proxy.Director = func(req *http.Request) {
-		originalDirector(req)
+		if forwardTargetFromContext(req.Context()) == nil {
+			originalDirector(req)
+		}
 		server.modifyRequest(req)
 	}
 
+	if options.ForwardProxy && len(options.ForwardProxyClients) == 0 {
+		log.Println("WARNING: the forward proxy is open to any client, which could reach the loopback and internal hosts of this machine, restrict it with --forward-proxy-client or --forward-proxy-host")
+	}
+
+	if options.MITMCA != nil && len(options.MITMHosts) > 0 {
+		if m, err := newMITMCertificates(options.MITMCA); err != nil {
+			log.Printf("WARN: MITM is disabled: %+v\n", err)
+		} else {
+			server.mitm = m
+		}
+	}
+
+	if options.DefaultCharset != "" {
+		if _, err := htmlindex.Get(options.DefaultCharset); err != nil {
+			log.Printf("WARN: ignore the default charset '%s': %s\n", options.DefaultCharset, err)
+		}
+	}
+
+	for _, paren := range options.ReplaceContent {
+		if _, _, ok := parseReplacement(paren); !ok {
+			log.Printf("WARN: ignore the replace content '%s', it should be like 'a=b'\n", paren)
+		}
+	}
+
+	if options.CircuitBreakerThreshold > 0 {
+		server.breakers = newCircuitBreakers(options.CircuitBreakerThreshold, options.CircuitBreakerTimeout)
+	}
+
+	if options.GRPC || options.GRPCWeb {
+		if options.Target != nil && options.Target.Scheme == "http" && !h2cSupported {
+			log.Println("WARN: h2c is not supported by this build, gRPC requests to the target use HTTP/1.1")
+		}
+
+		// the calls are never redirected, so the redirects are not followed
+		server.grpcProxy = server.newGRPCProxy(proxy.Director, server.wrapTransport(server.transport.clone(newGRPCTransport)))
+	}
+
+	proxy.Transport = server.wrapTransport(server.transport)
+
+	if len(options.FollowRedirects) > 0 {
+		proxy.Transport = newRedirectTransport(proxy.Transport, options)
+	}
+
+	if options.HealthCheckPath != "" {
+		go server.pool.healthCheck(server.transport, options.HealthCheckPath, options.HealthCheckInterval)
+	}
+
 	proxy.ModifyResponse = server.modifyResponse
 	proxy.ErrorHandler = func(rw http.ResponseWriter, r *http.Request, err error) {
+		server.metrics.upstreamErrors.inc(upstreamErrorType(err))
+
 		if errors.Is(err, context.Canceled) {
 			return
 		}
 		msg := fmt.Sprintf("%+v\n", err)
 		log.Println(msg)
-		rw.WriteHeader(http.StatusInternalServerError)
+
+		var circuitErr *errCircuitOpen
+		if errors.As(err, &circuitErr) {
+			// fail fast, the upstream has not been contacted
+			rw.Header().Set("Retry-After", fmt.Sprint(int(math.Ceil(circuitErr.retryAfter.Seconds()))))
+		} else if u := upstreamFromContext(r.Context()); u != nil {
+			server.pool.markFailure(u, err)
+		}
+
+		rw.WriteHeader(upstreamErrorStatus(err))
 		_, _ = rw.Write([]byte(msg))
 	}
 
 	return server
 }
 
+// wrapTransport wraps the transport of upstreams with the metrics, tracing, throttling, retries and circuit breakers.
+func (p *ProxyServer) wrapTransport(transport http.RoundTripper) http.RoundTripper {
+	transport = &metricsTransport{RoundTripper: transport, metrics: p.metrics, pool: p.pool}
+
+	if p.tracer != nil {
+		transport = &tracingTransport{RoundTripper: transport, tracer: p.tracer}
+	}
+
+	if len(p.throttles) > 0 || p.ThrottleHeader {
+		transport = &throttleTransport{RoundTripper: transport}
+	}
+
+	if p.Retries > 0 || p.CircuitBreakerThreshold > 0 {
+		retry := newRetryTransport(transport, p.ProxyServerOptions)
+		// the HTTP and gRPC requests of an upstream share the circuit
+		retry.breakers = p.breakers
+		transport = retry
+	}
+
+	return transport
+}
+
+// AdminHandler returns the handler of the admin listener.
+func (p *ProxyServer) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/upstreams", p.upstreamHandler)
+	mux.HandleFunc("/faults", p.faultHandler)
+	mux.HandleFunc("/metrics", p.metricsHandler)
+
+	return mux
+}
+
+// Close stops the background jobs of the proxy server.
+func (p *ProxyServer) Close() {
+	p.closeOnce.Do(func() {
+		close(p.pool.stop)
+		p.tracer.close()
+	})
+}
+
 func (p *ProxyServer) Handler() func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if p.OverwriteFolder != "" && r.Method == http.MethodGet {
-			paths := []string{p.OverwriteFolder}
-			paths = append(paths, strings.Split(strings.TrimLeft(r.URL.Path, "/"), "/")...)
+		r = p.withClientIP(r)
 
-			proxyFilePath := filepath.Join(paths...)
+		if len(p.headerRules) > 0 {
+			r = withRequestID(r)
+		}
 
-			fInfo, err := os.Stat(proxyFilePath)
+		mw, r, done := p.metrics.instrument(w, r)
+		r, span := p.tracer.startServerSpan(r)
+		w = mw
 
-			// proxy request if file is not exist
-			if os.IsNotExist(err) {
-				p.proxy.ServeHTTP(w, r)
+		defer func() {
+			span.setAttribute("http.status_code", mw.status)
+			if mw.status >= http.StatusInternalServerError {
+				span.setError(fmt.Errorf("responded with status %d", mw.status))
+			}
+			span.finish()
+			done()
+		}()
+
+		if p.ForwardProxy {
+			if r.Method == http.MethodConnect {
+				if p.allowForward(w, r, r.Host) {
+					p.serveConnect(w, r)
+				}
 				return
 			}
 
-			if err != nil {
-				if strings.Contains(err.Error(), "file name too long") {
-					p.proxy.ServeHTTP(w, r)
-					return
-				} else {
-					w.WriteHeader(http.StatusInternalServerError)
-					w.Write([]byte(fmt.Sprintf("%+v\n", errors.WithStack(err))))
+			// absolute-form request, eg. GET http://example.com/ HTTP/1.1
+			if r.URL.IsAbs() {
+				if !p.allowForward(w, r, r.URL.Host) {
 					return
 				}
-			}
 
-			if fInfo.IsDir() {
-				p.proxy.ServeHTTP(w, r)
-				return
+				r = withForwardTarget(r)
 			}
+		}
 
-			f, err := os.Open(proxyFilePath)
+		if p.Target == nil && forwardTargetFromContext(r.Context()) == nil {
+			http.Error(w, "forward is running as a forward proxy, configure it as the HTTP proxy of your client", http.StatusBadRequest)
+			return
+		}
 
-			// proxy request if file is not exist
-			if os.IsNotExist(err) {
-				p.proxy.ServeHTTP(w, r)
-				return
+		if !p.serveCors(w, r) {
+			return
+		}
+
+		if !p.serveCSPReport(w, r) {
+			return
+		}
+
+		if !p.rateLimit(w, r) {
+			return
+		}
+
+		w, r, err := p.throttleRequest(w, r)
+
+		if err != nil {
+			if !errors.Is(err, context.Canceled) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
 			}
+			return
+		}
 
-			if err != nil {
+		p.faults.serve(w, r, p.serveRoute)
+	}
+}
+
+// serveRoute serves the request from the overwrite folder, or proxies it to the upstream.
+func (p *ProxyServer) serveRoute(w http.ResponseWriter, r *http.Request) {
+	if p.OverwriteFolder != "" && r.Method == http.MethodGet {
+		paths := []string{p.OverwriteFolder}
+		paths = append(paths, strings.Split(strings.TrimLeft(r.URL.Path, "/"), "/")...)
+
+		proxyFilePath := filepath.Join(paths...)
+
+		fInfo, err := os.Stat(proxyFilePath)
+
+		// proxy request if file is not exist
+		if os.IsNotExist(err) {
+			p.serveProxy(w, r)
+			return
+		}
+
+		if err != nil {
+			if strings.Contains(err.Error(), "file name too long") {
+				p.serveProxy(w, r)
+				return
+			} else {
 				w.WriteHeader(http.StatusInternalServerError)
 				w.Write([]byte(fmt.Sprintf("%+v\n", errors.WithStack(err))))
 				return
 			}
+		}
 
-			defer f.Close()
+		if fInfo.IsDir() {
+			p.serveProxy(w, r)
+			return
+		}
 
-			MIMEType := mime.TypeByExtension(filepath.Ext(proxyFilePath))
+		f, err := os.Open(proxyFilePath)
 
-			w.Header().Set("Content-Type", MIMEType)
-			w.WriteHeader(http.StatusOK)
+		// proxy request if file is not exist
+		if os.IsNotExist(err) {
+			p.serveProxy(w, r)
+			return
+		}
 
-			_, _ = io.Copy(w, f)
-		} else {
-			p.proxy.ServeHTTP(w, r)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(fmt.Sprintf("%+v\n", errors.WithStack(err))))
+			return
 		}
+
+		defer f.Close()
+
+		p.metrics.served.inc(sourceOverwrite)
+
+		MIMEType := mime.TypeByExtension(filepath.Ext(proxyFilePath))
+
+		w.Header().Set("Content-Type", MIMEType)
+		w.WriteHeader(http.StatusOK)
+
+		_, _ = io.Copy(w, f)
+	} else {
+		p.serveProxy(w, r)
+	}
+}
+
+// upstreamTarget returns the host requested by a forward proxy client,
+// or the upstream picked for the request, or the target.
+func (p *ProxyServer) upstreamTarget(req *http.Request) url.URL {
+	if u := forwardTargetFromContext(req.Context()); u != nil {
+		return *u
+	}
+
+	if u := upstreamFromContext(req.Context()); u != nil {
+		return *u.URL
 	}
+
+	if p.Target == nil {
+		return url.URL{}
+	}
+
+	return *p.Target
+}
+
+// originHosts returns the hosts to be replaced by the proxy host.
+// All members of the upstream pool are treated as the origin host.
+func (p *ProxyServer) originHosts(target url.URL) []string {
+	if p.pool.has(target.Host) {
+		return p.pool.hosts
+	}
+
+	return []string{target.Host}
 }
 
 func (p *ProxyServer) modifyRequest(req *http.Request) {
-	target := *p.Target
+	target := p.upstreamTarget(req)
+	site := target // the upstream serving the pages of the proxy host
+	useSSL := p.isSecure(req)
 	isProxyUrl := req.URL.Query().Get("forward_url") != ""
 
 	if isProxyUrl {
 		if unescapeUrl, err := url.QueryUnescape(strings.TrimLeft(req.URL.RawQuery, "forward_url=")); err == nil {
 			if u, err := url.Parse(unescapeUrl); err == nil {
 				if u.Scheme == "" {
-					if p.UseSSL {
+					if useSSL {
 						u.Scheme = "https"
 					} else {
 						u.Scheme = "http"
@@ -161,7 +473,7 @@ func (p *ProxyServer) modifyRequest(req *http.Request) {
 
 		if u, err := url.Parse(targetUrl); err == nil {
 			if u.Scheme == "" {
-				if p.UseSSL {
+				if useSSL {
 					u.Scheme = "https"
 				} else {
 					u.Scheme = "http"
@@ -171,6 +483,8 @@ func (p *ProxyServer) modifyRequest(req *http.Request) {
 		}
 	}
 
+	proxyHost := req.Host
+
 	req.Header.Set(headerXOriginHost, req.Host)
 	req.Host = target.Host
 	if isProxyUrl {
@@ -183,12 +497,31 @@ func (p *ProxyServer) modifyRequest(req *http.Request) {
 	log.Printf("[%s]: %s", req.Method, req.URL.String())
 
 	req.Header.Set("Host", target.Host)
-	req.Header.Set("Origin", fmt.Sprintf("%s://%s", target.Scheme, target.Host))
-	req.Header.Set("Referrer", fmt.Sprintf("%s://%s%s", target.Scheme, target.Host, req.URL.RawPath))
-	req.Header.Set("X-Real-IP", req.RemoteAddr)
 
-	for k := range p.ReqHeaders {
-		req.Header.Add(k, p.ReqHeaders.Get(k))
+	if !skipHostMapping(req) {
+		p.modifyRequestHeaders(req, proxyHost, site)
+	}
+
+	p.setForwardedHeaders(req, proxyHost)
+
+	for k, values := range p.ReqHeaders {
+		req.Header[k] = append([]string{}, values...)
+	}
+
+	p.applyHeaderRules(HeaderSideRequest, req, req.Header, 0)
+
+	m := requestBodyMapping{targetHost: target.Host, useSSL: target.Scheme == "https", replaces: p.ReplaceRequestContent}
+
+	// the hosts of forward_url and forward proxy requests are not mapped from the proxy
+	if p.RewriteRequestBody && !isProxyUrl && !skipHostMapping(req) {
+		m.proxyURL = p.proxyURLs.get(proxyHost)
+	}
+
+	// nothing could be changed, the body is sent as it is
+	if m.proxyURL != nil || len(m.replaces) > 0 {
+		if err := p.modifyRequestBody(req, m); err != nil {
+			log.Printf("WARN: rewrite request body: %+v\n", err)
+		}
 	}
 }
 
@@ -207,36 +540,91 @@ func WriteFile(filename string, data []byte, perm os.FileMode) error {
 	return err
 }
 
-func (p *ProxyServer) modifyContent(extNames []string, body []byte, originHost string, proxyHost string) []byte {
-	bodyStr := string(body)
+// hostMapping describes how the hosts of upstream are mapped to the proxy host.
+type hostMapping struct {
+	originHosts []string // the hosts of upstream, replaced by the proxy host
+	proxyHost   string   // the host of proxy server, eg. localhost:8080
+	useSSL      bool     // whether the client connects the proxy server with TLS
+	forwarded   bool     // the hosts are kept as they are, see skipHostMapping
+}
+
+func (p *ProxyServer) replaceHosts(content string, m hostMapping) string {
+	return replaceHosts(content, m.originHosts, m.proxyHost, m.useSSL, p.ProxyExternal && !m.forwarded, p.ProxyExternalIgnores)
+}
+
+// isSecure reports whether the client connects the proxy server with TLS.
+func (p *ProxyServer) isSecure(req *http.Request) bool {
+	return p.UseSSL || req.TLS != nil
+}
+
+// parseReplacement parses the replacement like "a=b", the old string is required.
+func parseReplacement(value string) (string, string, bool) {
+	arr := strings.SplitN(value, "=", 2)
+
+	if len(arr) < 2 || arr[0] == "" {
+		return "", "", false
+	}
+
+	return arr[0], arr[1], true
+}
 
+// replaceContent applies the replacements of ReplaceContent, the invalid ones are ignored.
+func (p *ProxyServer) replaceContent(content string) string {
 	for _, paren := range p.ReplaceContent {
-		arr := strings.Split(paren, "=")
+		if from, to, ok := parseReplacement(paren); ok {
+			content = strings.ReplaceAll(content, from, to)
+		}
+	}
+
+	return content
+}
 
-		bodyStr = strings.ReplaceAll(bodyStr, arr[0], arr[1])
+func (p *ProxyServer) modifyContent(kind string, body []byte, m hostMapping) []byte {
+	start := time.Now()
+	bodyStr := string(body)
+	defer func() {
+		p.metrics.observeRewrite(start, len(body), len(bodyStr))
+	}()
+
+	// the replacements match the raw content, as they are written by users
+	bodyStr = p.replaceContent(bodyStr)
+
+	// the string values are decoded, so that the escaped URLs are mapped and the structure is kept
+	if kind == contentJSON || kind == contentManifest {
+		if newBody, ok := p.modifyJSONContent([]byte(bodyStr), m); ok {
+			bodyStr = string(newBody)
+			return newBody
+		}
 	}
 
-	bodyStr = replaceHost(bodyStr, originHost, proxyHost, p.UseSSL, p.ProxyExternal, p.ProxyExternalIgnores)
+	bodyStr = p.replaceHosts(bodyStr, m)
 
 	// https://developer.mozilla.org/zh-CN/docs/Web/Security/Subresource_Integrity
-	if isHtml(extNames) {
+	if kind == contentHTML {
 		bodyStr = regIntegrity.ReplaceAllString(bodyStr, "")
 
 		// <meta http-equiv="Content-Security-Policy" content="default-src 'self'; img-src https://*; child-src 'none';">
-		bodyStr = strings.ReplaceAll(bodyStr, `http-equiv="Content-Security-Policy"`, "") // disabled CSP
+		// the policy of meta could not be report-only
+		switch p.securityHeaderAction(headerCSP, m.useSSL) {
+		case SecurityHeaderStrip, SecurityHeaderReport:
+			bodyStr = strings.ReplaceAll(bodyStr, `http-equiv="Content-Security-Policy"`, "") // disabled CSP
+		case SecurityHeaderRewrite:
+			bodyStr = p.rewriteMetaCSP(bodyStr, m)
+		}
 	}
 
 	return []byte(bodyStr)
 }
 
 func (p *ProxyServer) modifyResponse(res *http.Response) error {
-	target := *p.Target
+	target := p.upstreamTarget(res.Request)
+	useSSL := p.isSecure(res.Request)
 	isProxyUrl := res.Request.URL.Query().Get("forward_url") != ""
 
 	if isProxyUrl {
 		if unescapeUrl, err := url.QueryUnescape(strings.TrimLeft(res.Request.URL.RawQuery, "forward_url=")); err == nil {
 			if u, err := url.Parse(unescapeUrl); err == nil {
-				if p.UseSSL {
+				if useSSL {
 					u.Scheme = "https"
 				} else {
 					u.Scheme = "http"
@@ -247,6 +635,12 @@ func (p *ProxyServer) modifyResponse(res *http.Response) error {
 	}
 
 	proxyHost := res.Request.Header.Get(headerXOriginHost) // localhost:8080 or localhost
+	mapping := hostMapping{
+		originHosts: p.originHosts(target),
+		proxyHost:   proxyHost,
+		useSSL:      useSSL,
+		forwarded:   skipHostMapping(res.Request),
+	}
 
 	var hostName string
 
@@ -262,8 +656,11 @@ func (p *ProxyServer) modifyResponse(res *http.Response) error {
 		hostName = proxyHost
 	}
 
+	if u := upstreamFromContext(res.Request.Context()); u != nil {
+		p.pool.markSuccess(u)
+	}
+
 	res.Header.Set(headerXProxyClient, "Forward-Cli")
-	res.Header.Del("Expect-CT")
 
 	// disable cache
 	{
@@ -272,25 +669,8 @@ func (p *ProxyServer) modifyResponse(res *http.Response) error {
 		}
 	}
 
-	// disabled CSP
-	{
-		// https://developer.mozilla.org/zh-CN/docs/Web/HTTP/CSP
-		res.Header.Del("Content-Security-Policy")
-	}
-
-	// disabled Strict-Transport-Security
-	if !p.UseSSL {
-		// https: //developer.mozilla.org/zh-CN/docs/Web/HTTP/Headers/Strict-Transport-Security
-		res.Header.Del("Strict-Transport-Security")
-	}
-
-	// overwrite status code
-	{
-		// 301 -> 302
-		if res.StatusCode == http.StatusMovedPermanently {
-			res.StatusCode = http.StatusFound
-		}
-	}
+	// https://developer.mozilla.org/zh-CN/docs/Web/HTTP/CSP
+	p.modifySecurityHeaders(res.Header, mapping)
 
 	// overwrite cookies
 	{
@@ -298,177 +678,205 @@ func (p *ProxyServer) modifyResponse(res *http.Response) error {
 		res.Header.Del("Set-Cookie")
 
 		for _, v := range cookies {
-			v.Domain = hostName
-			if v.Secure && !p.UseSSL {
+			if !mapping.forwarded {
+				v.Domain = hostName
+			}
+			if v.Secure && !useSSL {
 				v.Secure = false
 			}
 
 			res.Header.Add("Set-Cookie", v.String())
 		}
-	}
 
-	// overrit 302 Location
-	{
-		// https://developer.mozilla.org/zh-CN/docs/Web/HTTP/Headers/Location
-		location := res.Header.Get("Location")
-		if location != "" {
-			// relative path
-			if !isHttpUrl(location) {
-				if isProxyUrl {
-					newLocation := target
-					newLocation.Path = location
-					res.Header.Set("Location", newLocation.String())
-				}
-			} else {
-				newLocation := replaceHost(location, target.Host, proxyHost, p.UseSSL, p.ProxyExternal, p.ProxyExternalIgnores)
-				res.Header.Set("Location", newLocation)
-			}
+		// pin the client to the upstream
+		if u := upstreamFromContext(res.Request.Context()); u != nil && !isProxyUrl {
+			p.setStickyCookie(res, u)
 		}
 	}
 
-	if p.Cors {
-		res.Header.Set("Access-Control-Allow-Origin", "*")
-		res.Header.Set("Access-Control-Allow-Credentials", "true")
+	// overwrite 302 Location
+	p.modifyRedirect(res, mapping)
+
+	// overwrite Link, Refresh, Content-Location...
+	p.modifyURLHeaders(res, mapping)
+
+	// the CORS headers have been set by the policy
+	if p.cors != nil {
+		removeCorsHeaders(res.Header)
 	}
 
-	for k := range p.ResHeaders {
-		res.Header.Add(k, p.ResHeaders.Get(k))
+	// replace the headers sent by the upstream, instead of duplicating them
+	for k, values := range p.ResHeaders {
+		res.Header[k] = append([]string{}, values...)
 	}
 
+	p.applyHeaderRules(HeaderSideResponse, res.Request, res.Header, res.StatusCode)
+
 	// replace HTML/css/javascript... content
 	{
 		contentType := res.Header.Get("Content-Type")
 
-		extNames, err := mime.ExtensionsByType(contentType)
+		// gRPC streams are never rewritten
+		if isGRPCContentType(contentType) {
+			return nil
+		}
 
-		if err != nil {
+		// HEAD, 204 and 304
+		if res.Body == http.NoBody {
 			return nil
 		}
 
-		if !isShouldReplaceContent(extNames) {
+		kind, sniff := p.contentKind(res)
+
+		// the response without Content-Length may be a stream, it is not buffered entirely unless configured
+		stream := kind == contentEventStream || (res.ContentLength < 0 && !p.BufferStreams)
+
+		if kind == "" && (!sniff || stream) {
 			return nil
 		}
 
 		encoding := res.Header.Get("Content-Encoding")
 
 		// https://developer.mozilla.org/zh-CN/docs/Web/HTTP/Headers/Content-Encoding
-		switch encoding {
-		case "gzip":
-			reader, err := gzip.NewReader(res.Body)
+		if encoding == "compress" {
+			// Deprecated by most browsers
+			return nil
+		}
 
-			if err != nil {
-				return errors.WithStack(err)
+		// the upstream does not tell the type
+		if sniff {
+			if kind = sniffContent(res, encoding); kind == "" {
+				return nil
 			}
+		}
 
-			defer reader.Close()
-
-			body, err := ioutil.ReadAll(reader)
+		// the content which could not be rewritten line by line is buffered up to the limit
+		if stream && kind != contentEventStream && !p.lineRewritable(kind) {
+			buffered, err := bufferContent(res, streamBufferLimit)
 
 			if err != nil {
-				return errors.WithStack(err)
+				return err
 			}
 
-			newBody := p.modifyContent(extNames, body, target.Host, proxyHost)
-
-			var b bytes.Buffer
-			gz := gzip.NewWriter(&b)
-
-			if _, err := gz.Write(newBody); err != nil {
-				return errors.WithStack(err)
+			if !buffered {
+				log.Printf("WARN: the %s response of '%s' without Content-Length is larger than %d bytes, it is not rewritten\n", kind, res.Request.URL.Path, streamBufferLimit)
+				return nil
 			}
 
-			if err := gz.Close(); err != nil {
-				return errors.WithStack(err)
-			}
+			stream = false
+		}
 
-			bin := b.Bytes()
-			res.Header.Set("Content-Length", fmt.Sprint(len(bin)))
-			res.Body = io.NopCloser(bytes.NewReader(bin))
+		// the stream is rewritten as the upstream sends it
+		if stream {
+			return p.streamContent(res, kind, encoding, mapping)
+		}
 
-		case "compress":
-			// Deprecated by most browsers
-		case "deflate":
-			reader, err := zlib.NewReader(res.Body)
+		ctx, rewriteSpan := p.tracer.startSpan(res.Request.Context(), "rewrite", spanKindInternal)
+		defer rewriteSpan.finish()
 
-			if err != nil {
-				return errors.WithStack(err)
-			}
+		rewriteSpan.setAttribute("http.response.content_encoding", encoding)
+		rewriteSpan.setAttribute("content.kind", kind)
 
-			body, err := ioutil.ReadAll(reader)
+		_, span := p.tracer.startSpan(ctx, "decompress", spanKindInternal)
+		body, err := decodeContent(encoding, res.Body)
+		span.setError(err)
+		span.finish()
 
-			defer reader.Close()
+		_ = res.Body.Close()
 
-			if err != nil {
-				return errors.WithStack(err)
-			}
+		if err != nil {
+			rewriteSpan.setError(err)
+			return err
+		}
 
-			newBody := p.modifyContent(extNames, body, target.Host, proxyHost)
+		_, span = p.tracer.startSpan(ctx, "modifyContent", spanKindInternal)
+		newBody := p.modifyCharsetContent(kind, body, res.Header, mapping)
+		span.setAttribute("content.size.before", len(body))
+		span.setAttribute("content.size.after", len(newBody))
+		span.finish()
 
-			buf := &bytes.Buffer{}
+		_, span = p.tracer.startSpan(ctx, "recompress", spanKindInternal)
+		bin, err := encodeContent(encoding, newBody)
+		span.setError(err)
+		span.finish()
 
-			w := zlib.NewWriter(buf)
+		if err != nil {
+			rewriteSpan.setError(err)
+			return err
+		}
 
-			if n, err := w.Write(newBody); err != nil {
-				return errors.WithStack(err)
-			} else if n < len(newBody) {
-				return fmt.Errorf("n too small: %d vs %d for %s", n, len(newBody), string(newBody))
-			}
+		res.Header.Set("Content-Length", fmt.Sprint(len(bin)))
+		res.Body = io.NopCloser(bytes.NewReader(bin))
+	}
 
-			if err := w.Close(); err != nil {
-				return errors.WithStack(err)
-			}
+	return nil
+}
 
-			res.Header.Set("Content-Length", fmt.Sprint(buf.Len()))
-			res.Body = io.NopCloser(buf)
-		case "br":
-			reader := brotli.NewReader(res.Body)
+// decodeContent reads the body decompressed with the content encoding.
+func decodeContent(encoding string, body io.Reader) ([]byte, error) {
+	switch encoding {
+	case "gzip":
+		reader, err := gzip.NewReader(body)
 
-			body, err := ioutil.ReadAll(reader)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
 
-			if err != nil {
-				return errors.WithStack(err)
-			}
+		defer reader.Close()
 
-			newBody := p.modifyContent(extNames, body, target.Host, proxyHost)
+		b, err := ioutil.ReadAll(reader)
 
-			buf := &bytes.Buffer{}
-			w := brotli.NewWriter(buf)
-			if n, err := w.Write(newBody); err != nil {
-				return errors.WithStack(err)
-			} else if n < len(newBody) {
-				return fmt.Errorf("n too small: %d vs %d for %s", n, len(newBody), string(newBody))
-			}
+		return b, errors.WithStack(err)
+	case "deflate":
+		reader, err := zlib.NewReader(body)
 
-			if err := w.Close(); err != nil {
-				return errors.WithStack(err)
-			}
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
 
-			res.Header.Set("Content-Length", fmt.Sprint(buf.Len()))
-			res.Body = io.NopCloser(buf)
-		case "identity":
-			fallthrough
-		default:
-			// origin response data without compress
+		defer reader.Close()
 
-			body, err := ioutil.ReadAll(res.Body)
+		b, err := ioutil.ReadAll(reader)
 
-			if err != nil {
-				return errors.WithStack(err)
-			}
+		return b, errors.WithStack(err)
+	case "br":
+		b, err := ioutil.ReadAll(brotli.NewReader(body))
 
-			defer res.Body.Close()
+		return b, errors.WithStack(err)
+	default:
+		// origin response data without compress
+		b, err := ioutil.ReadAll(body)
 
-			newBody := p.modifyContent(extNames, body, target.Host, proxyHost)
+		return b, errors.WithStack(err)
+	}
+}
 
-			if err != nil {
-				return errors.WithStack(err)
-			}
+// encodeContent compresses the body with the content encoding.
+func encodeContent(encoding string, body []byte) ([]byte, error) {
+	var w io.WriteCloser
+
+	buf := &bytes.Buffer{}
+
+	switch encoding {
+	case "gzip":
+		w = gzip.NewWriter(buf)
+	case "deflate":
+		w = zlib.NewWriter(buf)
+	case "br":
+		w = brotli.NewWriter(buf)
+	default:
+		return body, nil
+	}
 
-			res.Header.Set("Content-Length", fmt.Sprint(len(newBody)))
-			res.Body = io.NopCloser(bytes.NewReader(newBody))
-		}
+	if n, err := w.Write(body); err != nil {
+		return nil, errors.WithStack(err)
+	} else if n < len(body) {
+		return nil, fmt.Errorf("n too small: %d vs %d for %s", n, len(body), string(body))
+	}
 
+	if err := w.Close(); err != nil {
+		return nil, errors.WithStack(err)
 	}
 
-	return nil
+	return buf.Bytes(), nil
 }
@@ -0,0 +1,217 @@
+package forward
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const proxyProtocolTimeout = 5 * time.Second
+
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// Listen listens on the TCP address, the PROXY protocol header is parsed if enabled.
+func (p *ProxyServer) Listen(addr string) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	if !p.ProxyProtocol {
+		return ln, nil
+	}
+
+	// any peer could forge the client address otherwise
+	if len(p.TrustedProxies) == 0 {
+		_ = ln.Close()
+		return nil, errors.New("the PROXY protocol requires the trusted proxies sending the header")
+	}
+
+	return &proxyProtocolListener{Listener: ln, server: p}, nil
+}
+
+// proxyProtocolListener accepts connections starting with the PROXY protocol header,
+// which tells the address of the client connecting the load balancer in front of the proxy.
+type proxyProtocolListener struct {
+	net.Listener
+	server *ProxyServer
+}
+
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+
+	if err != nil {
+		return nil, err
+	}
+
+	// only the trusted proxies are allowed to send the header
+	if host, _, err := net.SplitHostPort(conn.RemoteAddr().String()); err != nil || !l.server.isTrustedProxy(host) {
+		return conn, nil
+	}
+
+	return &proxyProtocolConn{Conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+// proxyProtocolConn reads the header on the first Read or RemoteAddr, so that Accept is never blocked.
+type proxyProtocolConn struct {
+	net.Conn
+	reader     *bufio.Reader
+	once       sync.Once
+	remoteAddr net.Addr
+	err        error
+}
+
+func (c *proxyProtocolConn) readHeader() {
+	c.once.Do(func() {
+		_ = c.Conn.SetReadDeadline(time.Now().Add(proxyProtocolTimeout))
+
+		c.remoteAddr, c.err = parseProxyProtocol(c.reader)
+
+		_ = c.Conn.SetReadDeadline(time.Time{})
+
+		if c.err != nil {
+			log.Printf("WARN: invalid PROXY protocol header from %s: %s\n", c.Conn.RemoteAddr(), c.err)
+			_ = c.Conn.Close()
+		}
+	})
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	c.readHeader()
+
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	return c.reader.Read(b)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.readHeader()
+
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+
+	return c.Conn.RemoteAddr()
+}
+
+// parseProxyProtocol parses the PROXY protocol header of version 1 or 2.
+// The address is nil for the LOCAL command and the UNKNOWN protocol, the address of the peer is used then.
+func parseProxyProtocol(r *bufio.Reader) (net.Addr, error) {
+	// the shortest v1 header "PROXY UNKNOWN\r\n" is longer than the signature of v2
+	signature, err := r.Peek(len(proxyProtocolV2Signature))
+
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	if bytes.Equal(signature, proxyProtocolV2Signature) {
+		return parseProxyProtocolV2(r)
+	}
+
+	if bytes.HasPrefix(signature, []byte("PROXY ")) {
+		return parseProxyProtocolV1(r)
+	}
+
+	return nil, errors.New("missing PROXY protocol header")
+}
+
+// parseProxyProtocolV1 parses the header like "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n".
+func parseProxyProtocolV1(r *bufio.Reader) (net.Addr, error) {
+	line := make([]byte, 0, 107)
+
+	// the header is at most 107 bytes
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		line = append(line, b)
+
+		if b == '\n' {
+			break
+		}
+	}
+
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("PROXY protocol v1 header is too long")
+	}
+
+	fields := strings.Fields(string(line[:len(line)-2]))
+
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("invalid PROXY protocol v1 header '%s'", strings.TrimSpace(string(line)))
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("invalid PROXY protocol v1 source '%s:%s'", fields[2], fields[4])
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// parseProxyProtocolV2 parses the binary header, the TLVs are ignored.
+func parseProxyProtocolV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version %d", header[12]>>4)
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	switch header[12] & 0x0F {
+	case 0x0: // LOCAL, eg. health checks of the load balancer
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, fmt.Errorf("unsupported PROXY protocol command %d", header[12]&0x0F)
+	}
+
+	// the high 4 bits are the address family, the low 4 bits are the transport protocol
+	switch header[13] >> 4 {
+	case 0x1: // AF_INET
+		if len(payload) < 12 {
+			return nil, errors.New("short PROXY protocol v2 address")
+		}
+
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 0x2: // AF_INET6
+		if len(payload) < 36 {
+			return nil, errors.New("short PROXY protocol v2 address")
+		}
+
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	default: // AF_UNSPEC or AF_UNIX
+		return nil, nil
+	}
+}
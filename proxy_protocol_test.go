@@ -0,0 +1,120 @@
+package forward
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_parseProxyProtocol(t *testing.T) {
+	v2 := func(command, family byte, payload ...byte) string {
+		header := append([]byte{}, proxyProtocolV2Signature...)
+		header = append(header, 0x20|command, family, byte(len(payload)>>8), byte(len(payload)))
+		return string(append(header, payload...))
+	}
+
+	tests := []struct {
+		name    string
+		header  string
+		want    string
+		wantErr bool
+	}{
+		{name: "v1 tcp4", header: "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n", want: "192.168.0.1:56324"},
+		{name: "v1 tcp6", header: "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n", want: "[2001:db8::1]:56324"},
+		{name: "v1 unknown", header: "PROXY UNKNOWN\r\n", want: "<nil>"},
+		{name: "v1 invalid", header: "PROXY TCP4 example.com 192.168.0.11 56324 443\r\n", wantErr: true},
+		{name: "v1 too long", header: "PROXY " + strings.Repeat("A", 120) + "\r\n", wantErr: true},
+		{
+			name:   "v2 tcp4",
+			header: v2(0x1, 0x11, 192, 168, 0, 1, 192, 168, 0, 11, 0xDC, 0x04, 0x01, 0xBB),
+			want:   "192.168.0.1:56324",
+		},
+		{
+			name:   "v2 tcp6",
+			header: v2(0x1, 0x21, append(append(net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")...), 0xDC, 0x04, 0x01, 0xBB)...),
+			want:   "[2001:db8::1]:56324",
+		},
+		{name: "v2 local", header: v2(0x0, 0x00), want: "<nil>"},
+		{name: "v2 short address", header: v2(0x1, 0x11, 192, 168), wantErr: true},
+		{name: "missing", header: "GET / HTTP/1.1\r\n\r\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reader := bufio.NewReader(strings.NewReader(tt.header + "GET / HTTP/1.1\r\n"))
+
+			got, err := parseProxyProtocol(reader)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseProxyProtocol() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err != nil {
+				return
+			}
+
+			addr := "<nil>"
+			if got != nil {
+				addr = got.String()
+			}
+
+			if addr != tt.want {
+				t.Errorf("parseProxyProtocol() = %v, want %v", addr, tt.want)
+			}
+
+			// the request follows the header
+			if rest, _ := ioutil.ReadAll(reader); string(rest) != "GET / HTTP/1.1\r\n" {
+				t.Errorf("rest = %q", rest)
+			}
+		})
+	}
+}
+
+func TestProxyServer_Listen(t *testing.T) {
+	if _, err := NewProxyServer(&ProxyServerOptions{ProxyProtocol: true}).Listen("127.0.0.1:0"); err == nil {
+		t.Error("Listen() without trusted proxies, want error")
+	}
+
+	tests := []struct {
+		name           string
+		trustedProxies []*net.IPNet
+		want           string
+	}{
+		{name: "trusted peer", trustedProxies: mustParseTrustedProxies("127.0.0.1"), want: "192.0.2.1"},
+		{name: "untrusted peer", trustedProxies: mustParseTrustedProxies("10.0.0.0/8"), want: "127.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ln, err := NewProxyServer(&ProxyServerOptions{ProxyProtocol: true, TrustedProxies: tt.trustedProxies}).Listen("127.0.0.1:0")
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer ln.Close()
+
+			go func() {
+				conn, err := net.Dial("tcp", ln.Addr().String())
+
+				if err == nil {
+					_, _ = conn.Write([]byte("PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n"))
+					time.Sleep(100 * time.Millisecond)
+					_ = conn.Close()
+				}
+			}()
+
+			conn, err := ln.Accept()
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer conn.Close()
+
+			if host, _, _ := net.SplitHostPort(conn.RemoteAddr().String()); host != tt.want {
+				t.Errorf("RemoteAddr() = %s, want %s", host, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,273 @@
+package forward
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	RateLimitByIP    = "ip"    // a bucket per client IP
+	RateLimitByRoute = "route" // a bucket shared by all clients of the route
+
+	rateLimitByHeaderPrefix = "header:" // a bucket per value of the header, eg. header:X-Api-Key
+
+	rateLimitSweepInterval = time.Minute
+)
+
+// RateLimitRule limits the rate of matched requests with token buckets.
+type RateLimitRule struct {
+	Path  string  // regular expression matching the URL path, matches all if empty
+	Key   string  // what a bucket is keyed by: ip, route or header:<name>, defaults to ip
+	Rate  float64 // the requests per second refilled into the bucket
+	Burst int     // the capacity of the bucket, defaults to the rate rounded up
+
+	path *regexp.Regexp
+}
+
+// ParseRateLimitRule parses the rule like "path=^/api,rate=10,burst=20,key=header:X-Api-Key",
+// the rate could be in the unit of /s, /m or /h like "rate=100/m". Commas in the path are escaped as "\,".
+func ParseRateLimitRule(value string) (RateLimitRule, error) {
+	rule := RateLimitRule{}
+
+	for _, paren := range splitEscaped(value, ',') {
+		kv := strings.SplitN(strings.TrimSpace(paren), "=", 2)
+
+		if len(kv) != 2 {
+			return rule, fmt.Errorf("invalid rate limit '%s'", value)
+		}
+
+		var err error
+
+		switch kv[0] {
+		case "path":
+			rule.Path = kv[1]
+		case "key":
+			rule.Key = kv[1]
+		case "rate":
+			rule.Rate, err = parseRate(kv[1])
+		case "burst":
+			rule.Burst, err = strconv.Atoi(kv[1])
+		default:
+			err = fmt.Errorf("unknown key '%s'", kv[0])
+		}
+
+		if err != nil {
+			return rule, errors.Wrapf(err, "invalid rate limit '%s'", value)
+		}
+	}
+
+	return rule, rule.compile()
+}
+
+// parseRate parses the rate like "10", "10/s", "100/m" or "1000/h" in requests per second.
+func parseRate(value string) (float64, error) {
+	unit := time.Second
+
+	if i := strings.Index(value, "/"); i >= 0 {
+		switch value[i+1:] {
+		case "s":
+		case "m":
+			unit = time.Minute
+		case "h":
+			unit = time.Hour
+		default:
+			return 0, fmt.Errorf("unknown rate unit '%s'", value[i+1:])
+		}
+
+		value = value[:i]
+	}
+
+	rate, err := strconv.ParseFloat(value, 64)
+
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+
+	return rate / unit.Seconds(), nil
+}
+
+func (l *RateLimitRule) compile() error {
+	if l.Rate <= 0 {
+		return fmt.Errorf("invalid rate %v, it should be greater than 0", l.Rate)
+	}
+
+	if l.Burst <= 0 {
+		l.Burst = int(math.Ceil(l.Rate))
+	}
+
+	switch {
+	case l.Key == "":
+		l.Key = RateLimitByIP
+	case l.Key == RateLimitByIP, l.Key == RateLimitByRoute:
+	case strings.HasPrefix(l.Key, rateLimitByHeaderPrefix) && len(l.Key) > len(rateLimitByHeaderPrefix):
+	default:
+		return fmt.Errorf("invalid rate limit key '%s', it should be ip, route or header:<name>", l.Key)
+	}
+
+	if l.Path == "" {
+		l.path = nil
+		return nil
+	}
+
+	reg, err := regexp.Compile(l.Path)
+
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	l.path = reg
+
+	return nil
+}
+
+// key returns the key of the bucket for the request, the client IP if the header is missing.
+func (l *RateLimitRule) key(r *http.Request) string {
+	switch {
+	case l.Key == RateLimitByRoute:
+		return ""
+	case strings.HasPrefix(l.Key, rateLimitByHeaderPrefix):
+		if v := r.Header.Get(strings.TrimPrefix(l.Key, rateLimitByHeaderPrefix)); v != "" {
+			return "header:" + v
+		}
+	}
+
+	return "ip:" + clientIP(r)
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter holds the token buckets of a rule.
+type rateLimiter struct {
+	rule      RateLimitRule
+	mux       sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func newRateLimiters(rules []RateLimitRule) []*rateLimiter {
+	limiters := []*rateLimiter{}
+
+	for _, rule := range rules {
+		if err := rule.compile(); err != nil {
+			log.Printf("WARN: ignore the rate limit: %+v\n", err)
+			continue
+		}
+
+		limiters = append(limiters, &rateLimiter{rule: rule, buckets: map[string]*tokenBucket{}})
+	}
+
+	return limiters
+}
+
+// bucket returns the refilled bucket of the key, the limiter should be locked.
+func (l *rateLimiter) bucket(key string, now time.Time) *tokenBucket {
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+
+	if !ok {
+		b = &tokenBucket{tokens: float64(l.rule.Burst), last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(float64(l.rule.Burst), b.tokens+now.Sub(b.last).Seconds()*l.rule.Rate)
+	b.last = now
+
+	return b
+}
+
+// allow takes a token from the bucket of the key,
+// or returns how long to wait for the next token if the bucket is empty.
+func (l *rateLimiter) allow(key string, now time.Time) (bool, time.Duration) {
+	return allowAll([]*rateLimiter{l}, []string{key}, now)
+}
+
+// allowAll takes a token from the buckets of all the limiters only if every bucket has one,
+// so that the request rejected by a rule does not consume the tokens of the others.
+// It returns the longest wait for the next tokens otherwise.
+func allowAll(limiters []*rateLimiter, keys []string, now time.Time) (bool, time.Duration) {
+	// the limiters are always locked in the order of the rules
+	for _, l := range limiters {
+		l.mux.Lock()
+		defer l.mux.Unlock()
+	}
+
+	buckets := make([]*tokenBucket, len(limiters))
+
+	var wait time.Duration
+
+	for i, l := range limiters {
+		buckets[i] = l.bucket(keys[i], now)
+
+		if b := buckets[i]; b.tokens < 1 {
+			if d := time.Duration((1 - b.tokens) / l.rule.Rate * float64(time.Second)); d > wait {
+				wait = d
+			}
+		}
+	}
+
+	if wait > 0 {
+		return false, wait
+	}
+
+	for _, b := range buckets {
+		b.tokens--
+	}
+
+	return true, 0
+}
+
+// sweep removes the buckets which have been refilled, they are the same as new ones.
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < rateLimitSweepInterval {
+		return
+	}
+
+	l.lastSweep = now
+
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rule.Rate >= float64(l.rule.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// rateLimit checks every matched rule, it responds with 429 and returns false if the request is limited.
+func (p *ProxyServer) rateLimit(w http.ResponseWriter, r *http.Request) bool {
+	limiters := []*rateLimiter{}
+	keys := []string{}
+
+	for _, l := range p.rateLimiters {
+		if l.rule.path != nil && !l.rule.path.MatchString(r.URL.Path) {
+			continue
+		}
+
+		limiters = append(limiters, l)
+		keys = append(keys, l.rule.key(r))
+	}
+
+	if len(limiters) == 0 {
+		return true
+	}
+
+	if ok, retryAfter := allowAll(limiters, keys, time.Now()); !ok {
+		log.Printf("rate limited [%s]: %s from %s\n", r.Method, r.URL.String(), clientIP(r))
+		w.Header().Set("Retry-After", fmt.Sprint(int(math.Ceil(retryAfter.Seconds()))))
+		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		return false
+	}
+
+	return true
+}
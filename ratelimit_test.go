@@ -0,0 +1,161 @@
+package forward
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestParseRateLimitRule(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    RateLimitRule
+		wantErr bool
+	}{
+		{name: "default key and burst", value: "rate=2.5", want: RateLimitRule{Key: RateLimitByIP, Rate: 2.5, Burst: 3}},
+		{name: "per minute", value: "path=^/api,rate=120/m,burst=10,key=route", want: RateLimitRule{Path: "^/api", Key: RateLimitByRoute, Rate: 2, Burst: 10}},
+		{name: "header", value: "rate=1,key=header:X-Api-Key", want: RateLimitRule{Key: "header:X-Api-Key", Rate: 1, Burst: 1}},
+		{name: "escaped comma", value: `path=^/v\d{1\,2}/,rate=1`, want: RateLimitRule{Path: `^/v\d{1,2}/`, Key: RateLimitByIP, Rate: 1, Burst: 1}},
+		{name: "missing rate", value: "burst=10", wantErr: true},
+		{name: "unknown unit", value: "rate=1/d", wantErr: true},
+		{name: "unknown key", value: "rate=1,key=cookie", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseRateLimitRule(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseRateLimitRule() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if tt.wantErr {
+				return
+			}
+			if got.Path != tt.want.Path || got.Key != tt.want.Key || got.Rate != tt.want.Rate || got.Burst != tt.want.Burst {
+				t.Errorf("ParseRateLimitRule() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_rateLimiter_allow(t *testing.T) {
+	l := newRateLimiters([]RateLimitRule{{Rate: 2, Burst: 2}})[0]
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.allow("a", now); !ok {
+			t.Fatalf("allow() #%d = false, want true within the burst", i)
+		}
+	}
+
+	if ok, retryAfter := l.allow("a", now); ok || retryAfter != 500*time.Millisecond {
+		t.Errorf("allow() = %v, %v, want false, 500ms", ok, retryAfter)
+	}
+
+	if ok, _ := l.allow("b", now); !ok {
+		t.Errorf("allow() of another key = false, want true")
+	}
+
+	if ok, _ := l.allow("a", now.Add(500*time.Millisecond)); !ok {
+		t.Errorf("allow() after refill = false, want true")
+	}
+}
+
+func Test_allowAll(t *testing.T) {
+	now := time.Now()
+	loose := newRateLimiters([]RateLimitRule{{Rate: 1, Burst: 5}})[0]
+	strict := newRateLimiters([]RateLimitRule{{Rate: 1, Burst: 1}})[0]
+	limiters := []*rateLimiter{loose, strict}
+	keys := []string{"a", "a"}
+
+	if ok, _ := allowAll(limiters, keys, now); !ok {
+		t.Fatal("allowAll() = false, want true within the bursts")
+	}
+
+	for i := 0; i < 3; i++ {
+		if ok, retryAfter := allowAll(limiters, keys, now); ok || retryAfter != time.Second {
+			t.Errorf("allowAll() = %v, %v, want false, 1s", ok, retryAfter)
+		}
+	}
+
+	// the rejected requests do not take the tokens of the loose rule
+	if b := loose.buckets["a"]; b.tokens != 4 {
+		t.Errorf("tokens of the loose rule = %v, want 4", b.tokens)
+	}
+}
+
+func TestProxyServer_rateLimit(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer upstream.Close()
+
+	target, _ := url.Parse(upstream.URL)
+
+	server := NewProxyServer(&ProxyServerOptions{
+		Target:     target,
+		RateLimits: []RateLimitRule{{Path: "^/api", Key: "header:X-Api-Key", Rate: 0.1, Burst: 1}},
+	})
+	defer server.Close()
+
+	tests := []struct {
+		name       string
+		path       string
+		apiKey     string
+		wantStatus int
+	}{
+		{name: "first request", path: "/api", apiKey: "a", wantStatus: http.StatusNoContent},
+		{name: "limited", path: "/api", apiKey: "a", wantStatus: http.StatusTooManyRequests},
+		{name: "another key", path: "/api", apiKey: "b", wantStatus: http.StatusNoContent},
+		{name: "another route", path: "/static", apiKey: "a", wantStatus: http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			req.Header.Set("X-Api-Key", tt.apiKey)
+			w := httptest.NewRecorder()
+
+			server.Handler()(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if w.Code == http.StatusTooManyRequests && w.Header().Get("Retry-After") != "10" {
+				t.Errorf("Retry-After = %q, want %q", w.Header().Get("Retry-After"), "10")
+			}
+		})
+	}
+}
+
+func Test_upstreamPool_acquire(t *testing.T) {
+	a, _ := url.Parse("http://a")
+	b, _ := url.Parse("http://b")
+
+	pool := newUpstreamPool(&ProxyServerOptions{Target: a, Upstreams: []*url.URL{b}, UpstreamConcurrency: 1})
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	first := pool.pick(req)
+
+	if !pool.acquire(first) {
+		t.Fatalf("acquire() = false, want true")
+	}
+
+	// the busy upstream is skipped
+	second := pool.pick(req)
+
+	if second == first || !pool.acquire(second) {
+		t.Fatalf("pick() = %s, want the idle upstream", second.URL)
+	}
+
+	if third := pool.pick(req); pool.acquire(third) {
+		t.Errorf("acquire() = true, want false when all upstreams are busy")
+	}
+
+	pool.release(first)
+
+	if !pool.acquire(first) {
+		t.Errorf("acquire() after release = false, want true")
+	}
+}
@@ -0,0 +1,224 @@
+package forward
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	RedirectDowngrade = "downgrade" // 301 -> 302 and 308 -> 307, so that browsers do not cache the redirects of the proxy
+	RedirectKeep      = "keep"      // send the permanent redirects as they are
+)
+
+const defaultMaxRedirects = 10
+
+func isRedirect(status int) bool {
+	switch status {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+
+	return false
+}
+
+// redirectTransport follows the redirects of the host patterns, the final response is returned.
+type redirectTransport struct {
+	http.RoundTripper
+	hosts []string // the host patterns whose redirects are followed
+	hops  int      // the max hops
+}
+
+func newRedirectTransport(next http.RoundTripper, options *ProxyServerOptions) *redirectTransport {
+	hops := options.MaxRedirects
+
+	if hops <= 0 {
+		hops = defaultMaxRedirects
+	}
+
+	return &redirectTransport{RoundTripper: next, hosts: options.FollowRedirects, hops: hops}
+}
+
+func (t *redirectTransport) match(host string) bool {
+	for _, pattern := range t.hosts {
+		if matchHostPattern(pattern, host) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// follow returns the location of the redirect to follow, or nil. Both the host sending the redirect
+// and the host of the location should match the patterns, the proxy never goes to other hosts.
+func (t *redirectTransport) follow(req *http.Request, res *http.Response) *url.URL {
+	if !isRedirect(res.StatusCode) || res.Header.Get("Location") == "" {
+		return nil
+	}
+
+	location, err := req.URL.Parse(res.Header.Get("Location"))
+
+	if err != nil || (location.Scheme != "http" && location.Scheme != "https") {
+		return nil
+	}
+
+	if !t.match(req.URL.Host) || !t.match(location.Host) {
+		return nil
+	}
+
+	return location
+}
+
+func (t *redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	method := req.Method
+	chain := []string{req.URL.String()}
+
+	res, err := t.RoundTripper.RoundTrip(req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for hops := 0; ; hops++ {
+		location := t.follow(req, res)
+
+		if location == nil {
+			break
+		}
+
+		// the last redirect is returned to the client
+		if hops >= t.hops {
+			log.Printf("redirect [%s]: the limit of %d hops is reached, return the %d response: %s -> (%d) %s\n", method, t.hops, res.StatusCode, strings.Join(chain, " -> "), res.StatusCode, location)
+			return res, nil
+		}
+
+		next, err := redirectRequest(req, res.StatusCode, location)
+
+		if err != nil {
+			log.Printf("WARN: could not follow the redirect to %s: %s\n", location, err)
+			break
+		}
+
+		_, _ = io.Copy(ioutil.Discard, io.LimitReader(res.Body, 4<<10))
+		_ = res.Body.Close()
+
+		chain = append(chain, fmt.Sprintf("(%d) %s", res.StatusCode, location))
+		req = next
+
+		if res, err = t.RoundTripper.RoundTrip(req); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(chain) > 1 {
+		log.Printf("redirect [%s]: %s\n", method, strings.Join(chain, " -> "))
+	}
+
+	return res, nil
+}
+
+// redirectRequest returns the request to the location like the client does,
+// the credentials are not sent to another host.
+func redirectRequest(req *http.Request, status int, location *url.URL) (*http.Request, error) {
+	next := req.Clone(req.Context())
+	next.URL = location
+	next.Host = location.Host
+
+	if !strings.EqualFold(location.Hostname(), req.URL.Hostname()) {
+		for _, name := range []string{"Authorization", "Www-Authenticate", "Cookie", "Cookie2"} {
+			next.Header.Del(name)
+		}
+	}
+
+	// the method is changed to GET except 307 and 308
+	if status != http.StatusTemporaryRedirect && status != http.StatusPermanentRedirect && req.Method != http.MethodGet && req.Method != http.MethodHead {
+		next.Method = http.MethodGet
+		next.Body = nil
+		next.GetBody = nil
+		next.ContentLength = 0
+		next.Header.Del("Content-Type")
+		next.Header.Del("Content-Length")
+		return next, nil
+	}
+
+	if req.Body == nil || req.Body == http.NoBody {
+		return next, nil
+	}
+
+	if req.GetBody == nil {
+		return nil, errors.New("the request body could not be sent again")
+	}
+
+	body, err := req.GetBody()
+
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	next.Body = body
+
+	return next, nil
+}
+
+// rewriteLocation maps the redirect location of the upstream to the proxy. The location on the upstream selected by
+// forward_url or X-Proxy-Target is requested with forward_url, since the browser does not send X-Proxy-Target again.
+func (p *ProxyServer) rewriteLocation(location string, res *http.Response, m hostMapping) string {
+	u, err := url.Parse(location)
+
+	if err != nil || m.forwarded || location == "" {
+		return location
+	}
+
+	base := res.Request.URL
+
+	if !u.IsAbs() {
+		// the browser resolves it on the proxy host, which serves the pages of the upstream
+		if u.Host == "" && contains(m.originHosts, base.Host) {
+			return location
+		}
+
+		u = base.ResolveReference(u)
+	}
+
+	if !contains(m.originHosts, u.Host) && strings.EqualFold(u.Host, base.Host) && (u.Scheme == "http" || u.Scheme == "https") {
+		scheme := "http"
+
+		if m.useSSL {
+			scheme = "https"
+		}
+
+		return fmt.Sprintf("%s://%s/?forward_url=%s", scheme, m.proxyHost, url.QueryEscape(u.String()))
+	}
+
+	return p.replaceHosts(u.String(), m)
+}
+
+// modifyRedirect applies the redirect policy, then rewrites the Location header.
+func (p *ProxyServer) modifyRedirect(res *http.Response, m hostMapping) {
+	// https://developer.mozilla.org/zh-CN/docs/Web/HTTP/Redirections
+	if p.PermanentRedirect != RedirectKeep {
+		switch res.StatusCode {
+		case http.StatusMovedPermanently:
+			res.StatusCode = http.StatusFound
+		case http.StatusPermanentRedirect:
+			res.StatusCode = http.StatusTemporaryRedirect
+		}
+	}
+
+	// https://developer.mozilla.org/zh-CN/docs/Web/HTTP/Headers/Location
+	if location := res.Header.Get("Location"); location != "" {
+		newLocation := p.rewriteLocation(location, res, m)
+
+		res.Header.Set("Location", newLocation)
+	}
+
+	if isRedirect(res.StatusCode) {
+		log.Printf("redirect [%s] %d: %s -> %s\n", res.Request.Method, res.StatusCode, res.Request.URL.String(), res.Header.Get("Location"))
+	}
+}
@@ -0,0 +1,167 @@
+package forward
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestProxyServer_modifyRedirect(t *testing.T) {
+	m := hostMapping{originHosts: []string{"example.com"}, proxyHost: "localhost:8080"}
+
+	tests := []struct {
+		name         string
+		options      ProxyServerOptions
+		requestURL   string
+		status       int
+		headers      map[string]string
+		wantStatus   int
+		wantLocation string
+	}{
+		{
+			name:         "downgrade 301",
+			requestURL:   "http://example.com/a",
+			status:       http.StatusMovedPermanently,
+			headers:      map[string]string{"Location": "https://example.com/b?c=d"},
+			wantStatus:   http.StatusFound,
+			wantLocation: "http://localhost:8080/b?c=d",
+		},
+		{
+			name:         "downgrade 308",
+			requestURL:   "http://example.com/a",
+			status:       http.StatusPermanentRedirect,
+			headers:      map[string]string{"Location": "/b"},
+			wantStatus:   http.StatusTemporaryRedirect,
+			wantLocation: "/b",
+		},
+		{
+			name:         "keep 301",
+			options:      ProxyServerOptions{PermanentRedirect: RedirectKeep},
+			requestURL:   "http://example.com/a",
+			status:       http.StatusMovedPermanently,
+			headers:      map[string]string{"Location": "/b"},
+			wantStatus:   http.StatusMovedPermanently,
+			wantLocation: "/b",
+		},
+		{
+			name:         "relative location of X-Proxy-Target",
+			requestURL:   "https://other.com/a/b",
+			status:       http.StatusFound,
+			headers:      map[string]string{"Location": "c?d=1"},
+			wantStatus:   http.StatusFound,
+			wantLocation: "http://localhost:8080/?forward_url=" + url.QueryEscape("https://other.com/a/c?d=1"),
+		},
+		{
+			name:         "protocol relative location of forward_url",
+			requestURL:   "https://other.com/a",
+			status:       http.StatusSeeOther,
+			headers:      map[string]string{"Location": "//example.com/login"},
+			wantStatus:   http.StatusSeeOther,
+			wantLocation: "http://localhost:8080/login",
+		},
+		{
+			name:         "external location",
+			requestURL:   "http://example.com/a",
+			status:       http.StatusFound,
+			headers:      map[string]string{"Location": "https://sso.example.org/login"},
+			wantStatus:   http.StatusFound,
+			wantLocation: "https://sso.example.org/login",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			options := tt.options
+			p := &ProxyServer{ProxyServerOptions: &options}
+
+			req, _ := http.NewRequest(http.MethodGet, tt.requestURL, nil)
+			res := &http.Response{StatusCode: tt.status, Header: http.Header{}, Request: req}
+
+			for k, v := range tt.headers {
+				res.Header.Set(k, v)
+			}
+
+			p.modifyRedirect(res, m)
+
+			if res.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d, want %d", res.StatusCode, tt.wantStatus)
+			}
+
+			if got := res.Header.Get("Location"); got != tt.wantLocation {
+				t.Errorf("Location = %v, want %v", got, tt.wantLocation)
+			}
+		})
+	}
+}
+
+func TestRedirectTransport(t *testing.T) {
+	requests := 0
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests++
+
+		switch r.URL.Path {
+		case "/away":
+			http.Redirect(w, r, "http://other.example.com/final", http.StatusFound)
+		case "/see-other":
+			http.Redirect(w, r, "/temporary", http.StatusSeeOther)
+		case "/temporary":
+			http.Redirect(w, r, "/final", http.StatusTemporaryRedirect)
+		case "/loop":
+			http.Redirect(w, r, "/loop", http.StatusFound)
+		default:
+			_, _ = w.Write([]byte(r.Method + " " + r.URL.Path + " " + string(body)))
+		}
+	}))
+	defer upstream.Close()
+
+	target, _ := url.Parse(upstream.URL)
+
+	tests := []struct {
+		name         string
+		hosts        []string
+		method       string
+		path         string
+		wantStatus   int
+		wantBody     string
+		wantRequests int
+	}{
+		{name: "not followed", hosts: []string{"example.com"}, method: http.MethodGet, path: "/temporary", wantStatus: http.StatusTemporaryRedirect, wantRequests: 1},
+		{name: "307 keeps the method", hosts: []string{target.Hostname()}, method: http.MethodPost, path: "/temporary", wantStatus: http.StatusOK, wantBody: "POST /final data", wantRequests: 2},
+		{name: "303 changes the method", hosts: []string{"127.0.0.0/8"}, method: http.MethodPost, path: "/see-other", wantStatus: http.StatusOK, wantBody: "GET /final ", wantRequests: 3},
+		{name: "location of another host", hosts: []string{"127.0.0.0/8"}, method: http.MethodGet, path: "/away", wantStatus: http.StatusFound, wantRequests: 1},
+		{name: "max hops", hosts: []string{"*"}, method: http.MethodGet, path: "/loop", wantStatus: http.StatusFound, wantRequests: 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests = 0
+			transport := newRedirectTransport(http.DefaultTransport, &ProxyServerOptions{FollowRedirects: tt.hosts, MaxRedirects: 3})
+
+			req, _ := http.NewRequest(tt.method, upstream.URL+tt.path, strings.NewReader("data"))
+
+			res, err := transport.RoundTrip(req)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			body, _ := ioutil.ReadAll(res.Body)
+			res.Body.Close()
+
+			if res.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d, want %d", res.StatusCode, tt.wantStatus)
+			}
+
+			if tt.wantBody != "" && string(body) != tt.wantBody {
+				t.Errorf("body = %q, want %q", body, tt.wantBody)
+			}
+
+			if requests != tt.wantRequests {
+				t.Errorf("requests = %d, want %d", requests, tt.wantRequests)
+			}
+		})
+	}
+}
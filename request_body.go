@@ -0,0 +1,278 @@
+package forward
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const defaultRequestBodyLimit = 10 << 20
+
+// the max number of proxy hosts whose URL patterns are cached, the Host header comes from the client
+const maxProxyURLPatterns = 64
+
+// proxyURLPatterns caches the compiled patterns matching the URLs of the proxy hosts.
+type proxyURLPatterns struct {
+	mux      sync.RWMutex
+	patterns map[string]*regexp.Regexp
+}
+
+// get returns the pattern matching the URLs of the proxy host.
+func (c *proxyURLPatterns) get(proxyHost string) *regexp.Regexp {
+	c.mux.RLock()
+	reg, ok := c.patterns[proxyHost]
+	c.mux.RUnlock()
+
+	if ok {
+		return reg
+	}
+
+	// the proxy host is usually localhost, which replaceHost does not treat as a host
+	reg = regexp.MustCompile(`(?i)\b(https?|wss?)://` + regexp.QuoteMeta(proxyHost) + `([^\w.:-]|$)`)
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if c.patterns == nil {
+		c.patterns = map[string]*regexp.Regexp{}
+	}
+
+	if len(c.patterns) < maxProxyURLPatterns {
+		c.patterns[proxyHost] = reg
+	}
+
+	return reg
+}
+
+// requestBodyMapping rewrites the content sent by the client for the upstream.
+type requestBodyMapping struct {
+	proxyURL   *regexp.Regexp // the URLs of the proxy host replaced with the target host, nil to keep the hosts
+	targetHost string
+	useSSL     bool // whether the target is https
+	replaces   []string
+}
+
+// replace applies the replacement rules, then maps the hosts of the proxy back to the target.
+func (m requestBodyMapping) replace(content string) string {
+	return m.mapHosts(m.replaceContent(content))
+}
+
+func (m requestBodyMapping) replaceContent(content string) string {
+	for _, paren := range m.replaces {
+		if from, to, ok := parseReplacement(paren); ok {
+			content = strings.ReplaceAll(content, from, to)
+		}
+	}
+
+	return content
+}
+
+func (m requestBodyMapping) mapHosts(content string) string {
+	if m.proxyURL == nil {
+		return content
+	}
+
+	return m.proxyURL.ReplaceAllStringFunc(content, func(s string) string {
+		sub := m.proxyURL.FindStringSubmatch(s)
+		scheme := "http"
+
+		if strings.HasPrefix(strings.ToLower(sub[1]), "ws") {
+			scheme = "ws"
+		}
+
+		if m.useSSL {
+			scheme += "s"
+		}
+
+		return scheme + "://" + m.targetHost + sub[2]
+	})
+}
+
+// rewriteJSONBody applies the replacement rules to the raw content, then maps the hosts in the string values,
+// so that the escaped URLs are mapped and the structure is kept. The invalid JSON is rewritten as text.
+func rewriteJSONBody(body []byte, m requestBodyMapping) []byte {
+	content := m.replaceContent(string(body))
+
+	if newBody, ok := rewriteJSON([]byte(content), func(value string, _ []jsonPathElement) string {
+		return m.mapHosts(value)
+	}); ok {
+		return newBody
+	}
+
+	return []byte(m.mapHosts(content))
+}
+
+// modifyRequestBody rewrites the body of JSON, form and multipart requests,
+// the hosts of the proxy are mapped back to the target, then the replacement rules are applied.
+func (p *ProxyServer) modifyRequestBody(req *http.Request, m requestBodyMapping) error {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil
+	}
+
+	mediaType, params, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+
+	if err != nil {
+		return nil
+	}
+
+	var rewrite func([]byte) ([]byte, error)
+
+	switch {
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		rewrite = func(body []byte) ([]byte, error) {
+			return rewriteJSONBody(body, m), nil
+		}
+	case mediaType == "application/x-www-form-urlencoded":
+		rewrite = func(body []byte) ([]byte, error) {
+			return []byte(rewriteFormBody(string(body), m)), nil
+		}
+	case mediaType == "multipart/form-data" && params["boundary"] != "":
+		rewrite = func(body []byte) ([]byte, error) {
+			return rewriteMultipartBody(body, params["boundary"], m)
+		}
+	default:
+		return nil
+	}
+
+	encoding := req.Header.Get("Content-Encoding")
+
+	switch encoding {
+	case "", "identity", "gzip", "deflate", "br":
+	default:
+		return nil
+	}
+
+	limit := p.RequestBodyLimit
+
+	if limit <= 0 {
+		limit = defaultRequestBodyLimit
+	}
+
+	if req.ContentLength > limit {
+		return nil
+	}
+
+	raw, err := ioutil.ReadAll(io.LimitReader(req.Body, limit+1))
+
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	// too large to be buffered, send it as it is
+	if int64(len(raw)) > limit {
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(raw), req.Body), req.Body}
+		return nil
+	}
+
+	_ = req.Body.Close()
+
+	newBody := raw
+
+	if body, err := decodeContent(encoding, bytes.NewReader(raw)); err == nil {
+		if body, err = rewrite(body); err == nil {
+			if body, err = encodeContent(encoding, body); err == nil {
+				newBody = body
+			}
+		}
+	}
+
+	req.ContentLength = int64(len(newBody))
+	req.Header.Set("Content-Length", strconv.Itoa(len(newBody)))
+	req.Body = ioutil.NopCloser(bytes.NewReader(newBody))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(newBody)), nil
+	}
+
+	return nil
+}
+
+// rewriteFormBody rewrites the decoded keys and values of the form, keeping the order of the fields.
+func rewriteFormBody(body string, m requestBodyMapping) string {
+	fields := strings.Split(body, "&")
+
+	for i, field := range fields {
+		kv := strings.SplitN(field, "=", 2)
+
+		for j, s := range kv {
+			if unescaped, err := url.QueryUnescape(s); err == nil {
+				if replaced := m.replace(unescaped); replaced != unescaped {
+					kv[j] = url.QueryEscape(replaced)
+				}
+			}
+		}
+
+		fields[i] = strings.Join(kv, "=")
+	}
+
+	return strings.Join(fields, "&")
+}
+
+// rewriteMultipartBody rewrites the text fields of the multipart form, files are kept as they are.
+func rewriteMultipartBody(body []byte, boundary string, m requestBodyMapping) ([]byte, error) {
+	reader := multipart.NewReader(bytes.NewReader(body), boundary)
+
+	buf := &bytes.Buffer{}
+	writer := multipart.NewWriter(buf)
+
+	if err := writer.SetBoundary(boundary); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	for {
+		part, err := reader.NextRawPart()
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		content, err := ioutil.ReadAll(part)
+
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		header := textproto.MIMEHeader{}
+
+		for k, v := range part.Header {
+			header[k] = v
+		}
+
+		if part.FileName() == "" {
+			content = []byte(m.replace(string(content)))
+		}
+
+		w, err := writer.CreatePart(header)
+
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		if _, err := w.Write(content); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,151 @@
+package forward
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func Test_rewriteFormBody(t *testing.T) {
+	m := requestBodyMapping{proxyURL: (&proxyURLPatterns{}).get("localhost:8080"), targetHost: "example.com", useSSL: true, replaces: []string{"foo=bar"}}
+
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{
+			name: "escaped url",
+			body: "redirect_uri=http%3A%2F%2Flocalhost%3A8080%2Fcallback&state=1",
+			want: "redirect_uri=https%3A%2F%2Fexample.com%2Fcallback&state=1",
+		},
+		{name: "replacement", body: "a=foo&b", want: "a=bar&b"},
+		{name: "untouched", body: "a=%E4%BD%A0+b&b=c", want: "a=%E4%BD%A0+b&b=c"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rewriteFormBody(tt.body, m); got != tt.want {
+				t.Errorf("rewriteFormBody() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProxyServer_modifyRequestBody(t *testing.T) {
+	var received []byte
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received, _ = ioutil.ReadAll(r.Body)
+
+		if r.ContentLength != int64(len(received)) {
+			t.Errorf("Content-Length = %d, want %d", r.ContentLength, len(received))
+		}
+
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			reader, _ := gzip.NewReader(bytes.NewReader(received))
+			received, _ = ioutil.ReadAll(reader)
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer upstream.Close()
+
+	target, _ := url.Parse(upstream.URL)
+
+	server := NewProxyServer(&ProxyServerOptions{
+		Target:                target,
+		RewriteRequestBody:    true,
+		ReplaceRequestContent: []string{"secret=token"},
+	})
+	defer server.Close()
+
+	proxyServer := httptest.NewServer(http.HandlerFunc(server.Handler()))
+	defer proxyServer.Close()
+
+	proxyHost := strings.TrimPrefix(proxyServer.URL, "http://")
+
+	multipartBody := &bytes.Buffer{}
+	mw := multipart.NewWriter(multipartBody)
+	_ = mw.WriteField("callback", proxyServer.URL+"/cb")
+	fw, _ := mw.CreateFormFile("file", "a.txt")
+	_, _ = fw.Write([]byte(proxyServer.URL))
+	_ = mw.Close()
+
+	gzipBody := &bytes.Buffer{}
+	gz := gzip.NewWriter(gzipBody)
+	_, _ = gz.Write([]byte(`{"url": "` + proxyServer.URL + `/a"}`))
+	_ = gz.Close()
+
+	tests := []struct {
+		name        string
+		contentType string
+		encoding    string
+		body        []byte
+		want        string
+	}{
+		{
+			name:        "json",
+			contentType: "application/json; charset=utf-8",
+			body:        []byte(`{"url": "` + proxyServer.URL + `/a", "key": "secret"}`),
+			want:        `{"url": "` + upstream.URL + `/a", "key": "token"}`,
+		},
+		{
+			name:        "json with escaped slashes",
+			contentType: "application/json",
+			body:        []byte(`{"url":"` + strings.ReplaceAll(proxyServer.URL, "/", `\/`) + `\/a"}`),
+			want:        `{"url":"` + strings.ReplaceAll(upstream.URL, "/", `\/`) + `\/a"}`,
+		},
+		{
+			name:        "gzip json",
+			contentType: "application/json",
+			encoding:    "gzip",
+			body:        gzipBody.Bytes(),
+			want:        `{"url": "` + upstream.URL + `/a"}`,
+		},
+		{
+			name:        "form",
+			contentType: "application/x-www-form-urlencoded",
+			body:        []byte("redirect_uri=" + url.QueryEscape(proxyServer.URL+"/cb")),
+			want:        "redirect_uri=" + url.QueryEscape(upstream.URL+"/cb"),
+		},
+		{
+			name:        "multipart",
+			contentType: mw.FormDataContentType(),
+			body:        multipartBody.Bytes(),
+			want:        strings.Replace(multipartBody.String(), proxyHost+"/cb", target.Host+"/cb", 1),
+		},
+		{
+			name:        "other types are untouched",
+			contentType: "text/plain",
+			body:        []byte(proxyServer.URL),
+			want:        proxyServer.URL,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodPost, proxyServer.URL, bytes.NewReader(tt.body))
+			req.Header.Set("Content-Type", tt.contentType)
+			req.Header.Set("Content-Encoding", tt.encoding)
+			req.Header.Set("Content-Length", strconv.Itoa(len(tt.body)))
+
+			res, err := http.DefaultClient.Do(req)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			res.Body.Close()
+
+			if string(received) != tt.want {
+				t.Errorf("body = %q, want %q", received, tt.want)
+			}
+		})
+	}
+}
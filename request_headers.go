@@ -0,0 +1,88 @@
+package forward
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// reverseMapURL maps the URL of the proxy back to the upstream, the path and query are preserved.
+// The URL like http://localhost:8080/?forward_url=https%3A%2F%2Fexternal.com%2F is mapped to the original URL.
+func reverseMapURL(raw, proxyHost string, site url.URL) (string, bool) {
+	u, err := url.Parse(raw)
+
+	if err != nil || u.Host == "" || !strings.EqualFold(u.Host, proxyHost) {
+		return raw, false
+	}
+
+	if forwardURL := u.Query().Get("forward_url"); forwardURL != "" {
+		if original, err := url.Parse(forwardURL); err == nil && original.IsAbs() {
+			return original.String(), true
+		}
+	}
+
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https":
+		u.Scheme = site.Scheme
+	case "ws":
+		u.Scheme = "ws"
+		if site.Scheme == "https" {
+			u.Scheme = "wss"
+		}
+	case "wss":
+		u.Scheme = "wss"
+		if site.Scheme == "http" {
+			u.Scheme = "ws"
+		}
+	default:
+		return raw, false
+	}
+
+	u.Host = site.Host
+
+	return u.String(), true
+}
+
+// modifyRequestHeaders maps the Referer, Origin and configured headers
+// sent by the client from the proxy host back to the upstream.
+func (p *ProxyServer) modifyRequestHeaders(req *http.Request, proxyHost string, site url.URL) {
+	origin := fmt.Sprintf("%s://%s", site.Scheme, site.Host)
+
+	if referer := req.Header.Get("Referer"); referer != "" {
+		if mapped, ok := reverseMapURL(referer, proxyHost, site); ok {
+			req.Header.Set("Referer", mapped)
+
+			// the page requested via forward_url has the origin of the proxy, but it comes from the original host
+			if u, err := url.Parse(mapped); err == nil {
+				origin = fmt.Sprintf("%s://%s", u.Scheme, u.Host)
+			}
+		}
+	}
+
+	if v := req.Header.Get("Origin"); v != "" {
+		if _, ok := reverseMapURL(v, proxyHost, site); ok {
+			req.Header.Set("Origin", origin)
+		}
+	}
+
+	if len(p.ReverseMapHeaders) == 0 {
+		return
+	}
+
+	m := requestBodyMapping{proxyURL: p.proxyURLs.get(proxyHost), targetHost: site.Host, useSSL: site.Scheme == "https"}
+
+	for _, name := range p.ReverseMapHeaders {
+		values := req.Header.Values(name)
+
+		req.Header.Del(name)
+
+		for _, v := range values {
+			if mapped, ok := reverseMapURL(v, proxyHost, site); ok {
+				req.Header.Add(name, mapped)
+			} else {
+				req.Header.Add(name, m.replace(v))
+			}
+		}
+	}
+}
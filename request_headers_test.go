@@ -0,0 +1,104 @@
+package forward
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func Test_reverseMapURL(t *testing.T) {
+	site := url.URL{Scheme: "https", Host: "example.com"}
+
+	tests := []struct {
+		name   string
+		raw    string
+		want   string
+		wantOK bool
+	}{
+		{name: "path and query", raw: "http://localhost:8080/a/b?c=d#e", want: "https://example.com/a/b?c=d#e", wantOK: true},
+		{name: "host is case insensitive", raw: "http://LOCALHOST:8080", want: "https://example.com", wantOK: true},
+		{name: "websocket", raw: "ws://localhost:8080/ws", want: "wss://example.com/ws", wantOK: true},
+		{
+			name:   "forward_url",
+			raw:    "http://localhost:8080/?forward_url=" + url.QueryEscape("https://cdn.example.org/page?x=1"),
+			want:   "https://cdn.example.org/page?x=1",
+			wantOK: true,
+		},
+		{name: "other host", raw: "http://localhost:8081/a", want: "http://localhost:8081/a"},
+		{name: "relative", raw: "/a", want: "/a"},
+		{name: "empty", raw: "", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := reverseMapURL(tt.raw, "localhost:8080", site)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("reverseMapURL() = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestProxyServer_modifyRequestHeaders(t *testing.T) {
+	target, _ := url.Parse("https://example.com")
+
+	server := NewProxyServer(&ProxyServerOptions{
+		Target:            target,
+		ReverseMapHeaders: []string{"X-Return-To"},
+	})
+	defer server.Close()
+
+	tests := []struct {
+		name        string
+		headers     map[string]string
+		wantHeaders map[string]string
+	}{
+		{
+			name: "same site",
+			headers: map[string]string{
+				"Referer":     "http://localhost:8080/login?next=%2Fhome",
+				"Origin":      "http://localhost:8080",
+				"X-Return-To": "url=http://localhost:8080/done",
+			},
+			wantHeaders: map[string]string{
+				"Referer":     "https://example.com/login?next=%2Fhome",
+				"Origin":      "https://example.com",
+				"X-Return-To": "url=https://example.com/done",
+				"Referrer":    "",
+			},
+		},
+		{
+			name: "page requested via forward_url",
+			headers: map[string]string{
+				"Referer": "http://localhost:8080/?forward_url=" + url.QueryEscape("https://cdn.example.org/page"),
+				"Origin":  "http://localhost:8080",
+			},
+			wantHeaders: map[string]string{
+				"Referer": "https://cdn.example.org/page",
+				"Origin":  "https://cdn.example.org",
+			},
+		},
+		{
+			name:        "without origin",
+			headers:     map[string]string{},
+			wantHeaders: map[string]string{"Origin": "", "Referer": ""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://localhost:8080/api", nil)
+
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+
+			server.proxy.Director(req)
+
+			for k, v := range tt.wantHeaders {
+				if got := req.Header.Get(k); got != v {
+					t.Errorf("%s = %q, want %q", k, got, v)
+				}
+			}
+		})
+	}
+}
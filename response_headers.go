@@ -0,0 +1,105 @@
+package forward
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Refresh: 5; url=https://example.com/
+var regRefresh = regexp.MustCompile(`(?i)^(\s*[0-9.]+\s*[;,]\s*(?:url\s*=\s*)?)(['"]?)([^'"]*)(['"]?\s*)$`)
+
+// Link: <https://example.com/style.css>; rel=preload; as=style, </app.js>; rel=preload
+var regLinkURL = regexp.MustCompile(`<([^>]*)>`)
+
+// urlHeaderRewriter rewrites the URLs in the value of the response header.
+type urlHeaderRewriter func(p *ProxyServer, value string, res *http.Response, m hostMapping) string
+
+// urlHeaders is the registry of the URL-bearing response headers, Location is rewritten by the redirect policy.
+var urlHeaders = map[string]urlHeaderRewriter{
+	"Content-Location":            rewriteURLHeader,
+	"X-Sourcemap":                 rewriteURLHeader,
+	"Sourcemap":                   rewriteURLHeader,
+	"Link":                        rewriteLinkHeader,
+	"Refresh":                     rewriteRefreshHeader,
+	"Access-Control-Allow-Origin": rewriteOriginHeader,
+	"Timing-Allow-Origin":         rewriteOriginHeader,
+	"Report-To":                   rewriteTextHeader,
+	"Reporting-Endpoints":         rewriteTextHeader,
+	"Nel":                         rewriteTextHeader,
+}
+
+// strippedResponseHeaders advertise the services of the upstream, which are not served by the proxy.
+var strippedResponseHeaders = []string{"Alt-Svc"}
+
+// rewriteURLHeader rewrites the value as a URL, which may be relative.
+func rewriteURLHeader(p *ProxyServer, value string, res *http.Response, m hostMapping) string {
+	return p.rewriteLocation(strings.TrimSpace(value), res, m)
+}
+
+// rewriteLinkHeader rewrites the URLs in the angle brackets.
+func rewriteLinkHeader(p *ProxyServer, value string, res *http.Response, m hostMapping) string {
+	return regLinkURL.ReplaceAllStringFunc(value, func(s string) string {
+		return "<" + p.rewriteLocation(s[1:len(s)-1], res, m) + ">"
+	})
+}
+
+// rewriteRefreshHeader rewrites the URL of "5; url=https://example.com/".
+func rewriteRefreshHeader(p *ProxyServer, value string, res *http.Response, m hostMapping) string {
+	sub := regRefresh.FindStringSubmatch(value)
+
+	if sub == nil || sub[3] == "" {
+		return value
+	}
+
+	return sub[1] + sub[2] + p.rewriteLocation(sub[3], res, m) + sub[4]
+}
+
+// rewriteOriginHeader rewrites the origins, "*" and "null" are kept.
+func rewriteOriginHeader(p *ProxyServer, value string, res *http.Response, m hostMapping) string {
+	if !strings.Contains(value, "://") {
+		return value
+	}
+
+	return p.replaceHosts(value, m)
+}
+
+// rewriteTextHeader rewrites the absolute URLs anywhere in the value, eg. the JSON of Report-To.
+func rewriteTextHeader(p *ProxyServer, value string, res *http.Response, m hostMapping) string {
+	return p.replaceHosts(value, m)
+}
+
+// modifyURLHeaders rewrites the URL-bearing response headers, including the configured ones.
+func (p *ProxyServer) modifyURLHeaders(res *http.Response, m hostMapping) {
+	if skipHostMapping(res.Request) {
+		return
+	}
+
+	for _, name := range strippedResponseHeaders {
+		res.Header.Del(name)
+	}
+
+	rewrite := func(name string, rewriter urlHeaderRewriter) {
+		values := res.Header.Values(name)
+
+		if len(values) == 0 {
+			return
+		}
+
+		res.Header.Del(name)
+
+		for _, v := range values {
+			res.Header.Add(name, rewriter(p, v, res, m))
+		}
+	}
+
+	for name, rewriter := range urlHeaders {
+		rewrite(name, rewriter)
+	}
+
+	for _, name := range p.RewriteResponseHeaders {
+		if _, ok := urlHeaders[http.CanonicalHeaderKey(name)]; !ok {
+			rewrite(name, rewriteTextHeader)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package forward
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestProxyServer_modifyURLHeaders(t *testing.T) {
+	m := hostMapping{originHosts: []string{"example.com"}, proxyHost: "localhost:8080"}
+
+	tests := []struct {
+		name        string
+		options     ProxyServerOptions
+		requestURL  string
+		forwarded   bool // requested by a forward proxy client
+		m           hostMapping
+		headers     http.Header
+		wantHeaders http.Header
+	}{
+		{
+			name:       "link",
+			requestURL: "https://example.com/",
+			m:          m,
+			headers:    http.Header{"Link": {"<https://example.com/style.css>; rel=preload; as=style, </app.js>; rel=preload", "<https://cdn.example.org/a.js>; rel=preload"}},
+			wantHeaders: http.Header{
+				"Link": {"<http://localhost:8080/style.css>; rel=preload; as=style, </app.js>; rel=preload", "<https://cdn.example.org/a.js>; rel=preload"},
+			},
+		},
+		{
+			name:       "link of X-Proxy-Target",
+			requestURL: "https://other.com/a/",
+			m:          m,
+			headers:    http.Header{"Link": {"<b.css>; rel=preload"}},
+			wantHeaders: http.Header{
+				"Link": {"<http://localhost:8080/?forward_url=" + url.QueryEscape("https://other.com/a/b.css") + ">; rel=preload"},
+			},
+		},
+		{
+			name:       "refresh and content location",
+			requestURL: "https://example.com/",
+			m:          m,
+			headers:    http.Header{"Refresh": {"5; url='https://example.com/next'"}, "Content-Location": {"https://example.com/index.html"}},
+			wantHeaders: http.Header{
+				"Refresh":          {"5; url='http://localhost:8080/next'"},
+				"Content-Location": {"http://localhost:8080/index.html"},
+			},
+		},
+		{
+			name:       "origins",
+			requestURL: "https://example.com/",
+			m:          m,
+			headers:    http.Header{"Access-Control-Allow-Origin": {"https://example.com"}, "Timing-Allow-Origin": {"*"}},
+			wantHeaders: http.Header{
+				"Access-Control-Allow-Origin": {"http://localhost:8080"},
+				"Timing-Allow-Origin":         {"*"},
+			},
+		},
+		{
+			name:       "alt-svc and report-to",
+			requestURL: "https://example.com/",
+			m:          m,
+			headers:    http.Header{"Alt-Svc": {`h3=":443"; ma=86400`}, "Report-To": {`{"endpoints":[{"url":"https://example.com/reports"}]}`}},
+			wantHeaders: http.Header{
+				"Alt-Svc":   nil,
+				"Report-To": {`{"endpoints":[{"url":"http://localhost:8080/reports"}]}`},
+			},
+		},
+		{
+			name:       "configured header",
+			options:    ProxyServerOptions{RewriteResponseHeaders: []string{"x-next-page"}},
+			requestURL: "https://example.com/",
+			m:          m,
+			headers:    http.Header{"X-Next-Page": {"page=https://example.com/2"}},
+			wantHeaders: http.Header{
+				"X-Next-Page": {"page=http://localhost:8080/2"},
+			},
+		},
+		{
+			name:       "forward proxy",
+			requestURL: "https://example.com/",
+			forwarded:  true,
+			m:          hostMapping{originHosts: m.originHosts, proxyHost: m.proxyHost, forwarded: true},
+			headers:    http.Header{"Link": {"<https://example.com/style.css>; rel=preload"}, "Alt-Svc": {`h3=":443"`}},
+			wantHeaders: http.Header{
+				"Link":    {"<https://example.com/style.css>; rel=preload"},
+				"Alt-Svc": {`h3=":443"`},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			options := tt.options
+			p := &ProxyServer{ProxyServerOptions: &options}
+
+			req, _ := http.NewRequest(http.MethodGet, tt.requestURL, nil)
+
+			if tt.forwarded {
+				req = withForwardTarget(req)
+			}
+			res := &http.Response{StatusCode: http.StatusOK, Header: tt.headers, Request: req}
+
+			p.modifyURLHeaders(res, tt.m)
+
+			for k, v := range tt.wantHeaders {
+				if got := res.Header.Values(k); !reflect.DeepEqual(got, v) && !(len(got) == 0 && len(v) == 0) {
+					t.Errorf("%s = %q, want %q", k, got, v)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,380 @@
+package forward
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultRetryBackoff        = 100 * time.Millisecond
+	defaultRetryMaxBackoff     = 5 * time.Second
+	defaultRetryBodyLimit      = 1 << 20 // 1MB
+	defaultCircuitBreakerReset = 30 * time.Second
+)
+
+var idempotentMethods = map[string]struct{}{
+	http.MethodGet:     {},
+	http.MethodHead:    {},
+	http.MethodOptions: {},
+	http.MethodTrace:   {},
+	http.MethodPut:     {},
+	http.MethodDelete:  {},
+}
+
+// errCircuitOpen is returned without contacting the upstream when its circuit is open.
+type errCircuitOpen struct {
+	host       string
+	retryAfter time.Duration
+}
+
+func (e *errCircuitOpen) Error() string {
+	return fmt.Sprintf("circuit breaker of upstream '%s' is open, retry after %s", e.host, e.retryAfter)
+}
+
+// retryTransport retries idempotent requests on connect errors and configured status codes,
+// and fails fast when the circuit of the upstream is open.
+type retryTransport struct {
+	next         http.RoundTripper
+	retries      int
+	statuses     []int
+	backoff      time.Duration
+	maxBackoff   time.Duration
+	bodyLimit    int64
+	breakers     *circuitBreakers
+	sleepContext func(ctx context.Context, d time.Duration) error
+}
+
+func newRetryTransport(next http.RoundTripper, options *ProxyServerOptions) *retryTransport {
+	t := &retryTransport{
+		next:         next,
+		retries:      options.Retries,
+		statuses:     options.RetryStatuses,
+		backoff:      options.RetryBackoff,
+		maxBackoff:   options.RetryMaxBackoff,
+		bodyLimit:    options.RetryBodyLimit,
+		sleepContext: sleepContext,
+	}
+
+	if t.backoff <= 0 {
+		t.backoff = defaultRetryBackoff
+	}
+
+	if t.maxBackoff <= 0 {
+		t.maxBackoff = defaultRetryMaxBackoff
+	}
+
+	if t.bodyLimit <= 0 {
+		t.bodyLimit = defaultRetryBodyLimit
+	}
+
+	if options.CircuitBreakerThreshold > 0 {
+		t.breakers = newCircuitBreakers(options.CircuitBreakerThreshold, options.CircuitBreakerTimeout)
+	}
+
+	return t
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	retries := t.retries
+
+	if _, ok := idempotentMethods[req.Method]; !ok {
+		retries = 0
+	}
+
+	var body []byte
+
+	// buffer the body for retries, bodies larger than the limit are not retried
+	if retries > 0 && req.Body != nil && req.Body != http.NoBody {
+		b, err := ioutil.ReadAll(io.LimitReader(req.Body, t.bodyLimit+1))
+
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		if int64(len(b)) > t.bodyLimit {
+			retries = 0
+			req = req.Clone(req.Context())
+			req.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(b), req.Body), req.Body}
+		} else {
+			body = b
+			_ = req.Body.Close()
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		r := req
+
+		if body != nil {
+			r = req.Clone(req.Context())
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+
+		res, err := t.roundTrip(r)
+
+		if attempt >= retries || !t.shouldRetry(res, err) {
+			return res, err
+		}
+
+		if res != nil {
+			_, _ = io.Copy(ioutil.Discard, res.Body)
+			_ = res.Body.Close()
+		}
+
+		delay := t.backoffDelay(attempt)
+
+		log.Printf("retry [%s]: %s in %s (attempt %d/%d)\n", req.Method, req.URL.String(), delay, attempt+1, retries)
+
+		if err := t.sleepContext(req.Context(), delay); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (t *retryTransport) roundTrip(req *http.Request) (*http.Response, error) {
+	if t.breakers == nil {
+		return t.next.RoundTrip(req)
+	}
+
+	breaker := t.breakers.get(req.URL.Host)
+
+	if retryAfter, ok := breaker.allow(); !ok {
+		return nil, &errCircuitOpen{host: req.URL.Host, retryAfter: retryAfter}
+	}
+
+	res, err := t.next.RoundTrip(req)
+
+	switch {
+	case errors.Is(err, context.Canceled):
+		// canceled by the client, says nothing about the upstream
+	case err != nil, isUpstreamFailureStatus(res.StatusCode):
+		breaker.failure()
+	default:
+		breaker.success()
+	}
+
+	return res, err
+}
+
+func (t *retryTransport) shouldRetry(res *http.Response, err error) bool {
+	if err != nil {
+		var circuitErr *errCircuitOpen
+		if errors.As(err, &circuitErr) {
+			return false
+		}
+		return isConnectError(err)
+	}
+
+	for _, status := range t.statuses {
+		if res.StatusCode == status {
+			return true
+		}
+	}
+
+	return false
+}
+
+// backoffDelay returns the exponential backoff delay of the attempt.
+func (t *retryTransport) backoffDelay(attempt int) time.Duration {
+	delay := time.Duration(float64(t.backoff) * math.Pow(2, float64(attempt)))
+
+	if delay > t.maxBackoff || delay <= 0 {
+		delay = t.maxBackoff
+	}
+
+	return delay
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func isUpstreamFailureStatus(status int) bool {
+	return status == http.StatusBadGateway || status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout
+}
+
+// isConnectError reports whether the request failed before it was sent to the upstream.
+func isConnectError(err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+
+	var dnsErr *net.DNSError
+
+	return errors.As(err, &dnsErr)
+}
+
+// upstreamErrorStatus maps the error of the upstream round trip to the status code of the response.
+func upstreamErrorStatus(err error) int {
+	var circuitErr *errCircuitOpen
+	if errors.As(err, &circuitErr) {
+		return http.StatusServiceUnavailable
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return http.StatusGatewayTimeout
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return http.StatusGatewayTimeout
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return http.StatusBadGateway
+	}
+
+	if errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) {
+		return http.StatusBadGateway
+	}
+
+	return http.StatusInternalServerError
+}
+
+// upstreamErrorType classifies the error of an upstream request for metrics.
+func upstreamErrorType(err error) string {
+	var circuitErr *errCircuitOpen
+	var netErr net.Error
+	var dnsErr *net.DNSError
+
+	switch {
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.As(err, &circuitErr):
+		return "circuit_open"
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case errors.Is(err, syscall.ECONNRESET):
+		return "reset"
+	default:
+		return "other"
+	}
+}
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+// circuitBreaker opens after the number of consecutive failures, and lets a single
+// trial request through (half-open) once the timeout has elapsed.
+type circuitBreaker struct {
+	mux       sync.Mutex
+	state     circuitState
+	fails     int
+	threshold int
+	timeout   time.Duration
+	openedAt  time.Time
+}
+
+func (c *circuitBreaker) allow() (time.Duration, bool) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	switch c.state {
+	case circuitOpen:
+		if elapsed := time.Since(c.openedAt); elapsed < c.timeout {
+			return c.timeout - elapsed, false
+		}
+		c.state = circuitHalfOpen
+		c.openedAt = time.Now()
+		return 0, true
+	case circuitHalfOpen:
+		// only one trial request at a time, another one is let through if the trial never completes
+		if elapsed := time.Since(c.openedAt); elapsed < c.timeout {
+			return c.timeout - elapsed, false
+		}
+		c.openedAt = time.Now()
+		return 0, true
+	}
+
+	return 0, true
+}
+
+func (c *circuitBreaker) success() {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	c.state = circuitClosed
+	c.fails = 0
+}
+
+func (c *circuitBreaker) failure() {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	c.fails++
+
+	if c.state == circuitHalfOpen || c.fails >= c.threshold {
+		if c.state != circuitOpen {
+			log.Printf("circuit breaker opened after %d consecutive failures\n", c.fails)
+		}
+		c.state = circuitOpen
+		c.openedAt = time.Now()
+	}
+}
+
+// circuitBreakers holds a circuit breaker per upstream host.
+type circuitBreakers struct {
+	mux       sync.Mutex
+	breakers  map[string]*circuitBreaker
+	threshold int
+	timeout   time.Duration
+}
+
+func newCircuitBreakers(threshold int, timeout time.Duration) *circuitBreakers {
+	if timeout <= 0 {
+		timeout = defaultCircuitBreakerReset
+	}
+
+	return &circuitBreakers{
+		breakers:  map[string]*circuitBreaker{},
+		threshold: threshold,
+		timeout:   timeout,
+	}
+}
+
+func (c *circuitBreakers) get(host string) *circuitBreaker {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	breaker, ok := c.breakers[host]
+
+	if !ok {
+		breaker = &circuitBreaker{threshold: c.threshold, timeout: c.timeout}
+		c.breakers[host] = breaker
+	}
+
+	return breaker
+}
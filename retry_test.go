@@ -0,0 +1,111 @@
+package forward
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func newStatusResponse(status int) *http.Response {
+	return &http.Response{StatusCode: status, Body: ioutil.NopCloser(strings.NewReader(""))}
+}
+
+func noSleep(ctx context.Context, d time.Duration) error {
+	return nil
+}
+
+func Test_retryTransport(t *testing.T) {
+	t.Run("retry on status with the same body", func(t *testing.T) {
+		attempts := 0
+
+		transport := newRetryTransport(roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			attempts++
+			if b, _ := ioutil.ReadAll(req.Body); string(b) != "payload" {
+				t.Errorf("body = %q, want %q", b, "payload")
+			}
+			if attempts < 3 {
+				return newStatusResponse(http.StatusServiceUnavailable), nil
+			}
+			return newStatusResponse(http.StatusOK), nil
+		}), &ProxyServerOptions{Retries: 3, RetryStatuses: []int{http.StatusServiceUnavailable}})
+		transport.sleepContext = noSleep
+
+		res, err := transport.RoundTrip(httptest.NewRequest(http.MethodPut, "http://example.com", strings.NewReader("payload")))
+
+		if err != nil || res.StatusCode != http.StatusOK || attempts != 3 {
+			t.Errorf("RoundTrip() = %v, %v after %d attempts", res, err, attempts)
+		}
+	})
+
+	t.Run("do not retry non-idempotent methods", func(t *testing.T) {
+		attempts := 0
+
+		transport := newRetryTransport(roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			attempts++
+			return nil, &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}
+		}), &ProxyServerOptions{Retries: 3})
+		transport.sleepContext = noSleep
+
+		if _, err := transport.RoundTrip(httptest.NewRequest(http.MethodPost, "http://example.com", nil)); err == nil || attempts != 1 {
+			t.Errorf("RoundTrip() = %v after %d attempts", err, attempts)
+		}
+	})
+
+	t.Run("circuit breaker", func(t *testing.T) {
+		attempts := 0
+
+		transport := newRetryTransport(roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			attempts++
+			return nil, &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}
+		}), &ProxyServerOptions{CircuitBreakerThreshold: 2, CircuitBreakerTimeout: time.Minute})
+
+		for i := 0; i < 3; i++ {
+			_, _ = transport.RoundTrip(httptest.NewRequest(http.MethodGet, "http://example.com", nil))
+		}
+
+		_, err := transport.RoundTrip(httptest.NewRequest(http.MethodGet, "http://example.com", nil))
+
+		var circuitErr *errCircuitOpen
+		if !errors.As(err, &circuitErr) || attempts != 2 {
+			t.Errorf("RoundTrip() = %v after %d attempts", err, attempts)
+		}
+
+		if got := upstreamErrorStatus(err); got != http.StatusServiceUnavailable {
+			t.Errorf("upstreamErrorStatus() = %v, want %v", got, http.StatusServiceUnavailable)
+		}
+	})
+}
+
+func Test_upstreamErrorStatus(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{name: "timeout", err: errors.WithStack(context.DeadlineExceeded), want: http.StatusGatewayTimeout},
+		{name: "dns", err: &net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: "example.invalid"}}, want: http.StatusBadGateway},
+		{name: "refused", err: &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, want: http.StatusBadGateway},
+		{name: "other", err: errors.New("unexpected"), want: http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := upstreamErrorStatus(tt.err); got != tt.want {
+				t.Errorf("upstreamErrorStatus() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
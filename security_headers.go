@@ -0,0 +1,194 @@
+package forward
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	SecurityHeaderKeep    = "keep"    // send the header as it is
+	SecurityHeaderStrip   = "strip"   // remove the header
+	SecurityHeaderRewrite = "rewrite" // map the hosts of the upstream in the header to the proxy host, the sources of CSP are parsed
+	SecurityHeaderReport  = "report"  // rewrite Content-Security-Policy as report-only, the violations are logged by forward
+)
+
+const (
+	headerCSP           = "Content-Security-Policy"
+	headerCSPReportOnly = "Content-Security-Policy-Report-Only"
+	headerHSTS          = "Strict-Transport-Security"
+)
+
+// cspReportPath receives the violation reports of the report mode.
+const cspReportPath = "/__forward/csp-report"
+
+// defaultSecurityHeaders are the actions of the headers not configured,
+// Strict-Transport-Security is stripped unless the client connects with TLS.
+var defaultSecurityHeaders = map[string]string{
+	headerCSP:   SecurityHeaderStrip,
+	"Expect-CT": SecurityHeaderStrip,
+}
+
+// ParseSecurityHeader parses the action of the security header like "X-Frame-Options=strip".
+func ParseSecurityHeader(value string) (string, string, error) {
+	kv := strings.SplitN(value, "=", 2)
+
+	if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+		return "", "", fmt.Errorf("invalid security header '%s', it should be <name>=<action>", value)
+	}
+
+	name := http.CanonicalHeaderKey(strings.TrimSpace(kv[0]))
+	action := strings.ToLower(strings.TrimSpace(kv[1]))
+
+	switch action {
+	case SecurityHeaderKeep, SecurityHeaderStrip, SecurityHeaderRewrite:
+	case SecurityHeaderReport:
+		if name != headerCSP {
+			return "", "", fmt.Errorf("the action report only applies to %s", headerCSP)
+		}
+	default:
+		return "", "", fmt.Errorf("invalid action '%s' of the security header '%s'", action, name)
+	}
+
+	return name, action, nil
+}
+
+// securityHeaderAction returns the action of the header.
+func (p *ProxyServer) securityHeaderAction(name string, useSSL bool) string {
+	for k, action := range p.SecurityHeaders {
+		if strings.EqualFold(k, name) {
+			return action
+		}
+	}
+
+	if action, ok := defaultSecurityHeaders[name]; ok {
+		return action
+	}
+
+	if name == headerHSTS && !useSSL {
+		// https://developer.mozilla.org/zh-CN/docs/Web/HTTP/Headers/Strict-Transport-Security
+		return SecurityHeaderStrip
+	}
+
+	return SecurityHeaderKeep
+}
+
+// modifySecurityHeaders applies the actions of the security headers sent by the upstream.
+func (p *ProxyServer) modifySecurityHeaders(header http.Header, m hostMapping) {
+	names := []string{headerCSP, headerCSPReportOnly, headerHSTS, "Expect-CT", "X-Frame-Options", "Permissions-Policy", "Cross-Origin-Opener-Policy", "Cross-Origin-Embedder-Policy", "Cross-Origin-Resource-Policy"}
+
+	for k := range p.SecurityHeaders {
+		if !contains(names, http.CanonicalHeaderKey(k)) {
+			names = append(names, http.CanonicalHeaderKey(k))
+		}
+	}
+
+	for _, name := range names {
+		values := header.Values(name)
+
+		if len(values) == 0 {
+			continue
+		}
+
+		rewrite := p.replaceHosts
+
+		if name == headerCSP || name == headerCSPReportOnly {
+			rewrite = p.rewriteCSP
+		}
+
+		switch p.securityHeaderAction(name, m.useSSL) {
+		case SecurityHeaderStrip:
+			header.Del(name)
+		case SecurityHeaderRewrite:
+			header.Del(name)
+
+			for _, v := range values {
+				header.Add(name, rewrite(v, m))
+			}
+		case SecurityHeaderReport:
+			header.Del(name)
+
+			// the policy is enforced by nobody, but the violations are reported to forward
+			for _, v := range values {
+				header.Add(headerCSPReportOnly, withCSPReportURI(rewrite(v, m)))
+			}
+		}
+	}
+}
+
+// withCSPReportURI replaces the report destinations of the policy with the report endpoint of forward.
+func withCSPReportURI(policy string) string {
+	directives := []string{}
+
+	for _, directive := range strings.Split(policy, ";") {
+		directive = strings.TrimSpace(directive)
+		name := strings.ToLower(strings.SplitN(directive, " ", 2)[0])
+
+		if directive == "" || name == "report-uri" || name == "report-to" {
+			continue
+		}
+
+		directives = append(directives, directive)
+	}
+
+	return strings.Join(append(directives, "report-uri "+cspReportPath), "; ")
+}
+
+// cspReport is the violation report sent with report-uri.
+// https://developer.mozilla.org/en-US/docs/Web/HTTP/Headers/Content-Security-Policy/report-uri
+type cspReport struct {
+	Body struct {
+		DocumentURI        string `json:"document-uri"`
+		ViolatedDirective  string `json:"violated-directive"`
+		EffectiveDirective string `json:"effective-directive"`
+		BlockedURI         string `json:"blocked-uri"`
+		SourceFile         string `json:"source-file"`
+		LineNumber         int    `json:"line-number"`
+	} `json:"csp-report"`
+}
+
+// serveCSPReport logs the violation reports of the report mode, it returns false if the request has been answered.
+func (p *ProxyServer) serveCSPReport(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodPost || r.URL.Path != cspReportPath || p.securityHeaderAction(headerCSP, false) != SecurityHeaderReport {
+		return true
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 64<<10))
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+
+	report := cspReport{}
+
+	if err := json.Unmarshal(body, &report); err != nil {
+		log.Printf("WARN: invalid CSP report: %+v\n", errors.WithStack(err))
+		http.Error(w, "invalid CSP report", http.StatusBadRequest)
+		return false
+	}
+
+	directive := report.Body.EffectiveDirective
+
+	if directive == "" {
+		directive = report.Body.ViolatedDirective
+	}
+
+	source := report.Body.DocumentURI
+
+	if report.Body.SourceFile != "" {
+		source = fmt.Sprintf("%s:%d", report.Body.SourceFile, report.Body.LineNumber)
+	}
+
+	log.Printf("CSP would block '%s' by %s at %s\n", report.Body.BlockedURI, directive, source)
+
+	w.WriteHeader(http.StatusNoContent)
+
+	return false
+}
@@ -0,0 +1,176 @@
+package forward
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseSecurityHeader(t *testing.T) {
+	tests := []struct {
+		name       string
+		value      string
+		wantName   string
+		wantAction string
+		wantErr    bool
+	}{
+		{name: "strip", value: "x-frame-options=strip", wantName: "X-Frame-Options", wantAction: SecurityHeaderStrip},
+		{name: "report", value: "Content-Security-Policy=Report", wantName: headerCSP, wantAction: SecurityHeaderReport},
+		{name: "report other header", value: "X-Frame-Options=report", wantErr: true},
+		{name: "unknown action", value: "X-Frame-Options=drop", wantErr: true},
+		{name: "missing action", value: "X-Frame-Options", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name, action, err := ParseSecurityHeader(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseSecurityHeader() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if name != tt.wantName || action != tt.wantAction {
+				t.Errorf("ParseSecurityHeader() = %v, %v, want %v, %v", name, action, tt.wantName, tt.wantAction)
+			}
+		})
+	}
+}
+
+func Test_withCSPReportURI(t *testing.T) {
+	got := withCSPReportURI("default-src 'self'; report-uri https://example.com/csp; report-to csp-endpoint;")
+	want := "default-src 'self'; report-uri " + cspReportPath
+
+	if got != want {
+		t.Errorf("withCSPReportURI() = %v, want %v", got, want)
+	}
+}
+
+func TestProxyServer_modifySecurityHeaders(t *testing.T) {
+	var upstreamHost string
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Security-Policy", "default-src 'self' http://"+upstreamHost+"; report-uri /csp")
+		w.Header().Set("Content-Security-Policy-Report-Only", "script-src 'none'")
+		w.Header().Set("Strict-Transport-Security", "max-age=31536000")
+		w.Header().Set("Expect-CT", "max-age=86400")
+		w.Header().Set("X-Frame-Options", "DENY")
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte(`<meta http-equiv="Content-Security-Policy" content="default-src 'self'">`))
+	}))
+	defer upstream.Close()
+
+	target, _ := url.Parse(upstream.URL)
+	upstreamHost = target.Host
+
+	tests := []struct {
+		name            string
+		securityHeaders map[string]string
+		wantHeaders     map[string][]string
+		wantMeta        bool
+	}{
+		{
+			name: "defaults",
+			wantHeaders: map[string][]string{
+				"Content-Security-Policy":             nil,
+				"Content-Security-Policy-Report-Only": {"script-src 'none'"},
+				"Strict-Transport-Security":           nil,
+				"Expect-Ct":                           nil,
+				"X-Frame-Options":                     {"DENY"},
+			},
+		},
+		{
+			name:            "keep and strip",
+			securityHeaders: map[string]string{"Content-Security-Policy": SecurityHeaderKeep, "X-Frame-Options": SecurityHeaderStrip, "Expect-CT": SecurityHeaderKeep},
+			wantHeaders: map[string][]string{
+				"Content-Security-Policy": {"default-src 'self' http://{upstream}; report-uri /csp"},
+				"X-Frame-Options":         nil,
+				"Expect-Ct":               {"max-age=86400"},
+			},
+			wantMeta: true,
+		},
+		{
+			name:            "rewrite",
+			securityHeaders: map[string]string{"Content-Security-Policy": SecurityHeaderRewrite},
+			wantHeaders: map[string][]string{
+				"Content-Security-Policy": {"default-src 'self' http://{proxy}; report-uri /csp"},
+			},
+			wantMeta: true,
+		},
+		{
+			name:            "report",
+			securityHeaders: map[string]string{"Content-Security-Policy": SecurityHeaderReport},
+			wantHeaders: map[string][]string{
+				"Content-Security-Policy":             nil,
+				"Content-Security-Policy-Report-Only": {"script-src 'none'", "default-src 'self' http://{proxy}; report-uri " + cspReportPath},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := NewProxyServer(&ProxyServerOptions{Target: target, SecurityHeaders: tt.securityHeaders})
+			defer server.Close()
+
+			proxyServer := httptest.NewServer(http.HandlerFunc(server.Handler()))
+			defer proxyServer.Close()
+
+			proxyHost := strings.TrimPrefix(proxyServer.URL, "http://")
+
+			res, err := http.Get(proxyServer.URL)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			body, _ := ioutil.ReadAll(res.Body)
+			res.Body.Close()
+
+			for k, v := range tt.wantHeaders {
+				for i := range v {
+					v[i] = strings.NewReplacer("{upstream}", upstreamHost, "{proxy}", proxyHost).Replace(v[i])
+				}
+
+				if got := res.Header.Values(k); !reflect.DeepEqual(got, v) && !(len(got) == 0 && len(v) == 0) {
+					t.Errorf("%s = %q, want %q", k, got, v)
+				}
+			}
+
+			if got := strings.Contains(string(body), `http-equiv="Content-Security-Policy"`); got != tt.wantMeta {
+				t.Errorf("meta CSP = %v, want %v", got, tt.wantMeta)
+			}
+		})
+	}
+}
+
+func TestProxyServer_serveCSPReport(t *testing.T) {
+	target, _ := url.Parse("http://127.0.0.1:1")
+
+	server := NewProxyServer(&ProxyServerOptions{Target: target, SecurityHeaders: map[string]string{headerCSP: SecurityHeaderReport}})
+	defer server.Close()
+
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+	}{
+		{
+			name:       "report",
+			body:       `{"csp-report": {"document-uri": "http://localhost/", "effective-directive": "script-src-elem", "blocked-uri": "https://evil.com/a.js"}}`,
+			wantStatus: http.StatusNoContent,
+		},
+		{name: "invalid", body: `{`, wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "http://localhost"+cspReportPath, strings.NewReader(tt.body))
+			w := httptest.NewRecorder()
+
+			server.Handler()(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
@@ -0,0 +1,295 @@
+package forward
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/pkg/errors"
+	"golang.org/x/text/transform"
+)
+
+const (
+	// the size of the buffer reading the stream
+	streamBufferSize = 64 << 10
+	// the max size of the response without Content-Length which is buffered to rewrite entirely,
+	// a larger one is sent as it is
+	streamBufferLimit = 8 << 20
+)
+
+// flushWriter is the encoder of the content encoding, it flushes the encoded data to the client.
+type flushWriter interface {
+	io.WriteCloser
+	Flush() error
+}
+
+type nopFlushWriter struct {
+	io.Writer
+}
+
+func (nopFlushWriter) Flush() error { return nil }
+
+func (nopFlushWriter) Close() error { return nil }
+
+// newContentDecoder returns the reader decompressing the stream with the content encoding.
+func newContentDecoder(encoding string, body io.Reader) (io.Reader, error) {
+	switch encoding {
+	case "gzip":
+		reader, err := gzip.NewReader(body)
+
+		return reader, errors.WithStack(err)
+	case "deflate":
+		reader, err := zlib.NewReader(body)
+
+		return reader, errors.WithStack(err)
+	case "br":
+		return brotli.NewReader(body), nil
+	default:
+		return body, nil
+	}
+}
+
+// newContentEncoder returns the writer compressing the stream with the content encoding.
+func newContentEncoder(encoding string, w io.Writer) flushWriter {
+	switch encoding {
+	case "gzip":
+		return gzip.NewWriter(w)
+	case "deflate":
+		return zlib.NewWriter(w)
+	case "br":
+		return brotli.NewWriter(w)
+	default:
+		return nopFlushWriter{Writer: w}
+	}
+}
+
+// readLine reads an entire line of the stream, including the line break.
+func readLine(reader *bufio.Reader) ([]byte, error) {
+	return reader.ReadBytes('\n')
+}
+
+// readEvent reads an event of the event stream, including the blank line dispatching it.
+// https://html.spec.whatwg.org/multipage/server-sent-events.html#event-stream-interpretation
+func readEvent(reader *bufio.Reader) ([]byte, error) {
+	event := []byte{}
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		event = append(event, line...)
+
+		if err != nil || len(bytes.TrimRight(line, "\r\n")) == 0 {
+			return event, err
+		}
+	}
+}
+
+// rewriteEvent rewrites the data of the event, the data lines are joined so that the JSON data is rewritten structurally.
+func (p *ProxyServer) rewriteEvent(event []byte, m hostMapping) []byte {
+	lines := strings.SplitAfter(string(event), "\n")
+	data := []string{}
+
+	for _, line := range lines {
+		if strings.HasPrefix(line, "data:") {
+			data = append(data, strings.TrimPrefix(strings.TrimRight(line[5:], "\r\n"), " "))
+		}
+	}
+
+	if len(data) == 0 {
+		return event
+	}
+
+	newData := strings.Split(string(p.modifyContent(contentJSON, []byte(strings.Join(data, "\n")), m)), "\n")
+	result := &bytes.Buffer{}
+	written := false
+
+	// the data lines are written at the first one, the replacements may change the number of lines
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "data:") {
+			result.WriteString(line)
+			continue
+		}
+
+		if !written {
+			for _, v := range newData {
+				result.WriteString("data: " + v + "\n")
+			}
+
+			written = true
+		}
+	}
+
+	return result.Bytes()
+}
+
+// lineRewritable reports whether the content of the kind is rewritten correctly line by line.
+// The JSON is rewritten structurally, and the replacements spanning lines match the entire content only.
+func (p *ProxyServer) lineRewritable(kind string) bool {
+	switch kind {
+	case contentJSON, contentManifest:
+		return false
+	}
+
+	for _, paren := range p.ReplaceContent {
+		if from, _, ok := parseReplacement(paren); ok && strings.Contains(from, "\n") {
+			return false
+		}
+	}
+
+	return true
+}
+
+// bufferContent reads the entire body up to the limit to rewrite, it returns false if the body is larger,
+// then the body is restored to be sent as it is.
+func bufferContent(res *http.Response, limit int64) (bool, error) {
+	b, err := ioutil.ReadAll(io.LimitReader(res.Body, limit+1))
+
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+
+	var reader io.Reader = bytes.NewReader(b)
+
+	if int64(len(b)) > limit {
+		reader = io.MultiReader(reader, res.Body)
+	}
+
+	res.Body = struct {
+		io.Reader
+		io.Closer
+	}{reader, res.Body}
+
+	return int64(len(b)) <= limit, nil
+}
+
+// streamContent rewrites the response as a stream, line by line or event by event for the event stream,
+// so that the client receives the content as soon as the upstream sends it. It never reads the entire body.
+func (p *ProxyServer) streamContent(res *http.Response, kind string, encoding string, m hostMapping) error {
+	body := res.Body
+
+	decoded, err := newContentDecoder(encoding, body)
+
+	if err != nil {
+		return err
+	}
+
+	reader := bufio.NewReaderSize(decoded, streamBufferSize)
+	read := readLine
+	rewrite := func(line []byte) []byte {
+		return p.modifyContent(kind, line, m)
+	}
+
+	if kind == contentEventStream {
+		read = readEvent
+		rewrite = func(event []byte) []byte {
+			return p.rewriteEvent(event, m)
+		}
+	}
+
+	var charset *contentCharset
+
+	// the event stream is always UTF-8
+	if kind != contentEventStream {
+		// the BOM, or the declaration in the head of HTML and CSS
+		head := 3
+
+		if kind == contentHTML || kind == contentCSS {
+			head = metaCharsetScanLen
+		}
+
+		prefix, _ := reader.Peek(head)
+		charset = detectCharset(res.Header.Get("Content-Type"), prefix, kind, p.DefaultCharset)
+	}
+
+	bom := []byte{}
+
+	if charset != nil {
+		// the lines are rewritten in UTF-8 and encoded back one by one
+		_, _ = reader.Discard(len(charset.bom))
+		reader = bufio.NewReaderSize(transform.NewReader(reader, charset.encoding.NewDecoder()), streamBufferSize)
+
+		if p.ServeUTF8 {
+			setUTF8Charset(res.Header)
+		} else {
+			bom = charset.bom
+		}
+
+		decodedRewrite := rewrite
+		encoder := charset.encoder(kind)
+		scanned := 0
+		rewrite = func(line []byte) []byte {
+			content := decodedRewrite(line)
+
+			if p.ServeUTF8 {
+				if scanned < metaCharsetScanLen {
+					content = declareUTF8Charset(content, kind)
+				}
+
+				scanned += len(line)
+
+				return content
+			}
+
+			b, err := encoder.Bytes(content)
+
+			if err == nil {
+				return b
+			}
+
+			log.Printf("WARN: encode the rewritten content to %s: %+v\n", charset.name, err)
+
+			// the line is sent as it was read
+			if b, err := encoder.Bytes(line); err == nil {
+				return b
+			}
+
+			return line
+		}
+	}
+
+	pr, pw := io.Pipe()
+
+	go func() {
+		defer body.Close()
+
+		w := newContentEncoder(encoding, pw)
+
+		_, err := w.Write(bom)
+
+		for err == nil {
+			var unit []byte
+
+			unit, err = read(reader)
+
+			if len(unit) > 0 {
+				if _, writeErr := w.Write(rewrite(unit)); writeErr != nil {
+					err = writeErr
+					break
+				}
+			}
+
+			// send the content before waiting for the upstream
+			if err == nil && reader.Buffered() == 0 {
+				err = w.Flush()
+			}
+		}
+
+		if err == io.EOF {
+			err = w.Close()
+		}
+
+		_ = pw.CloseWithError(err)
+	}()
+
+	res.Header.Del("Content-Length")
+	res.ContentLength = -1
+	res.Body = pr
+
+	return nil
+}
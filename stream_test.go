@@ -0,0 +1,324 @@
+package forward
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProxyServer_rewriteEvent(t *testing.T) {
+	m := hostMapping{originHosts: []string{"example.com"}, proxyHost: "localhost:8080"}
+
+	tests := []struct {
+		name    string
+		replace []string
+		event   string
+		want    string
+	}{
+		{
+			name:  "data",
+			event: "id: 1\ndata: https://example.com/a\n\n",
+			want:  "id: 1\ndata: http://localhost:8080/a\n\n",
+		},
+		{
+			name:  "json",
+			event: "event: update\r\ndata:{\"url\":\r\ndata: \"https:\\/\\/example.com\\/a\"}\r\n\r\n",
+			want:  "event: update\r\ndata: {\"url\":\ndata: \"http:\\/\\/localhost:8080\\/a\"}\n\r\n",
+		},
+		{
+			name:  "without data",
+			event: ": ping https://example.com\n\n",
+			want:  ": ping https://example.com\n\n",
+		},
+		{
+			name:    "more lines",
+			replace: []string{"b=c\nd"},
+			event:   "data: a b\nretry: 1000\n\n",
+			want:    "data: a c\ndata: d\nretry: 1000\n\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &ProxyServer{ProxyServerOptions: &ProxyServerOptions{ReplaceContent: tt.replace}, metrics: newMetrics(nil)}
+
+			if got := string(p.rewriteEvent([]byte(tt.event), m)); got != tt.want {
+				t.Errorf("rewriteEvent() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProxyServer_streamContent(t *testing.T) {
+	m := hostMapping{originHosts: []string{"example.com"}, proxyHost: "localhost:8080"}
+
+	gzipped := func(s string) string {
+		buf := &bytes.Buffer{}
+		w := gzip.NewWriter(buf)
+		_, _ = w.Write([]byte(s))
+		_ = w.Close()
+		return buf.String()
+	}
+
+	tests := []struct {
+		name            string
+		options         ProxyServerOptions
+		contentType     string
+		encoding        string
+		kind            string
+		body            string
+		want            string
+		wantContentType string
+	}{
+		{
+			name:            "lines",
+			contentType:     "text/html",
+			kind:            contentHTML,
+			body:            "<a href=\"https://example.com/a\">\n<script integrity=\"sha384-x\" src=\"https://example.com/b.js\"></script>",
+			want:            "<a href=\"http://localhost:8080/a\">\n<script src=\"http://localhost:8080/b.js\"></script>",
+			wantContentType: "text/html",
+		},
+		{
+			name:            "gzip",
+			contentType:     "application/x-ndjson",
+			encoding:        "gzip",
+			kind:            contentJSON,
+			body:            gzipped("{\"url\":\"https:\\/\\/example.com\\/1\"}\n{\"url\":\"https:\\/\\/example.com\\/2\"}\n"),
+			want:            "{\"url\":\"http:\\/\\/localhost:8080\\/1\"}\n{\"url\":\"http:\\/\\/localhost:8080\\/2\"}\n",
+			wantContentType: "application/x-ndjson",
+		},
+		{
+			name:            "gbk",
+			options:         ProxyServerOptions{ReplaceContent: []string{"你好=再见"}},
+			contentType:     "text/plain; charset=gbk",
+			kind:            contentText,
+			body:            encodeCharset(t, "gbk", "你好\nhttps://example.com/首页\n"),
+			want:            encodeCharset(t, "gbk", "再见\nhttp://localhost:8080/首页\n"),
+			wantContentType: "text/plain; charset=gbk",
+		},
+		{
+			name:            "serve utf-8",
+			options:         ProxyServerOptions{ServeUTF8: true},
+			contentType:     "text/html",
+			kind:            contentHTML,
+			body:            encodeCharset(t, "gbk", "<meta charset=\"gbk\">\n<p>你好</p>"),
+			want:            "<meta charset=\"utf-8\">\n<p>你好</p>",
+			wantContentType: "text/html; charset=utf-8",
+		},
+		{
+			name:            "long line",
+			contentType:     "text/javascript",
+			kind:            contentJavaScript,
+			body:            "var a = \"" + strings.Repeat("a", streamBufferSize) + "\", b = \"https://example.com/b\";\n",
+			want:            "var a = \"" + strings.Repeat("a", streamBufferSize) + "\", b = \"http://localhost:8080/b\";\n",
+			wantContentType: "text/javascript",
+		},
+		{
+			name:            "event stream",
+			contentType:     "text/event-stream",
+			kind:            contentEventStream,
+			body:            "data: https://example.com/1\n\ndata: https://example.com/2\n\n",
+			want:            "data: http://localhost:8080/1\n\ndata: http://localhost:8080/2\n\n",
+			wantContentType: "text/event-stream",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &ProxyServer{ProxyServerOptions: &tt.options, metrics: newMetrics(nil)}
+			res := &http.Response{
+				Header:        http.Header{"Content-Type": []string{tt.contentType}, "Content-Length": []string{fmt.Sprint(len(tt.body))}},
+				ContentLength: int64(len(tt.body)),
+				Body:          ioutil.NopCloser(strings.NewReader(tt.body)),
+			}
+
+			if err := p.streamContent(res, tt.kind, tt.encoding, m); err != nil {
+				t.Fatal(err)
+			}
+
+			body, err := ioutil.ReadAll(res.Body)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.encoding != "" {
+				if body, err = decodeContent(tt.encoding, bytes.NewReader(body)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if string(body) != tt.want {
+				t.Errorf("streamContent() = %q, want %q", body, tt.want)
+			}
+
+			if got := res.Header.Get("Content-Type"); got != tt.wantContentType {
+				t.Errorf("Content-Type = %q, want %q", got, tt.wantContentType)
+			}
+
+			if res.ContentLength != -1 || res.Header.Get("Content-Length") != "" {
+				t.Errorf("Content-Length = %d, %q, want none", res.ContentLength, res.Header.Get("Content-Length"))
+			}
+		})
+	}
+}
+
+func TestProxyServer_eventStream(t *testing.T) {
+	next := make(chan struct{})
+
+	var upstreamURL string
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+
+		fmt.Fprintf(w, "data: %s/1\n\n", upstreamURL)
+		w.(http.Flusher).Flush()
+
+		// the second event is sent after the client receives the first one
+		select {
+		case <-next:
+		case <-time.After(5 * time.Second):
+			return
+		}
+
+		fmt.Fprintf(w, "data: %s/2\n\n", upstreamURL)
+	}))
+	defer upstream.Close()
+
+	upstreamURL = upstream.URL
+	target, _ := url.Parse(upstream.URL)
+
+	server := NewProxyServer(&ProxyServerOptions{Target: target, FlushInterval: -1})
+	defer server.Close()
+
+	proxyServer := httptest.NewServer(http.HandlerFunc(server.Handler()))
+	defer proxyServer.Close()
+
+	res, err := http.Get(proxyServer.URL + "/events")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer res.Body.Close()
+
+	reader := bufio.NewReader(res.Body)
+
+	for i := 1; i <= 2; i++ {
+		line, err := reader.ReadString('\n')
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if want := fmt.Sprintf("data: %s/%d\n", proxyServer.URL, i); line != want {
+			t.Errorf("event %d = %q, want %q", i, line, want)
+		}
+
+		_, _ = reader.ReadString('\n')
+
+		if i == 1 {
+			close(next)
+		}
+	}
+}
+
+func TestProxyServer_lineRewritable(t *testing.T) {
+	tests := []struct {
+		name    string
+		replace []string
+		kind    string
+		want    bool
+	}{
+		{name: "html", kind: contentHTML, want: true},
+		{name: "json", kind: contentJSON, want: false},
+		{name: "manifest", kind: contentManifest, want: false},
+		{name: "replacement in a line", replace: []string{"a=b\nc"}, kind: contentText, want: true},
+		{name: "replacement spanning lines", replace: []string{"a\nb=c"}, kind: contentText, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &ProxyServer{ProxyServerOptions: &ProxyServerOptions{ReplaceContent: tt.replace}}
+
+			if got := p.lineRewritable(tt.kind); got != tt.want {
+				t.Errorf("lineRewritable() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProxyServer_withoutContentLength(t *testing.T) {
+	var upstreamURL string
+
+	large := "{\"url\":\"https://example.com\",\"padding\":\"" + strings.Repeat("a", streamBufferLimit) + "\"}"
+
+	tests := []struct {
+		name        string
+		replace     []string
+		contentType string
+		body        func() string
+		want        func(proxyURL string) string
+	}{
+		{
+			name:        "json",
+			contentType: "application/json",
+			body:        func() string { return "{\n\"url\": \"" + strings.ReplaceAll(upstreamURL, "/", `\/`) + `\/a"` + "\n}" },
+			want: func(proxyURL string) string {
+				return "{\n\"url\": \"" + strings.ReplaceAll(proxyURL, "/", `\/`) + `\/a"` + "\n}"
+			},
+		},
+		{
+			name:        "replacement spanning lines",
+			replace:     []string{"a\nb=c"},
+			contentType: "text/plain",
+			body:        func() string { return "a\nb\n" + upstreamURL },
+			want:        func(proxyURL string) string { return "c\n" + proxyURL },
+		},
+		{
+			name:        "json larger than the limit",
+			contentType: "application/json",
+			body:        func() string { return large },
+			want:        func(proxyURL string) string { return large },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tt.contentType)
+				// the response is chunked
+				w.(http.Flusher).Flush()
+				_, _ = w.Write([]byte(tt.body()))
+			}))
+			defer upstream.Close()
+
+			upstreamURL = upstream.URL
+			target, _ := url.Parse(upstream.URL)
+
+			server := NewProxyServer(&ProxyServerOptions{Target: target, ReplaceContent: tt.replace})
+			defer server.Close()
+
+			proxyServer := httptest.NewServer(http.HandlerFunc(server.Handler()))
+			defer proxyServer.Close()
+
+			res, err := http.Get(proxyServer.URL)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer res.Body.Close()
+
+			body, _ := ioutil.ReadAll(res.Body)
+
+			if want := tt.want(proxyServer.URL); string(body) != want {
+				t.Errorf("body = %.200q, want %.200q", body, want)
+			}
+		})
+	}
+}
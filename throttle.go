@@ -0,0 +1,372 @@
+package forward
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// throttle paces data to the bandwidth in bytes per second.
+type throttle struct {
+	bytesPerSecond int64
+	start          time.Time
+	sent           int64
+}
+
+func newThrottle(bytesPerSecond int64) *throttle {
+	return &throttle{bytesPerSecond: bytesPerSecond}
+}
+
+// chunkSize returns the size of data sent at once, about 100ms worth of data.
+func (t *throttle) chunkSize() int {
+	size := t.bytesPerSecond / 10
+
+	if size < 1 {
+		size = 1
+	}
+
+	return int(size)
+}
+
+// wait blocks until n more bytes can be sent without exceeding the bandwidth.
+func (t *throttle) wait(ctx context.Context, n int) error {
+	if t.start.IsZero() {
+		t.start = time.Now()
+	}
+
+	t.sent += int64(n)
+
+	due := t.start.Add(time.Duration(float64(t.sent) / float64(t.bytesPerSecond) * float64(time.Second)))
+
+	if delay := time.Until(due); delay > 0 {
+		return sleepContext(ctx, delay)
+	}
+
+	return nil
+}
+
+// throttledResponseWriter writes the response body at the bandwidth of the throttle.
+type throttledResponseWriter struct {
+	http.ResponseWriter
+	ctx      context.Context
+	throttle *throttle
+}
+
+func (w *throttledResponseWriter) Write(b []byte) (int, error) {
+	written := 0
+
+	for len(b) > 0 {
+		chunk := b
+
+		if size := w.throttle.chunkSize(); len(chunk) > size {
+			chunk = chunk[:size]
+		}
+
+		if err := w.throttle.wait(w.ctx, len(chunk)); err != nil {
+			return written, err
+		}
+
+		n, err := w.ResponseWriter.Write(chunk)
+		written += n
+
+		if err != nil {
+			return written, err
+		}
+
+		w.Flush()
+
+		b = b[len(chunk):]
+	}
+
+	return written, nil
+}
+
+func (w *throttledResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *throttledResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// throttledReader reads the request body at the bandwidth of the throttle.
+type throttledReader struct {
+	io.ReadCloser
+	ctx      context.Context
+	throttle *throttle
+}
+
+func (r *throttledReader) Read(b []byte) (int, error) {
+	if size := r.throttle.chunkSize(); len(b) > size {
+		b = b[:size]
+	}
+
+	n, err := r.ReadCloser.Read(b)
+
+	if n > 0 {
+		if werr := r.throttle.wait(r.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+
+	return n, err
+}
+
+// NetworkProfile simulates a slow network link.
+type NetworkProfile struct {
+	Down int64         // the download bandwidth in kbps, unlimited if 0
+	Up   int64         // the upload bandwidth in kbps, unlimited if 0
+	RTT  time.Duration // the round-trip time added to each request
+}
+
+// NetworkProfiles are the built-in profiles, similar to the presets of browser devtools.
+var NetworkProfiles = map[string]NetworkProfile{
+	"2g":      {Down: 280, Up: 256, RTT: 800 * time.Millisecond},
+	"slow-3g": {Down: 400, Up: 400, RTT: 400 * time.Millisecond},
+	"3g":      {Down: 1600, Up: 768, RTT: 300 * time.Millisecond},
+	"slow-4g": {Down: 1600, Up: 750, RTT: 150 * time.Millisecond},
+	"4g":      {Down: 9000, Up: 9000, RTT: 170 * time.Millisecond},
+}
+
+// ParseNetworkProfile parses the name of a built-in profile,
+// or a custom profile like "down=500,up=100,rtt=200ms" in kbps.
+func ParseNetworkProfile(value string) (NetworkProfile, error) {
+	if profile, ok := NetworkProfiles[strings.ToLower(strings.TrimSpace(value))]; ok {
+		return profile, nil
+	}
+
+	profile := NetworkProfile{}
+
+	for _, paren := range splitEscaped(value, ',') {
+		kv := strings.SplitN(strings.TrimSpace(paren), "=", 2)
+
+		if len(kv) != 2 {
+			return profile, fmt.Errorf("unknown network profile '%s'", value)
+		}
+
+		var err error
+
+		switch kv[0] {
+		case "down":
+			profile.Down, err = strconv.ParseInt(kv[1], 10, 64)
+		case "up":
+			profile.Up, err = strconv.ParseInt(kv[1], 10, 64)
+		case "rtt":
+			profile.RTT, err = time.ParseDuration(kv[1])
+		default:
+			err = fmt.Errorf("unknown key '%s'", kv[0])
+		}
+
+		if err != nil {
+			return profile, errors.Wrapf(err, "invalid network profile '%s'", value)
+		}
+	}
+
+	return profile, nil
+}
+
+// bytesPerSecond converts the bandwidth in kbps.
+func bytesPerSecond(kbps int64) int64 {
+	return kbps * 1000 / 8
+}
+
+const (
+	ThrottleClient   = "client"   // throttle the connection of the client
+	ThrottleUpstream = "upstream" // throttle the connection of the upstream
+	ThrottleBoth     = "both"     // throttle both connections
+)
+
+// ThrottleRule applies the network profile to the matched requests.
+type ThrottleRule struct {
+	Path    string         // regular expression matching the URL path, matches all if empty
+	Profile NetworkProfile // the simulated link
+	Side    string         // the throttled connection: client, upstream or both, defaults to client
+
+	path *regexp.Regexp
+}
+
+// ParseThrottleRule parses the rule like "path=^/api,profile=3g,side=upstream",
+// the profile could also be custom like "down=500,up=100,rtt=200ms". Commas in the path are escaped as "\,".
+func ParseThrottleRule(value string) (ThrottleRule, error) {
+	rule := ThrottleRule{}
+	custom := []string{}
+
+	for _, paren := range splitEscaped(value, ',') {
+		kv := strings.SplitN(strings.TrimSpace(paren), "=", 2)
+
+		if len(kv) != 2 {
+			return rule, fmt.Errorf("invalid throttle '%s'", value)
+		}
+
+		switch kv[0] {
+		case "path":
+			rule.Path = kv[1]
+		case "side":
+			rule.Side = kv[1]
+		case "profile":
+			profile, err := ParseNetworkProfile(kv[1])
+
+			if err != nil {
+				return rule, err
+			}
+
+			rule.Profile = profile
+		default:
+			custom = append(custom, paren)
+		}
+	}
+
+	if len(custom) > 0 {
+		profile, err := ParseNetworkProfile(strings.Join(custom, ","))
+
+		if err != nil {
+			return rule, err
+		}
+
+		rule.Profile = profile
+	}
+
+	return rule, rule.compile()
+}
+
+func (t *ThrottleRule) compile() error {
+	switch t.Side {
+	case "":
+		t.Side = ThrottleClient
+	case ThrottleClient, ThrottleUpstream, ThrottleBoth:
+	default:
+		return fmt.Errorf("invalid throttle side '%s', it should be client, upstream or both", t.Side)
+	}
+
+	if t.Path == "" {
+		t.path = nil
+		return nil
+	}
+
+	reg, err := regexp.Compile(t.Path)
+
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	t.path = reg
+
+	return nil
+}
+
+func newThrottleRules(rules []ThrottleRule) []ThrottleRule {
+	compiled := []ThrottleRule{}
+
+	for _, rule := range rules {
+		if err := rule.compile(); err != nil {
+			log.Printf("WARN: ignore the throttle: %+v\n", err)
+			continue
+		}
+
+		compiled = append(compiled, rule)
+	}
+
+	return compiled
+}
+
+type upstreamThrottleContextKey struct{}
+
+// throttleRequest applies the network profile selected by the header or the first matched rule.
+// The client connection is throttled by wrapping the response writer and request body,
+// the upstream connection is throttled by the transport.
+func (p *ProxyServer) throttleRequest(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, *http.Request, error) {
+	var rule *ThrottleRule
+
+	if value := r.Header.Get(headerXForwardThrottle); value != "" && p.ThrottleHeader {
+		r.Header.Del(headerXForwardThrottle)
+
+		profile, err := ParseNetworkProfile(value)
+
+		if err != nil {
+			return w, r, err
+		}
+
+		rule = &ThrottleRule{Profile: profile, Side: ThrottleClient}
+	} else {
+		for i := range p.throttles {
+			if p.throttles[i].path == nil || p.throttles[i].path.MatchString(r.URL.Path) {
+				rule = &p.throttles[i]
+				break
+			}
+		}
+	}
+
+	if rule == nil {
+		return w, r, nil
+	}
+
+	if rule.Side == ThrottleUpstream || rule.Side == ThrottleBoth {
+		r = r.WithContext(context.WithValue(r.Context(), upstreamThrottleContextKey{}, rule.Profile))
+	}
+
+	if rule.Side == ThrottleUpstream {
+		return w, r, nil
+	}
+
+	if rule.Profile.RTT > 0 {
+		if err := sleepContext(r.Context(), rule.Profile.RTT); err != nil {
+			return w, r, err
+		}
+	}
+
+	if rule.Profile.Up > 0 && r.Body != nil && r.Body != http.NoBody {
+		r.Body = &throttledReader{ReadCloser: r.Body, ctx: r.Context(), throttle: newThrottle(bytesPerSecond(rule.Profile.Up))}
+	}
+
+	if rule.Profile.Down > 0 {
+		w = &throttledResponseWriter{ResponseWriter: w, ctx: r.Context(), throttle: newThrottle(bytesPerSecond(rule.Profile.Down))}
+	}
+
+	return w, r, nil
+}
+
+// throttleTransport throttles the connection of the upstream with the profile in the request context.
+type throttleTransport struct {
+	http.RoundTripper
+}
+
+func (t *throttleTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	profile, ok := req.Context().Value(upstreamThrottleContextKey{}).(NetworkProfile)
+
+	if !ok {
+		return t.RoundTripper.RoundTrip(req)
+	}
+
+	if profile.RTT > 0 {
+		if err := sleepContext(req.Context(), profile.RTT); err != nil {
+			return nil, err
+		}
+	}
+
+	if profile.Up > 0 && req.Body != nil && req.Body != http.NoBody {
+		req = req.Clone(req.Context())
+		req.Body = &throttledReader{ReadCloser: req.Body, ctx: req.Context(), throttle: newThrottle(bytesPerSecond(profile.Up))}
+	}
+
+	res, err := t.RoundTripper.RoundTrip(req)
+
+	if err != nil {
+		return res, err
+	}
+
+	if profile.Down > 0 {
+		res.Body = &throttledReader{ReadCloser: res.Body, ctx: req.Context(), throttle: newThrottle(bytesPerSecond(profile.Down))}
+	}
+
+	return res, nil
+}
@@ -0,0 +1,137 @@
+package forward
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseThrottleRule(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    ThrottleRule
+		wantErr bool
+	}{
+		{
+			name:  "built-in profile",
+			value: "path=^/api,profile=slow-3g",
+			want:  ThrottleRule{Path: "^/api", Profile: NetworkProfiles["slow-3g"], Side: ThrottleClient},
+		},
+		{
+			name:  "custom profile",
+			value: "down=500,up=100,rtt=200ms,side=upstream",
+			want:  ThrottleRule{Profile: NetworkProfile{Down: 500, Up: 100, RTT: 200 * time.Millisecond}, Side: ThrottleUpstream},
+		},
+		{
+			name:  "escaped comma",
+			value: `path=^/v\d{1\,2}/,profile=3g`,
+			want:  ThrottleRule{Path: `^/v\d{1,2}/`, Profile: NetworkProfiles["3g"], Side: ThrottleClient},
+		},
+		{name: "unknown profile", value: "profile=5g", wantErr: true},
+		{name: "invalid side", value: "profile=3g,side=server", wantErr: true},
+		{name: "invalid bandwidth", value: "down=fast", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseThrottleRule(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseThrottleRule() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if tt.wantErr {
+				return
+			}
+			if got.Path != tt.want.Path || got.Profile != tt.want.Profile || got.Side != tt.want.Side {
+				t.Errorf("ParseThrottleRule() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProxyServer_throttle(t *testing.T) {
+	body := strings.Repeat("a", 2000)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		_, _ = w.Write([]byte(body))
+	}))
+	defer upstream.Close()
+
+	dir := t.TempDir()
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "local.bin"), []byte(body), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	target, _ := url.Parse(upstream.URL)
+
+	server := NewProxyServer(&ProxyServerOptions{
+		Target:          target,
+		OverwriteFolder: dir,
+		ThrottleHeader:  true,
+		Throttles: []ThrottleRule{
+			// 80 kbps is 10000 bytes per second
+			{Path: "^/upstream", Profile: NetworkProfile{Down: 80, RTT: 50 * time.Millisecond}, Side: ThrottleUpstream},
+		},
+	})
+	defer server.Close()
+
+	proxyServer := httptest.NewServer(http.HandlerFunc(server.Handler()))
+	defer proxyServer.Close()
+
+	get := func(path, profile string) (time.Duration, error) {
+		req, _ := http.NewRequest(http.MethodGet, proxyServer.URL+path, nil)
+
+		if profile != "" {
+			req.Header.Set(headerXForwardThrottle, profile)
+		}
+
+		start := time.Now()
+
+		res, err := http.DefaultClient.Do(req)
+
+		if err != nil {
+			return 0, err
+		}
+
+		defer res.Body.Close()
+
+		b, err := ioutil.ReadAll(res.Body)
+
+		if string(b) != body {
+			t.Errorf("GET %s: body length = %d, want %d", path, len(b), len(body))
+		}
+
+		return time.Since(start), err
+	}
+
+	tests := []struct {
+		name    string
+		path    string
+		profile string
+		min     time.Duration
+		max     time.Duration
+	}{
+		{name: "not throttled", path: "/local.bin", max: 150 * time.Millisecond},
+		{name: "overwrite folder by header", path: "/local.bin", profile: "down=80,rtt=50ms", min: 250 * time.Millisecond},
+		{name: "upstream by rule", path: "/upstream", min: 250 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			elapsed, err := get(tt.path, tt.profile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if elapsed < tt.min || (tt.max > 0 && elapsed > tt.max) {
+				t.Errorf("GET %s took %v, want between %v and %v", tt.path, elapsed, tt.min, tt.max)
+			}
+		})
+	}
+}
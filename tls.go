@@ -0,0 +1,83 @@
+package forward
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+)
+
+// UpstreamTLSOptions controls the TLS connections to upstreams.
+type UpstreamTLSOptions struct {
+	RootCAFiles        []string // extra root CAs in PEM format, trusted besides the system roots
+	InsecureSkipVerify bool     // do not verify the certificate of upstreams
+	CertFile           string   // client certificate for mTLS
+	KeyFile            string   // client key for mTLS
+	ServerName         string   // override the server name (SNI) sent to upstreams
+	MinVersion         uint16   // the minimum TLS version, eg. tls.VersionTLS12
+}
+
+// NewUpstreamTLSConfig loads the files of the options and returns the TLS config for upstreams.
+func NewUpstreamTLSConfig(options UpstreamTLSOptions) (*tls.Config, error) {
+	config := &tls.Config{
+		InsecureSkipVerify: options.InsecureSkipVerify,
+		ServerName:         options.ServerName,
+		MinVersion:         options.MinVersion,
+	}
+
+	if len(options.RootCAFiles) > 0 {
+		pool, err := x509.SystemCertPool()
+
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+
+		for _, file := range options.RootCAFiles {
+			b, err := ioutil.ReadFile(file)
+
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+
+			if !pool.AppendCertsFromPEM(b) {
+				return nil, fmt.Errorf("no certificate found in CA file '%s'", file)
+			}
+		}
+
+		config.RootCAs = pool
+	}
+
+	if options.CertFile != "" || options.KeyFile != "" {
+		if options.CertFile == "" || options.KeyFile == "" {
+			return nil, errors.New("both client certificate and key are required for mTLS")
+		}
+
+		cert, err := tls.LoadX509KeyPair(options.CertFile, options.KeyFile)
+
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+// ParseTLSVersion parses the TLS version like "1.2".
+func ParseTLSVersion(version string) (uint16, error) {
+	switch version {
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+
+	return 0, fmt.Errorf("invalid TLS version '%s'", version)
+}
@@ -0,0 +1,63 @@
+package forward
+
+import (
+	"crypto/tls"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewUpstreamTLSConfig(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer upstream.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+
+	if err := ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: upstream.Certificate().Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	target, _ := url.Parse(upstream.URL)
+
+	trusted, err := NewUpstreamTLSConfig(UpstreamTLSOptions{RootCAFiles: []string{caFile}})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		options *ProxyServerOptions
+		wantErr bool
+	}{
+		{name: "untrusted", options: &ProxyServerOptions{}, wantErr: true},
+		{name: "extra root CA", options: &ProxyServerOptions{UpstreamTLSConfig: trusted}},
+		{name: "per host", options: &ProxyServerOptions{UpstreamTLSConfigs: map[string]*tls.Config{target.Host: trusted}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, upstream.URL, nil)
+			req.RequestURI = ""
+
+			res, err := newUpstreamTransport(tt.options).RoundTrip(req)
+
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("RoundTrip() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if err == nil {
+				res.Body.Close()
+			}
+		})
+	}
+
+	if _, err := NewUpstreamTLSConfig(UpstreamTLSOptions{CertFile: "cert.pem"}); err == nil {
+		t.Errorf("NewUpstreamTLSConfig() without key should fail")
+	}
+}
@@ -0,0 +1,497 @@
+package forward
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	headerTraceparent = "Traceparent"
+	headerTracestate  = "Tracestate"
+
+	defaultTraceServiceName = "forward-cli"
+
+	traceBatchSize     = 512
+	traceFlushInterval = 5 * time.Second
+)
+
+// the span kinds of OTLP
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+)
+
+type spanContextKey struct{}
+
+type spanAttribute struct {
+	key   string
+	value interface{} // string, int or bool
+}
+
+// span is a timed operation of a trace, following the W3C trace context.
+type span struct {
+	tracer     *tracer
+	traceID    [16]byte
+	spanID     [8]byte
+	parentID   [8]byte
+	sampled    bool
+	tracestate string
+	name       string
+	kind       int
+	start      time.Time
+
+	mux        sync.Mutex
+	end        time.Time
+	attributes []spanAttribute
+	err        string
+}
+
+func (s *span) setAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+
+	s.mux.Lock()
+	s.attributes = append(s.attributes, spanAttribute{key: key, value: value})
+	s.mux.Unlock()
+}
+
+func (s *span) setError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+
+	s.mux.Lock()
+	s.err = err.Error()
+	s.mux.Unlock()
+}
+
+func (s *span) finish() {
+	if s == nil {
+		return
+	}
+
+	s.mux.Lock()
+	s.end = time.Now()
+	s.mux.Unlock()
+
+	if s.sampled {
+		s.tracer.record(s)
+	}
+}
+
+// traceparent formats the span as the traceparent header.
+func (s *span) traceparent() string {
+	flags := "00"
+
+	if s.sampled {
+		flags = "01"
+	}
+
+	return fmt.Sprintf("00-%s-%s-%s", hex.EncodeToString(s.traceID[:]), hex.EncodeToString(s.spanID[:]), flags)
+}
+
+// parseTraceparent parses the traceparent header like "00-<trace id>-<parent id>-<flags>".
+func parseTraceparent(value string) (traceID [16]byte, parentID [8]byte, sampled bool, ok bool) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return
+	}
+
+	// future versions may append fields
+	if parts[0] == "00" && len(parts) != 4 {
+		return
+	}
+
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil || traceID == [16]byte{} {
+		return
+	}
+
+	if _, err := hex.Decode(parentID[:], []byte(parts[2])); err != nil || parentID == [8]byte{} {
+		return
+	}
+
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+
+	if err != nil {
+		return
+	}
+
+	return traceID, parentID, flags&1 == 1, true
+}
+
+func spanFromContext(ctx context.Context) *span {
+	s, _ := ctx.Value(spanContextKey{}).(*span)
+
+	return s
+}
+
+// spanExporter sends the finished spans to the backend.
+type spanExporter interface {
+	export(payload []byte) error
+}
+
+// otlpHTTPExporter posts the spans to an OTLP/HTTP collector in the JSON encoding.
+type otlpHTTPExporter struct {
+	endpoint string
+	client   *http.Client
+}
+
+func (e *otlpHTTPExporter) export(payload []byte) error {
+	res, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(payload))
+
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("OTLP endpoint '%s' responded with status %d", e.endpoint, res.StatusCode)
+	}
+
+	return nil
+}
+
+// fileExporter appends the spans to a file, a JSON line per batch in the OTLP JSON encoding.
+type fileExporter struct {
+	file string
+}
+
+func (e *fileExporter) export(payload []byte) error {
+	f, err := os.OpenFile(e.file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	defer f.Close()
+
+	if _, err := f.Write(append(payload, '\n')); err != nil {
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
+
+// tracer starts spans and exports them in batches.
+// A nil tracer starts no span, so tracing costs nothing when it is disabled.
+type tracer struct {
+	serviceName string
+	exporter    spanExporter
+	spans       chan *span
+	flush       chan chan struct{}
+	stop        chan struct{}
+	stopped     chan struct{}
+}
+
+func newTracer(options *ProxyServerOptions) *tracer {
+	var exporter spanExporter
+
+	switch {
+	case options.TraceEndpoint != "":
+		endpoint := options.TraceEndpoint
+
+		if u, err := url.Parse(endpoint); err == nil && (u.Path == "" || u.Path == "/") {
+			endpoint = strings.TrimRight(endpoint, "/") + "/v1/traces"
+		}
+
+		exporter = &otlpHTTPExporter{endpoint: endpoint, client: &http.Client{Timeout: 10 * time.Second}}
+	case options.TraceFile != "":
+		exporter = &fileExporter{file: options.TraceFile}
+	default:
+		return nil
+	}
+
+	t := &tracer{
+		serviceName: options.TraceServiceName,
+		exporter:    exporter,
+		spans:       make(chan *span, traceBatchSize*4),
+		flush:       make(chan chan struct{}),
+		stop:        make(chan struct{}),
+		stopped:     make(chan struct{}),
+	}
+
+	if t.serviceName == "" {
+		t.serviceName = defaultTraceServiceName
+	}
+
+	go t.run()
+
+	return t
+}
+
+// startSpan starts a child span of the span in the context.
+func (t *tracer) startSpan(ctx context.Context, name string, kind int) (context.Context, *span) {
+	if t == nil {
+		return ctx, nil
+	}
+
+	s := &span{tracer: t, name: name, kind: kind, start: time.Now(), sampled: true}
+
+	if parent := spanFromContext(ctx); parent != nil {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+		s.sampled = parent.sampled
+		s.tracestate = parent.tracestate
+	} else {
+		_, _ = rand.Read(s.traceID[:])
+	}
+
+	_, _ = rand.Read(s.spanID[:])
+
+	return context.WithValue(ctx, spanContextKey{}, s), s
+}
+
+// startServerSpan starts the span of a client request, continuing the trace of the traceparent header.
+func (t *tracer) startServerSpan(r *http.Request) (*http.Request, *span) {
+	if t == nil {
+		return r, nil
+	}
+
+	ctx := r.Context()
+
+	if traceID, parentID, sampled, ok := parseTraceparent(r.Header.Get(headerTraceparent)); ok {
+		// a remote parent only carries the context of the trace
+		ctx = context.WithValue(ctx, spanContextKey{}, &span{
+			traceID:    traceID,
+			spanID:     parentID,
+			sampled:    sampled,
+			tracestate: r.Header.Get(headerTracestate),
+		})
+	}
+
+	ctx, s := t.startSpan(ctx, "HTTP "+r.Method, spanKindServer)
+
+	s.setAttribute("http.method", r.Method)
+	s.setAttribute("http.target", r.URL.RequestURI())
+	s.setAttribute("http.host", r.Host)
+	s.setAttribute("net.peer.ip", clientIP(r))
+
+	return r.WithContext(ctx), s
+}
+
+func (t *tracer) record(s *span) {
+	select {
+	case t.spans <- s:
+	default:
+		// drop the span rather than blocking the request
+	}
+}
+
+func (t *tracer) run() {
+	defer close(t.stopped)
+
+	ticker := time.NewTicker(traceFlushInterval)
+	defer ticker.Stop()
+
+	batch := []*span{}
+
+	export := func() {
+		if len(batch) == 0 {
+			return
+		}
+
+		if err := t.exporter.export(t.encode(batch)); err != nil {
+			log.Printf("WARN: export %d spans: %+v\n", len(batch), err)
+		}
+
+		batch = []*span{}
+	}
+
+	for {
+		select {
+		case s := <-t.spans:
+			batch = append(batch, s)
+
+			if len(batch) >= traceBatchSize {
+				export()
+			}
+		case <-ticker.C:
+			export()
+		case done := <-t.flush:
+			for len(t.spans) > 0 {
+				batch = append(batch, <-t.spans)
+			}
+			export()
+			close(done)
+		case <-t.stop:
+			for len(t.spans) > 0 {
+				batch = append(batch, <-t.spans)
+			}
+			export()
+			return
+		}
+	}
+}
+
+// forceFlush exports the recorded spans immediately.
+func (t *tracer) forceFlush() {
+	if t == nil {
+		return
+	}
+
+	done := make(chan struct{})
+
+	select {
+	case t.flush <- done:
+		<-done
+	case <-t.stopped:
+	}
+}
+
+// close exports the remaining spans and stops the tracer.
+func (t *tracer) close() {
+	if t == nil {
+		return
+	}
+
+	close(t.stop)
+	<-t.stopped
+}
+
+// encode marshals the spans as an OTLP ExportTraceServiceRequest in the JSON encoding.
+func (t *tracer) encode(batch []*span) []byte {
+	type keyValue struct {
+		Key   string                 `json:"key"`
+		Value map[string]interface{} `json:"value"`
+	}
+
+	type status struct {
+		Code    int    `json:"code"`
+		Message string `json:"message,omitempty"`
+	}
+
+	type otlpSpan struct {
+		TraceID           string     `json:"traceId"`
+		SpanID            string     `json:"spanId"`
+		ParentSpanID      string     `json:"parentSpanId,omitempty"`
+		TraceState        string     `json:"traceState,omitempty"`
+		Name              string     `json:"name"`
+		Kind              int        `json:"kind"`
+		StartTimeUnixNano string     `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+		Attributes        []keyValue `json:"attributes,omitempty"`
+		Status            status     `json:"status"`
+	}
+
+	attribute := func(key string, value interface{}) keyValue {
+		switch v := value.(type) {
+		case int:
+			return keyValue{Key: key, Value: map[string]interface{}{"intValue": strconv.Itoa(v)}}
+		case int64:
+			return keyValue{Key: key, Value: map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}}
+		case bool:
+			return keyValue{Key: key, Value: map[string]interface{}{"boolValue": v}}
+		default:
+			return keyValue{Key: key, Value: map[string]interface{}{"stringValue": fmt.Sprint(v)}}
+		}
+	}
+
+	spans := make([]otlpSpan, 0, len(batch))
+
+	for _, s := range batch {
+		s.mux.Lock()
+
+		o := otlpSpan{
+			TraceID:           hex.EncodeToString(s.traceID[:]),
+			SpanID:            hex.EncodeToString(s.spanID[:]),
+			TraceState:        s.tracestate,
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		}
+
+		if s.parentID != [8]byte{} {
+			o.ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+
+		for _, a := range s.attributes {
+			o.Attributes = append(o.Attributes, attribute(a.key, a.value))
+		}
+
+		if s.err != "" {
+			o.Status = status{Code: 2, Message: s.err}
+		}
+
+		s.mux.Unlock()
+
+		spans = append(spans, o)
+	}
+
+	payload, _ := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": []keyValue{attribute("service.name", t.serviceName)},
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]interface{}{"name": "github.com/axetroy/forward-cli"},
+						"spans": spans,
+					},
+				},
+			},
+		},
+	})
+
+	return payload
+}
+
+// tracingTransport records a client span for every upstream round-trip,
+// and propagates the trace context to the upstream.
+type tracingTransport struct {
+	http.RoundTripper
+	tracer *tracer
+}
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, s := t.tracer.startSpan(req.Context(), "HTTP "+req.Method, spanKindClient)
+	defer s.finish()
+
+	s.setAttribute("http.method", req.Method)
+	s.setAttribute("http.url", req.URL.String())
+	s.setAttribute("net.peer.name", req.URL.Host)
+
+	outreq := req.Clone(ctx)
+	outreq.Header.Set(headerTraceparent, s.traceparent())
+
+	if s.tracestate != "" {
+		outreq.Header.Set(headerTracestate, s.tracestate)
+	}
+
+	res, err := t.RoundTripper.RoundTrip(outreq)
+
+	if err != nil {
+		s.setError(err)
+		return res, err
+	}
+
+	// the response is handled in the context of the request, eg. rewriting is not part of the round-trip
+	res.Request = req
+
+	s.setAttribute("http.status_code", res.StatusCode)
+
+	if res.StatusCode >= http.StatusInternalServerError {
+		s.setError(fmt.Errorf("upstream responded with status %d", res.StatusCode))
+	}
+
+	return res, nil
+}
@@ -0,0 +1,175 @@
+package forward
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func Test_parseTraceparent(t *testing.T) {
+	tests := []struct {
+		name        string
+		value       string
+		wantSampled bool
+		wantOK      bool
+	}{
+		{name: "sampled", value: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", wantSampled: true, wantOK: true},
+		{name: "not sampled", value: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", wantOK: true},
+		{name: "future version", value: "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", wantSampled: true, wantOK: true},
+		{name: "zero trace id", value: "00-00000000000000000000000000000000-00f067aa0ba902b7-01"},
+		{name: "invalid version", value: "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+		{name: "invalid hex", value: "00-4bf92f3577b34da6a3ce929d0e0e473z-00f067aa0ba902b7-01"},
+		{name: "empty", value: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, sampled, ok := parseTraceparent(tt.value)
+			if sampled != tt.wantSampled || ok != tt.wantOK {
+				t.Errorf("parseTraceparent() = %v, %v, want %v, %v", sampled, ok, tt.wantSampled, tt.wantOK)
+			}
+		})
+	}
+}
+
+type otlpRequest struct {
+	ResourceSpans []struct {
+		ScopeSpans []struct {
+			Spans []struct {
+				TraceID      string `json:"traceId"`
+				SpanID       string `json:"spanId"`
+				ParentSpanID string `json:"parentSpanId"`
+				Name         string `json:"name"`
+				Kind         int    `json:"kind"`
+			} `json:"spans"`
+		} `json:"scopeSpans"`
+	} `json:"resourceSpans"`
+}
+
+func TestProxyServer_tracing(t *testing.T) {
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+
+	var upstreamTraceparent string
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamTraceparent = r.Header.Get(headerTraceparent)
+
+		var b bytes.Buffer
+		gz := gzip.NewWriter(&b)
+		_, _ = gz.Write([]byte("hello"))
+		_ = gz.Close()
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Content-Encoding", "gzip")
+		_, _ = w.Write(b.Bytes())
+	}))
+	defer upstream.Close()
+
+	var (
+		mux      sync.Mutex
+		received []otlpRequest
+		path     string
+	)
+
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req otlpRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("decode OTLP request: %v", err)
+		}
+		mux.Lock()
+		path = r.URL.Path
+		received = append(received, req)
+		mux.Unlock()
+	}))
+	defer collector.Close()
+
+	target, _ := url.Parse(upstream.URL)
+
+	server := NewProxyServer(&ProxyServerOptions{
+		Target:        target,
+		TraceEndpoint: collector.URL,
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(headerTraceparent, "00-"+traceID+"-00f067aa0ba902b7-01")
+
+	w := httptest.NewRecorder()
+	server.Handler()(w, req)
+
+	server.Close()
+
+	if !strings.HasPrefix(upstreamTraceparent, "00-"+traceID+"-") || strings.Contains(upstreamTraceparent, "00f067aa0ba902b7") {
+		t.Errorf("traceparent of upstream = %q, want a child of trace %s", upstreamTraceparent, traceID)
+	}
+
+	if path != "/v1/traces" {
+		t.Errorf("path = %q, want %q", path, "/v1/traces")
+	}
+
+	ids := map[string]string{} // name -> span id
+	parents := map[string]string{}
+
+	for _, req := range received {
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				for _, s := range ss.Spans {
+					if s.TraceID != traceID {
+						t.Errorf("span %s in trace %s, want %s", s.Name, s.TraceID, traceID)
+					}
+					key := fmt.Sprintf("%s/%d", s.Name, s.Kind)
+					ids[key] = s.SpanID
+					parents[key] = s.ParentSpanID
+				}
+			}
+		}
+	}
+
+	if parents["HTTP GET/2"] != "00f067aa0ba902b7" {
+		t.Errorf("parent of the server span = %q, want the remote parent", parents["HTTP GET/2"])
+	}
+
+	for name, parent := range map[string]string{
+		"HTTP GET/3":      "HTTP GET/2",
+		"rewrite/1":       "HTTP GET/2",
+		"decompress/1":    "rewrite/1",
+		"modifyContent/1": "rewrite/1",
+		"recompress/1":    "rewrite/1",
+	} {
+		if ids[name] == "" || parents[name] != ids[parent] {
+			t.Errorf("span %s = %q with parent %q, want a child of %s %q", name, ids[name], parents[name], parent, ids[parent])
+		}
+	}
+}
+
+func Test_fileExporter(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "spans.json")
+
+	tr := newTracer(&ProxyServerOptions{TraceFile: file})
+
+	_, s := tr.startSpan(httptest.NewRequest(http.MethodGet, "/", nil).Context(), "test", spanKindInternal)
+	s.setAttribute("count", 1)
+	s.finish()
+
+	tr.forceFlush()
+	tr.close()
+
+	b, err := ioutil.ReadFile(file)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{`"name":"test"`, `"intValue":"1"`, `"stringValue":"forward-cli"`} {
+		if !strings.Contains(string(b), want) {
+			t.Errorf("file = %s, want %s", b, want)
+		}
+	}
+}
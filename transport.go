@@ -0,0 +1,233 @@
+package forward
+
+import (
+	"crypto/tls"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// upstreamTransport routes requests to the transport configured for the upstream host,
+// requests to other hosts use the default transport.
+type upstreamTransport struct {
+	base  *http.Transport
+	hosts map[string]*http.Transport // keyed by host or host name
+}
+
+// newUpstreamTransport returns the transport used to connect upstreams, including hosts reached via forward_url.
+func newUpstreamTransport(options *ProxyServerOptions) *upstreamTransport {
+	t := &upstreamTransport{
+		base:  newTransport(options, options.UpstreamTLSConfig),
+		hosts: map[string]*http.Transport{},
+	}
+
+	if options.UpstreamTLSConfig != nil && options.UpstreamTLSConfig.InsecureSkipVerify {
+		log.Println("WARNING: TLS certificate verification of upstreams is DISABLED, connections are vulnerable to man-in-the-middle attacks!")
+	}
+
+	for host, config := range options.UpstreamTLSConfigs {
+		if config != nil && config.InsecureSkipVerify {
+			log.Printf("WARNING: TLS certificate verification of upstream '%s' is DISABLED, connections are vulnerable to man-in-the-middle attacks!\n", host)
+		}
+
+		t.hosts[strings.ToLower(host)] = newTransport(options, config)
+	}
+
+	return t
+}
+
+func (t *upstreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.transportFor(req.URL).RoundTrip(req)
+}
+
+func (t *upstreamTransport) transportFor(u *url.URL) *http.Transport {
+	if transport, ok := t.hosts[strings.ToLower(u.Host)]; ok {
+		return transport
+	}
+
+	if transport, ok := t.hosts[strings.ToLower(u.Hostname())]; ok {
+		return transport
+	}
+
+	return t.base
+}
+
+// clone returns a copy of the transport with every member transformed by fn.
+func (t *upstreamTransport) clone(fn func(*http.Transport) *http.Transport) *upstreamTransport {
+	c := &upstreamTransport{
+		base:  fn(t.base),
+		hosts: map[string]*http.Transport{},
+	}
+
+	for host, transport := range t.hosts {
+		c.hosts[host] = fn(transport)
+	}
+
+	return c
+}
+
+// newTransport returns a transport tuned by the options.
+// The zero value of an option keeps the default of http.DefaultTransport.
+func newTransport(options *ProxyServerOptions, tlsConfig *tls.Config) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+
+	if options.DialTimeout > 0 {
+		dialer.Timeout = options.DialTimeout
+	}
+
+	// negative value disables TCP keep-alive probes
+	if options.KeepAlive != 0 {
+		dialer.KeepAlive = options.KeepAlive
+	}
+
+	transport.DialContext = dialer.DialContext
+	transport.Proxy = newProxySelector(options).proxy
+	transport.DisableKeepAlives = options.DisableKeepAlives
+	// the upstream encodes as the client accepts, the body and Content-Length are not decompressed transparently
+	transport.DisableCompression = true
+
+	if options.TLSHandshakeTimeout > 0 {
+		transport.TLSHandshakeTimeout = options.TLSHandshakeTimeout
+	}
+
+	if options.ResponseHeaderTimeout > 0 {
+		transport.ResponseHeaderTimeout = options.ResponseHeaderTimeout
+	}
+
+	if options.MaxIdleConns > 0 {
+		transport.MaxIdleConns = options.MaxIdleConns
+	}
+
+	if options.MaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = options.MaxIdleConnsPerHost
+	}
+
+	if options.MaxConnsPerHost > 0 {
+		transport.MaxConnsPerHost = options.MaxConnsPerHost
+	}
+
+	if options.IdleConnTimeout > 0 {
+		transport.IdleConnTimeout = options.IdleConnTimeout
+	}
+
+	if tlsConfig != nil {
+		transport.TLSClientConfig = tlsConfig.Clone()
+	}
+
+	return transport
+}
+
+// Server returns a http server listening on the address with the server-side timeouts of the options.
+func (p *ProxyServer) Server(addr string) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           http.HandlerFunc(p.Handler()),
+		ReadTimeout:       p.ServerReadTimeout,
+		ReadHeaderTimeout: p.ServerReadHeaderTimeout,
+		WriteTimeout:      p.ServerWriteTimeout,
+		IdleTimeout:       p.ServerIdleTimeout,
+	}
+}
+
+// proxySelector chooses the outbound proxy (HTTP CONNECT or SOCKS5) of a request.
+type proxySelector struct {
+	defaultProxy *url.URL
+	hosts        map[string]*url.URL // per host pattern, nil means direct
+	noProxy      []string
+}
+
+func newProxySelector(options *ProxyServerOptions) *proxySelector {
+	s := &proxySelector{
+		defaultProxy: options.UpstreamProxy,
+		hosts:        map[string]*url.URL{},
+		noProxy:      options.NoProxy,
+	}
+
+	for pattern, u := range options.UpstreamProxies {
+		s.hosts[strings.ToLower(pattern)] = u
+	}
+
+	return s
+}
+
+// proxy returns the proxy of the request, nil for direct connection.
+// Per host overrides win over the no-proxy list, which wins over the default proxy.
+// Without a default proxy, the proxy environment variables are honoured.
+func (s *proxySelector) proxy(req *http.Request) (*url.URL, error) {
+	host := req.URL.Host
+
+	// the exact host wins over patterns
+	for _, key := range []string{host, req.URL.Hostname()} {
+		if u, ok := s.hosts[strings.ToLower(key)]; ok {
+			return u, nil
+		}
+	}
+
+	// the most specific (longest) pattern wins
+	matched := ""
+
+	for pattern := range s.hosts {
+		if matchHostPattern(pattern, host) && len(pattern) > len(matched) {
+			matched = pattern
+		}
+	}
+
+	if matched != "" {
+		return s.hosts[matched], nil
+	}
+
+	for _, pattern := range s.noProxy {
+		if matchHostPattern(pattern, host) {
+			return nil, nil
+		}
+	}
+
+	if s.defaultProxy != nil {
+		return s.defaultProxy, nil
+	}
+
+	return http.ProxyFromEnvironment(req)
+}
+
+// matchHostPattern reports whether the host matches the pattern.
+// The pattern could be "*", a host with or without port, a domain suffix like ".example.com"
+// or "*.example.com", or a CIDR like "10.0.0.0/8".
+func matchHostPattern(pattern, host string) bool {
+	pattern = strings.ToLower(strings.TrimSpace(pattern))
+	host = strings.ToLower(host)
+
+	if pattern == "" {
+		return false
+	}
+
+	if pattern == "*" || pattern == host {
+		return true
+	}
+
+	hostname := host
+
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+
+	if pattern == hostname {
+		return true
+	}
+
+	if _, cidr, err := net.ParseCIDR(pattern); err == nil {
+		ip := net.ParseIP(hostname)
+		return ip != nil && cidr.Contains(ip)
+	}
+
+	suffix := strings.TrimPrefix(pattern, "*")
+
+	return strings.HasPrefix(suffix, ".") && (strings.HasSuffix(hostname, suffix) || hostname == suffix[1:])
+}
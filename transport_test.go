@@ -0,0 +1,69 @@
+package forward
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func Test_matchHostPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		host    string
+		want    bool
+	}{
+		{pattern: "*", host: "example.com", want: true},
+		{pattern: "example.com", host: "example.com:443", want: true},
+		{pattern: "example.com:8080", host: "example.com:443", want: false},
+		{pattern: ".example.com", host: "api.example.com", want: true},
+		{pattern: "*.example.com", host: "example.com", want: true},
+		{pattern: ".example.com", host: "badexample.com", want: false},
+		{pattern: "10.0.0.0/8", host: "10.1.2.3:80", want: true},
+		{pattern: "10.0.0.0/8", host: "192.168.1.1", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.host, func(t *testing.T) {
+			if got := matchHostPattern(tt.pattern, tt.host); got != tt.want {
+				t.Errorf("matchHostPattern() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_proxySelector(t *testing.T) {
+	corporate, _ := url.Parse("http://proxy.corp:3128")
+	tunnel, _ := url.Parse("socks5://127.0.0.1:1080")
+
+	selector := newProxySelector(&ProxyServerOptions{
+		UpstreamProxy: corporate,
+		UpstreamProxies: map[string]*url.URL{
+			".internal.example.com": tunnel,
+			"example.com":           nil,
+		},
+		NoProxy: []string{"10.0.0.0/8"},
+	})
+
+	tests := []struct {
+		url  string
+		want *url.URL
+	}{
+		{url: "https://example.com/", want: nil},
+		{url: "https://api.internal.example.com/", want: tunnel},
+		{url: "http://10.0.0.1/", want: nil},
+		{url: "https://cdn.example.org/?forward_url=1", want: corporate},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			got, err := selector.proxy(httptest.NewRequest(http.MethodGet, tt.url, nil))
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got != tt.want {
+				t.Errorf("proxy() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
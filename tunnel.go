@@ -0,0 +1,249 @@
+package forward
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// dialTunnel connects the host of the CONNECT request, through the outbound proxy selected for the host if any.
+func (p *ProxyServer) dialTunnel(ctx context.Context, host string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: p.DialTimeout}
+
+	if dialer.Timeout <= 0 {
+		dialer.Timeout = 30 * time.Second
+	}
+
+	proxyURL, err := p.proxies.proxy(&http.Request{URL: &url.URL{Scheme: "https", Host: host}, Header: http.Header{}})
+
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	if proxyURL == nil {
+		return dialer.DialContext(ctx, "tcp", host)
+	}
+
+	switch proxyURL.Scheme {
+	case "http", "https":
+		return dialHTTPTunnel(ctx, dialer, proxyURL, host)
+	case "socks5", "socks5h":
+		return dialSOCKS5(ctx, dialer, proxyURL, host)
+	default:
+		return nil, fmt.Errorf("unsupported outbound proxy scheme '%s'", proxyURL.Scheme)
+	}
+}
+
+// proxyAddr returns the address of the outbound proxy with the default port of the scheme.
+func proxyAddr(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+
+	port := "80"
+
+	switch u.Scheme {
+	case "https":
+		port = "443"
+	case "socks5", "socks5h":
+		port = "1080"
+	}
+
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// dialHTTPTunnel opens the tunnel to the host with a CONNECT request to the HTTP proxy.
+func dialHTTPTunnel(ctx context.Context, dialer *net.Dialer, proxyURL *url.URL, host string) (net.Conn, error) {
+	conn, err := dialer.DialContext(ctx, "tcp", proxyAddr(proxyURL))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if proxyURL.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: proxyURL.Hostname()})
+
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			_ = conn.Close()
+			return nil, errors.WithStack(err)
+		}
+
+		conn = tlsConn
+	}
+
+	_ = conn.SetDeadline(time.Now().Add(dialer.Timeout))
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: host},
+		Host:   host,
+		Header: http.Header{},
+	}
+
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(proxyURL.User.Username()+":"+password)))
+	}
+
+	if err := req.Write(conn); err != nil {
+		_ = conn.Close()
+		return nil, errors.WithStack(err)
+	}
+
+	reader := bufio.NewReader(conn)
+	res, err := http.ReadResponse(reader, req)
+
+	if err != nil {
+		_ = conn.Close()
+		return nil, errors.WithStack(err)
+	}
+
+	_ = res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		_ = conn.Close()
+		return nil, fmt.Errorf("the outbound proxy %s refused to connect %s: %s", proxyURL.Host, host, res.Status)
+	}
+
+	_ = conn.SetDeadline(time.Time{})
+
+	return &bufferedConn{Conn: conn, r: reader}, nil
+}
+
+// dialSOCKS5 opens the tunnel to the host with the SOCKS5 proxy, the host name is resolved by the proxy.
+// https://www.rfc-editor.org/rfc/rfc1928
+func dialSOCKS5(ctx context.Context, dialer *net.Dialer, proxyURL *url.URL, host string) (net.Conn, error) {
+	hostname, portStr, err := net.SplitHostPort(host)
+
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	port, err := strconv.Atoi(portStr)
+
+	if err != nil || len(hostname) > 255 {
+		return nil, fmt.Errorf("invalid address '%s'", host)
+	}
+
+	conn, err := dialer.DialContext(ctx, "tcp", proxyAddr(proxyURL))
+
+	if err != nil {
+		return nil, err
+	}
+
+	_ = conn.SetDeadline(time.Now().Add(dialer.Timeout))
+
+	if err := socks5Handshake(conn, proxyURL.User, hostname, port); err != nil {
+		_ = conn.Close()
+		return nil, errors.Wrapf(err, "SOCKS5 proxy %s", proxyURL.Host)
+	}
+
+	_ = conn.SetDeadline(time.Time{})
+
+	return conn, nil
+}
+
+func socks5Handshake(conn net.Conn, user *url.Userinfo, hostname string, port int) error {
+	methods := []byte{0x00} // no authentication
+
+	if user != nil {
+		methods = []byte{0x02} // username/password
+	}
+
+	if _, err := conn.Write(append([]byte{0x05, byte(len(methods))}, methods...)); err != nil {
+		return errors.WithStack(err)
+	}
+
+	reply := make([]byte, 2)
+
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return errors.WithStack(err)
+	}
+
+	if reply[0] != 0x05 || reply[1] != methods[0] {
+		return errors.New("no acceptable authentication method")
+	}
+
+	// https://www.rfc-editor.org/rfc/rfc1929
+	if user != nil {
+		password, _ := user.Password()
+		auth := []byte{0x01, byte(len(user.Username()))}
+		auth = append(auth, user.Username()...)
+		auth = append(auth, byte(len(password)))
+		auth = append(auth, password...)
+
+		if _, err := conn.Write(auth); err != nil {
+			return errors.WithStack(err)
+		}
+
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return errors.WithStack(err)
+		}
+
+		if reply[1] != 0x00 {
+			return errors.New("authentication failed")
+		}
+	}
+
+	req := []byte{0x05, 0x01, 0x00}
+
+	if ip := net.ParseIP(hostname); ip == nil {
+		req = append(append(req, 0x03, byte(len(hostname))), hostname...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(append(req, 0x01), ip4...)
+	} else {
+		req = append(append(req, 0x04), ip.To16()...)
+	}
+
+	req = append(req, byte(port>>8), byte(port))
+
+	if _, err := conn.Write(req); err != nil {
+		return errors.WithStack(err)
+	}
+
+	head := make([]byte, 4)
+
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return errors.WithStack(err)
+	}
+
+	if head[1] != 0x00 {
+		return fmt.Errorf("connect failed with reply %d", head[1])
+	}
+
+	// the bound address is not used
+	var skip int
+
+	switch head[3] {
+	case 0x01:
+		skip = net.IPv4len
+	case 0x04:
+		skip = net.IPv6len
+	case 0x03:
+		length := make([]byte, 1)
+
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return errors.WithStack(err)
+		}
+
+		skip = int(length[0])
+	default:
+		return fmt.Errorf("invalid address type %d", head[3])
+	}
+
+	if _, err := io.ReadFull(conn, make([]byte, skip+2)); err != nil {
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
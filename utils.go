@@ -21,26 +21,8 @@ func contains(s []string, str string) bool {
 }
 
 var (
-	urlWithSchemeRegExp    *regexp.Regexp
-	hostNameRegexp         = regexp.MustCompile(`^(([a-zA-Z]{1})|([a-zA-Z]{1}[a-zA-Z]{1})|([a-zA-Z]{1}[0-9]{1})|([0-9]{1}[a-zA-Z]{1})|([a-zA-Z0-9][a-zA-Z0-9-_]{1,61}[a-zA-Z0-9]))\.([a-zA-Z]{2,6}|[a-zA-Z0-9-]{2,30}\.[a-zA-Z]{2,3})$`)
-	rewriteContentExtNames = map[string]struct{}{
-		".html":  {},
-		".htm":   {},
-		".xhtml": {},
-		".xml":   {},
-		".yml":   {},
-		".yaml":  {},
-		".css":   {},
-		".js":    {},
-		".txt":   {},
-		".text":  {},
-		".json":  {},
-	}
-	htmlExtNames = map[string]struct{}{
-		".html":  {},
-		".htm":   {},
-		".xhtml": {},
-	}
+	urlWithSchemeRegExp *regexp.Regexp
+	hostNameRegexp      = regexp.MustCompile(`^(([a-zA-Z]{1})|([a-zA-Z]{1}[a-zA-Z]{1})|([a-zA-Z]{1}[0-9]{1})|([0-9]{1}[a-zA-Z]{1})|([a-zA-Z0-9][a-zA-Z0-9-_]{1,61}[a-zA-Z0-9]))\.([a-zA-Z]{2,6}|[a-zA-Z0-9-]{2,30}\.[a-zA-Z]{2,3})$`)
 )
 
 func init() {
@@ -51,29 +33,12 @@ func init() {
 	}
 }
 
-func isHttpUrl(u string) bool {
-	return regexp.MustCompile(`^https?:\/\/`).MatchString(u)
-}
-
-func isShouldReplaceContent(extNames []string) bool {
-	for _, extName := range extNames {
-		if _, ok := rewriteContentExtNames[extName]; ok {
-			return true
-		}
-	}
-	return false
-}
-
-func isHtml(extNames []string) bool {
-	for _, extName := range extNames {
-		if _, ok := htmlExtNames[extName]; ok {
-			return true
-		}
-	}
-	return false
+func replaceHost(content, oldHost, newHost string, useSSL bool, proxyExternal bool, proxyExternalIgnores []string) string {
+	return replaceHosts(content, []string{oldHost}, newHost, useSSL, proxyExternal, proxyExternalIgnores)
 }
 
-func replaceHost(content, oldHost, newHost string, useSSL bool, proxyExternal bool, proxyExternalIgnores []string) string {
+// replaceHosts is like replaceHost, but any of the old hosts is replaced with the new host.
+func replaceHosts(content string, oldHosts []string, newHost string, useSSL bool, proxyExternal bool, proxyExternalIgnores []string) string {
 	newContent := urlWithSchemeRegExp.ReplaceAllStringFunc(content, func(s string) string {
 		matchUrl, err := url.Parse(s)
 
@@ -104,9 +69,9 @@ func replaceHost(content, oldHost, newHost string, useSSL bool, proxyExternal bo
 					escapedValue := strings.Join(arr[1:], "=")
 
 					if unescapedValue, err := url.QueryUnescape(escapedValue); err == nil {
-						escapedValue = url.QueryEscape(replaceHost(unescapedValue, oldHost, newHost, useSSL, proxyExternal, proxyExternalIgnores))
+						escapedValue = url.QueryEscape(replaceHosts(unescapedValue, oldHosts, newHost, useSSL, proxyExternal, proxyExternalIgnores))
 					} else {
-						escapedValue = replaceHost(escapedValue, oldHost, newHost, useSSL, proxyExternal, proxyExternalIgnores)
+						escapedValue = replaceHosts(escapedValue, oldHosts, newHost, useSSL, proxyExternal, proxyExternalIgnores)
 					}
 
 					query = append(query, key+"="+escapedValue)
@@ -117,7 +82,7 @@ func replaceHost(content, oldHost, newHost string, useSSL bool, proxyExternal bo
 		}
 
 		// if the host not match the target
-		if matchUrl.Host != oldHost {
+		if !contains(oldHosts, matchUrl.Host) {
 			// do not proxy external link
 			if !proxyExternal {
 				return s
@@ -159,7 +124,7 @@ func replaceHost(content, oldHost, newHost string, useSSL bool, proxyExternal bo
 			}
 		}
 
-		s = strings.Replace(s, oldHost, newHost, 1)
+		s = strings.Replace(s, matchUrl.Host, newHost, 1)
 
 		return s
 	})